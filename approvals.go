@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+// Number of distinct admins who must approve a plug before it goes live,
+// overridden with PLUG_REQUIRED_APPROVALS.
+const DEFAULT_REQUIRED_APPROVALS = 2
+
+const SQL_CREATE_PLUG_APPROVALS_TABLE = `CREATE TABLE plug_approvals (
+plug_id         INTEGER NOT NULL REFERENCES plugs(id) ON DELETE CASCADE,
+uid             VARCHAR(32) NOT NULL,
+time            TIMESTAMP NOT NULL,
+PRIMARY KEY (plug_id, uid)
+);`
+
+const SQL_ADD_PLUG_APPROVAL = `INSERT INTO plug_approvals (plug_id, uid, time)
+VALUES ($1::integer, $2::text, $3)
+ON CONFLICT (plug_id, uid) DO NOTHING`
+
+const SQL_RETRIEVE_PLUG_APPROVERS = `SELECT plug_id, uid FROM plug_approvals
+WHERE plug_id = ANY($1::integer[])
+ORDER BY time`
+
+const SQL_CLEAR_PLUG_APPROVALS = `DELETE FROM plug_approvals WHERE plug_id = ANY($1::integer[])`
+
+func parseRequiredApprovals(value string) int {
+	if value == "" {
+		return DEFAULT_REQUIRED_APPROVALS
+	}
+	required, err := strconv.Atoi(value)
+	if err != nil || required < 1 {
+		log.Fatal("PLUG_REQUIRED_APPROVALS must be a positive number")
+	}
+	return required
+}
+
+// AddPlugApproval records uid's vote for plug, returning the admins who
+// have now approved it.
+func (c DBConnection) AddPlugApproval(plug Plug, uid string) []string {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_ADD_PLUG_APPROVAL, plug.ID, uid, time.Now())
+	c.app.metrics.ObserveDependency("postgres", "add_plug_approval", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+	return c.GetPlugApprovers([]int{plug.ID})[plug.ID]
+}
+
+// GetPlugApprovers returns who has approved each of the given plugs so far,
+// in the order they voted.
+func (c DBConnection) GetPlugApprovers(ids []int) map[int][]string {
+	approvers := make(map[int][]string)
+	start := time.Now()
+	rows, err := c.con.Query(SQL_RETRIEVE_PLUG_APPROVERS, pq.Array(ids))
+	c.app.metrics.ObserveDependency("postgres", "get_plug_approvers", start, err)
+	if err != nil {
+		log.Error(err)
+		return approvers
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var uid string
+		err = rows.Scan(&id, &uid)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		approvers[id] = append(approvers[id], uid)
+	}
+	return approvers
+}
+
+func (c DBConnection) ClearPlugApprovals(ids []int) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_CLEAR_PLUG_APPROVALS, pq.Array(ids))
+	c.app.metrics.ObserveDependency("postgres", "clear_plug_approvals", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// refuseOwnApproval reports whether actor manages plug, auditing the refused
+// approval if they do.
+func (a *PlugApplication) refuseOwnApproval(plug Plug, actor string) bool {
+	if !a.CanManagePlug(actor, plug) {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"uid":     actor,
+		"plug_id": plug.ID,
+	}).Warn("Refused approval of a plug by its owner")
+	a.db.Audit(actor, AUDIT_PLUG_APPROVAL_REFUSED, plug.ID, SEVERITY_WARNING, map[string]interface{}{
+		"reason": "owner",
+	})
+	return true
+}
+
+// ApprovePlugs records actor's approval of each plug, putting live those
+// which now have enough approvals. Nobody's vote counts on a plug they own.
+// It returns the plugs newly approved.
+func (a *PlugApplication) ApprovePlugs(plugs []Plug, actor string) []Plug {
+	var ready []int
+	for _, plug := range plugs {
+		if plug.Approved || a.refuseOwnApproval(plug, actor) {
+			continue
+		}
+
+		approvers := a.db.AddPlugApproval(plug, actor)
+		a.db.Audit(actor, AUDIT_PLUG_APPROVAL_VOTE, plug.ID, SEVERITY_INFO, map[string]interface{}{
+			"approvers": approvers,
+			"required":  a.required_approvals,
+		})
+		if len(approvers) >= a.required_approvals {
+			ready = append(ready, plug.ID)
+		}
+	}
+	if len(ready) == 0 {
+		return nil
+	}
+	return a.PutPlugsLive(ready, actor)
+}
+
+// ForceApprovePlugs puts plugs live without waiting for votes, auditing it as
+// an override. Plugs actor manages are still refused.
+func (a *PlugApplication) ForceApprovePlugs(plugs []Plug, actor string) []Plug {
+	var ids []int
+	for _, plug := range plugs {
+		if plug.Approved || a.refuseOwnApproval(plug, actor) {
+			continue
+		}
+		a.db.Audit(actor, AUDIT_PLUG_APPROVAL_FORCED, plug.ID, SEVERITY_WARNING, map[string]interface{}{
+			"approvers": a.db.GetPlugApprovers([]int{plug.ID})[plug.ID],
+			"required":  a.required_approvals,
+		})
+		ids = append(ids, plug.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return a.PutPlugsLive(ids, actor)
+}
+
+// PutPlugsLive approves plugs without waiting for votes, letting their
+// owners and webhooks know. It returns the plugs newly approved.
+func (a *PlugApplication) PutPlugsLive(ids []int, actor string) []Plug {
+	approved := a.db.ApprovePlugs(ids)
+	for _, plug := range approved {
+		a.db.Audit(actor, AUDIT_PLUG_APPROVED, plug.ID, SEVERITY_INFO, nil)
+		a.notifier.Notify(Notification{Kind: NOTIFY_APPROVED, Plug: plug})
+		a.webhooks.Emit(EVENT_PLUG_APPROVED, plug, actor, nil)
+	}
+	return approved
+}
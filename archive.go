@@ -0,0 +1,689 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// An archive is a gzipped tar holding manifest.json, which lists every plug
+// along with its approvals, impressions, ledger entries and audit events,
+// followed by each plug's image under objects/. Importing gives plugs and
+// sites new IDs and rewrites the references to them, so an archive can be
+// restored into any empty deployment. Site tokens, pricing rules, settings
+// and webhooks aren't included.
+
+const ARCHIVE_VERSION = 1
+
+const (
+	ARCHIVE_MANIFEST    = "manifest.json"
+	ARCHIVE_OBJECTS_DIR = "objects/"
+)
+
+const SQL_EXPORT_SITES = `SELECT id, host, name, created FROM sites ORDER BY id`
+
+const SQL_EXPORT_PLUG_SITES = `SELECT plug_id, site_id FROM plug_sites ORDER BY plug_id, site_id`
+
+const SQL_EXPORT_PLUG_APPROVALS = `SELECT plug_id, uid, time FROM plug_approvals ORDER BY plug_id, time`
+
+const SQL_EXPORT_IMPRESSIONS = `SELECT to_char(day, 'YYYY-MM-DD'), plug_id, site_id, count
+FROM impressions ORDER BY day, plug_id, site_id`
+
+const SQL_EXPORT_LEDGER = `SELECT id, time, uid, COALESCE(plug_id, 0), credits, views, reason
+FROM credit_ledger ORDER BY id`
+
+const SQL_EXPORT_AUDIT_EVENTS = `SELECT id, time, actor, action, COALESCE(plug_id, 0), details, severity
+FROM audit_events ORDER BY id`
+
+// Rows which mean the database isn't empty. Sites may already exist, and
+// are matched by host.
+const SQL_COUNT_ARCHIVE_ROWS = `SELECT
+(SELECT COUNT(*) FROM plugs) + (SELECT COUNT(*) FROM credit_ledger) + (SELECT COUNT(*) FROM impressions)`
+
+const SQL_IMPORT_SITE = `INSERT INTO sites (host, name, created)
+VALUES ($1::text, $2::text, $3)
+ON CONFLICT (host) DO UPDATE SET host = EXCLUDED.host
+RETURNING id`
+
+const SQL_IMPORT_PLUG = `INSERT INTO plugs (s3id, owner, owner_group, views, approved, paused, credits_paid,
+views_purchased, created, claimed_by, claimed_at, title, alt_text, description, approved_at, ends_at, paced, weight,
+image_size, content_type, archived_at, archived_by, archive_reason, image_purged_at)
+VALUES ($1::text, $2::text, $3::text, $4::integer, $5::boolean, $6::boolean, $7::integer,
+$8::integer, $9, $10::text, $11, $12::text, $13::text, $14::text, $15, $16, $17::boolean, $18::integer,
+$19::bigint, $20::text, $21, $22::text, $23::text, $24)
+RETURNING id`
+
+const SQL_IMPORT_PLUG_SITE = `INSERT INTO plug_sites (plug_id, site_id) VALUES ($1::integer, $2::integer)
+ON CONFLICT DO NOTHING`
+
+const SQL_IMPORT_IMPRESSIONS = `INSERT INTO impressions (day, plug_id, site_id, count)
+VALUES ($1::date, $2::integer, $3::integer, $4::integer)
+ON CONFLICT (day, plug_id, site_id) DO UPDATE SET count = impressions.count + EXCLUDED.count`
+
+// Takes an ID from a table's sequence without inserting a row
+const SQL_RESERVE_ID = `SELECT nextval(pg_get_serial_sequence($1::text, 'id'))`
+
+type ArchiveManifest struct {
+	Version     int                  `json:"version"`
+	ExportedAt  time.Time            `json:"exported_at"`
+	Sites       []archiveSite        `json:"sites"`
+	Plugs       []archivePlug        `json:"plugs"`
+	Approvals   []archiveApproval    `json:"approvals"`
+	Impressions []archiveImpression  `json:"impressions"`
+	Ledger      []archiveLedgerEntry `json:"ledger"`
+	AuditEvents []archiveAuditEvent  `json:"audit_events"`
+}
+
+type archiveSite struct {
+	ID      int       `json:"id"`
+	Host    string    `json:"host"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+type archivePlug struct {
+	ID             int        `json:"id"`
+	S3ID           string     `json:"s3id"`
+	Owner          string     `json:"owner"`
+	Group          string     `json:"group"`
+	Views          int        `json:"views"`
+	Approved       bool       `json:"approved"`
+	Paused         bool       `json:"paused"`
+	CreditsPaid    int        `json:"credits_paid"`
+	ViewsPurchased int        `json:"views_purchased"`
+	Created        time.Time  `json:"created"`
+	ClaimedBy      string     `json:"claimed_by"`
+	ClaimedAt      *time.Time `json:"claimed_at"`
+	Title          string     `json:"title"`
+	AltText        string     `json:"alt_text"`
+	Description    string     `json:"description"`
+	ApprovedAt     *time.Time `json:"approved_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+	Paced          bool       `json:"paced"`
+	Weight         int        `json:"weight"`
+	ArchivedAt     *time.Time `json:"archived_at"`
+	ArchivedBy     string     `json:"archived_by"`
+	ArchiveReason  string     `json:"archive_reason"`
+	ImagePurgedAt  *time.Time `json:"image_purged_at"`
+	SiteIDs        []int      `json:"site_ids"`
+	// Path of the image in the archive, empty if it was missing from S3 or
+	// had been purged
+	Object      string `json:"object"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+type archiveApproval struct {
+	PlugID int       `json:"plug_id"`
+	UID    string    `json:"uid"`
+	Time   time.Time `json:"time"`
+}
+
+type archiveImpression struct {
+	Day    string `json:"day"`
+	PlugID int    `json:"plug_id"`
+	SiteID int    `json:"site_id"`
+	Count  int    `json:"count"`
+}
+
+type archiveLedgerEntry struct {
+	ID      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	UID     string    `json:"uid"`
+	PlugID  int       `json:"plug_id"`
+	Credits int       `json:"credits"`
+	Views   int       `json:"views"`
+	Reason  string    `json:"reason"`
+}
+
+type archiveAuditEvent struct {
+	ID       int             `json:"id"`
+	Time     time.Time       `json:"time"`
+	Actor    string          `json:"actor"`
+	Action   string          `json:"action"`
+	PlugID   int             `json:"plug_id"`
+	Details  json.RawMessage `json:"details"`
+	Severity int             `json:"severity"`
+}
+
+// ArchiveSummary counts what an export or import covered. PlugIDs maps
+// the IDs plugs had in the archive to the ones they were imported as.
+type ArchiveSummary struct {
+	Sites       int         `json:"sites"`
+	Plugs       int         `json:"plugs"`
+	Approvals   int         `json:"approvals"`
+	Impressions int         `json:"impressions"`
+	Ledger      int         `json:"ledger"`
+	AuditEvents int         `json:"audit_events"`
+	Objects     int         `json:"objects"`
+	PlugIDs     map[int]int `json:"plug_ids,omitempty"`
+}
+
+func (m ArchiveManifest) summary() ArchiveSummary {
+	return ArchiveSummary{
+		Sites:       len(m.Sites),
+		Plugs:       len(m.Plugs),
+		Approvals:   len(m.Approvals),
+		Impressions: len(m.Impressions),
+		Ledger:      len(m.Ledger),
+		AuditEvents: len(m.AuditEvents),
+	}
+}
+
+// queryRows runs query, calling scan for each row.
+func queryRows(tx *sql.Tx, query string, scan func(rowScanner) error) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exportManifest reads everything in the archive from one snapshot of the
+// database.
+func (c DBConnection) exportManifest() (ArchiveManifest, error) {
+	m := ArchiveManifest{Version: ARCHIVE_VERSION, ExportedAt: time.Now()}
+
+	start := time.Now()
+	tx, err := c.con.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return m, err
+	}
+	defer tx.Rollback()
+
+	err = queryRows(tx, SQL_EXPORT_SITES, func(row rowScanner) error {
+		var obj archiveSite
+		err := row.Scan(&obj.ID, &obj.Host, &obj.Name, &obj.Created)
+		m.Sites = append(m.Sites, obj)
+		return err
+	})
+	if err == nil {
+		err = queryRows(tx, SQL_RETRIEVE_ALL_PLUGS, func(row rowScanner) error {
+			p, err := scanPlug(row)
+			m.Plugs = append(m.Plugs, archivePlug{
+				ID:             p.ID,
+				S3ID:           p.S3ID,
+				Owner:          p.Owner,
+				Group:          p.Group,
+				Views:          p.ViewsRemaining,
+				Approved:       p.Approved,
+				Paused:         p.Paused,
+				CreditsPaid:    p.CreditsPaid,
+				ViewsPurchased: p.ViewsPurchased,
+				Created:        p.Created,
+				ClaimedBy:      p.ClaimedBy,
+				ClaimedAt:      p.ClaimedAt,
+				Title:          p.Title,
+				AltText:        p.AltText,
+				Description:    p.Description,
+				ApprovedAt:     p.ApprovedAt,
+				EndsAt:         p.EndsAt,
+				Paced:          p.Paced,
+				Weight:         p.Weight,
+				ArchivedAt:     p.ArchivedAt,
+				ArchivedBy:     p.ArchivedBy,
+				ArchiveReason:  p.ArchiveReason,
+				ImagePurgedAt:  p.ImagePurgedAt,
+				Size:           p.ImageSize,
+				ContentType:    p.ContentType,
+			})
+			return err
+		})
+	}
+	if err == nil {
+		sites := make(map[int][]int)
+		err = queryRows(tx, SQL_EXPORT_PLUG_SITES, func(row rowScanner) error {
+			var plugID, siteID int
+			err := row.Scan(&plugID, &siteID)
+			sites[plugID] = append(sites[plugID], siteID)
+			return err
+		})
+		for i := range m.Plugs {
+			m.Plugs[i].SiteIDs = sites[m.Plugs[i].ID]
+		}
+	}
+	if err == nil {
+		err = queryRows(tx, SQL_EXPORT_PLUG_APPROVALS, func(row rowScanner) error {
+			var obj archiveApproval
+			err := row.Scan(&obj.PlugID, &obj.UID, &obj.Time)
+			m.Approvals = append(m.Approvals, obj)
+			return err
+		})
+	}
+	if err == nil {
+		err = queryRows(tx, SQL_EXPORT_IMPRESSIONS, func(row rowScanner) error {
+			var obj archiveImpression
+			err := row.Scan(&obj.Day, &obj.PlugID, &obj.SiteID, &obj.Count)
+			m.Impressions = append(m.Impressions, obj)
+			return err
+		})
+	}
+	if err == nil {
+		err = queryRows(tx, SQL_EXPORT_LEDGER, func(row rowScanner) error {
+			var obj archiveLedgerEntry
+			err := row.Scan(&obj.ID, &obj.Time, &obj.UID, &obj.PlugID, &obj.Credits, &obj.Views, &obj.Reason)
+			m.Ledger = append(m.Ledger, obj)
+			return err
+		})
+	}
+	if err == nil {
+		err = queryRows(tx, SQL_EXPORT_AUDIT_EVENTS, func(row rowScanner) error {
+			var obj archiveAuditEvent
+			var details []byte
+			err := row.Scan(&obj.ID, &obj.Time, &obj.Actor, &obj.Action, &obj.PlugID, &details, &obj.Severity)
+			obj.Details = json.RawMessage(details)
+			m.AuditEvents = append(m.AuditEvents, obj)
+			return err
+		})
+	}
+	c.app.metrics.ObserveDependency("postgres", "export_manifest", start, err)
+	return m, err
+}
+
+// ExportArchive writes every plug, its image and its history to w.
+func (a *PlugApplication) ExportArchive(w io.Writer, actor string) (ArchiveSummary, error) {
+	m, err := a.db.exportManifest()
+	if err != nil {
+		return ArchiveSummary{}, err
+	}
+
+	// The manifest goes first so imports can check it before reading any
+	// images, which means knowing which images exist up front.
+	for i, plug := range m.Plugs {
+		if plug.ImagePurgedAt != nil {
+			continue
+		}
+		info, err := a.store.StatObject(plug.S3ID)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plug_id": plug.ID,
+				"s3id":    plug.S3ID,
+			}).Warn("Exporting plug without its image: ", err)
+			continue
+		}
+		m.Plugs[i].Object = ARCHIVE_OBJECTS_DIR + plug.S3ID
+		m.Plugs[i].Size = info.Size
+		m.Plugs[i].ContentType = info.ContentType
+	}
+
+	summary := m.summary()
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return summary, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err = tw.WriteHeader(&tar.Header{
+		Name:    ARCHIVE_MANIFEST,
+		Mode:    0644,
+		Size:    int64(len(manifest)),
+		ModTime: m.ExportedAt,
+	})
+	if err == nil {
+		_, err = tw.Write(manifest)
+	}
+
+	for _, plug := range m.Plugs {
+		if err != nil {
+			break
+		}
+		if plug.Object == "" {
+			continue
+		}
+		err = a.exportObject(tw, plug, m.ExportedAt)
+		if err == nil {
+			summary.Objects++
+		}
+	}
+
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return summary, err
+	}
+
+	a.db.Audit(actor, AUDIT_ARCHIVE_EXPORTED, 0, SEVERITY_INFO, map[string]interface{}{
+		"plugs":   summary.Plugs,
+		"objects": summary.Objects,
+	})
+	return summary, nil
+}
+
+func (a *PlugApplication) exportObject(tw *tar.Writer, plug archivePlug, modTime time.Time) error {
+	obj, err := a.store.GetObject(plug.S3ID)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    plug.Object,
+		Mode:    0644,
+		Size:    plug.Size,
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, obj)
+	if err != nil {
+		return fmt.Errorf("plug %d's image: %v", plug.ID, err)
+	}
+	return nil
+}
+
+// readManifest opens an archive, returning its manifest and a reader
+// positioned at the first image.
+func readManifest(r io.Reader) (ArchiveManifest, *tar.Reader, error) {
+	var m ArchiveManifest
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return m, nil, err
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil {
+		return m, nil, err
+	}
+	if hdr.Name != ARCHIVE_MANIFEST {
+		return m, nil, fmt.Errorf("archive starts with %s rather than %s", hdr.Name, ARCHIVE_MANIFEST)
+	}
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return m, nil, fmt.Errorf("reading %s: %v", ARCHIVE_MANIFEST, err)
+	}
+	if m.Version != ARCHIVE_VERSION {
+		return m, nil, fmt.Errorf("archive is version %d, this plug reads version %d", m.Version, ARCHIVE_VERSION)
+	}
+	return m, tr, nil
+}
+
+// checkManifest makes sure the plugs in an archive can all be imported.
+func checkManifest(m ArchiveManifest) error {
+	sites := make(map[int]bool)
+	for _, site := range m.Sites {
+		sites[site.ID] = true
+	}
+	ids := make(map[int]bool)
+	objects := make(map[string]bool)
+	for _, plug := range m.Plugs {
+		if ids[plug.ID] {
+			return fmt.Errorf("plug %d appears twice", plug.ID)
+		}
+		ids[plug.ID] = true
+		if plug.Object != "" {
+			if !strings.HasPrefix(plug.Object, ARCHIVE_OBJECTS_DIR) || objects[plug.Object] {
+				return fmt.Errorf("plug %d has a bad object path %q", plug.ID, plug.Object)
+			}
+			objects[plug.Object] = true
+		}
+		for _, site := range plug.SiteIDs {
+			if !sites[site] {
+				return fmt.Errorf("plug %d is restricted to site %d, which isn't in the archive", plug.ID, site)
+			}
+		}
+	}
+	return nil
+}
+
+// checkEmpty makes sure an import won't mix with plugs already here.
+func (a *PlugApplication) checkEmpty() error {
+	var rows int
+	start := time.Now()
+	err := a.db.con.QueryRow(SQL_COUNT_ARCHIVE_ROWS).Scan(&rows)
+	a.metrics.ObserveDependency("postgres", "count_archive_rows", start, err)
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return errors.New("the database already has plugs, ledger entries or impressions")
+	}
+
+	empty, err := a.store.IsEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return errors.New("the plugs bucket isn't empty")
+	}
+	return nil
+}
+
+// idMap tracks the IDs rows of a table were given on import. References to
+// rows deleted before the export get an unused ID from the table's
+// sequence, so their history stays together without pointing at anything.
+type idMap struct {
+	tx    *sql.Tx
+	table string
+	ids   map[int]int
+}
+
+func (m *idMap) get(old int) (interface{}, error) {
+	if old == 0 {
+		return nil, nil
+	}
+	if id, ok := m.ids[old]; ok {
+		return id, nil
+	}
+	var id int
+	err := m.tx.QueryRow(SQL_RESERVE_ID, m.table).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	m.ids[old] = id
+	return id, nil
+}
+
+// importRows writes the manifest to the database, returning the ID each
+// plug was given.
+func importRows(tx *sql.Tx, m ArchiveManifest) (map[int]int, error) {
+	sites := &idMap{tx, "sites", make(map[int]int)}
+	plugs := &idMap{tx, "plugs", make(map[int]int)}
+
+	for _, site := range m.Sites {
+		var id int
+		err := tx.QueryRow(SQL_IMPORT_SITE, site.Host, site.Name, site.Created).Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		sites.ids[site.ID] = id
+	}
+
+	for _, p := range m.Plugs {
+		var id int
+		err := tx.QueryRow(SQL_IMPORT_PLUG,
+			p.S3ID, p.Owner, p.Group, p.Views, p.Approved, p.Paused, p.CreditsPaid,
+			p.ViewsPurchased, p.Created, p.ClaimedBy, p.ClaimedAt, p.Title, p.AltText, p.Description,
+			p.ApprovedAt, p.EndsAt, p.Paced, p.Weight, p.Size, p.ContentType,
+			p.ArchivedAt, p.ArchivedBy, p.ArchiveReason, p.ImagePurgedAt).Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		plugs.ids[p.ID] = id
+		for _, site := range p.SiteIDs {
+			_, err = tx.Exec(SQL_IMPORT_PLUG_SITE, id, sites.ids[site])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	imported := make(map[int]int)
+	for old, id := range plugs.ids {
+		imported[old] = id
+	}
+
+	for _, approval := range m.Approvals {
+		id, ok := plugs.ids[approval.PlugID]
+		if !ok {
+			// Approvals go with their plug
+			continue
+		}
+		_, err := tx.Exec(SQL_ADD_PLUG_APPROVAL, id, approval.UID, approval.Time)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, row := range m.Impressions {
+		plug, err := plugs.get(row.PlugID)
+		if err != nil {
+			return nil, err
+		}
+		site, err := sites.get(row.SiteID)
+		if err != nil {
+			return nil, err
+		}
+		if site == nil {
+			// Impressions from unknown sites are recorded against site 0
+			site = 0
+		}
+		_, err = tx.Exec(SQL_IMPORT_IMPRESSIONS, row.Day, plug, site, row.Count)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range m.Ledger {
+		plug, err := plugs.get(entry.PlugID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(SQL_INSERT_LEDGER_ENTRY, entry.Time, entry.UID, plug, entry.Credits, entry.Views, entry.Reason)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, event := range m.AuditEvents {
+		plug, err := plugs.get(event.PlugID)
+		if err != nil {
+			return nil, err
+		}
+		details := string(event.Details)
+		if details == "" {
+			details = "{}"
+		}
+		_, err = tx.Exec(SQL_INSERT_AUDIT_EVENT, event.Time, event.Actor, event.Action, plug, details, event.Severity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return imported, nil
+}
+
+// ImportArchive restores an archive into an empty database and bucket. A
+// dry run reads and checks the whole archive without changing anything.
+// Either everything is imported or, on any error, nothing is.
+func (a *PlugApplication) ImportArchive(r io.Reader, dryRun bool, actor string) (ArchiveSummary, error) {
+	m, tr, err := readManifest(r)
+	if err != nil {
+		return ArchiveSummary{}, err
+	}
+	summary := m.summary()
+	if err := checkManifest(m); err != nil {
+		return summary, err
+	}
+	if err := a.checkEmpty(); err != nil {
+		return summary, err
+	}
+
+	var tx *sql.Tx
+	if !dryRun {
+		start := time.Now()
+		tx, err = a.db.con.Begin()
+		if err == nil {
+			summary.PlugIDs, err = importRows(tx, m)
+		}
+		a.metrics.ObserveDependency("postgres", "import_archive", start, err)
+		if err != nil {
+			if tx != nil {
+				tx.Rollback()
+			}
+			return summary, err
+		}
+	}
+
+	// Images are uploaded inside the transaction, and removed again if
+	// anything goes wrong before it's committed.
+	plugs := make(map[string]archivePlug)
+	for _, plug := range m.Plugs {
+		if plug.Object != "" {
+			plugs[plug.Object] = plug
+		}
+	}
+	var uploaded []string
+	for err == nil {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			break
+		}
+		plug, ok := plugs[hdr.Name]
+		if !ok {
+			err = fmt.Errorf("%s isn't the image of any plug in the archive", hdr.Name)
+			break
+		}
+		delete(plugs, hdr.Name)
+		summary.Objects++
+		if dryRun {
+			_, err = io.Copy(ioutil.Discard, tr)
+			continue
+		}
+		err = a.store.PutObject(plug.S3ID, tr, hdr.Size, plug.ContentType)
+		if err == nil {
+			uploaded = append(uploaded, plug.S3ID)
+		}
+	}
+	if err == nil && len(plugs) > 0 {
+		for name := range plugs {
+			err = fmt.Errorf("%s is missing from the archive", name)
+			break
+		}
+	}
+
+	if dryRun {
+		return summary, err
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		for _, s3id := range uploaded {
+			a.store.DelFile(Plug{S3ID: s3id})
+		}
+		return summary, err
+	}
+
+	a.db.Audit(actor, AUDIT_ARCHIVE_IMPORTED, 0, SEVERITY_WARNING, map[string]interface{}{
+		"plugs":       summary.Plugs,
+		"objects":     summary.Objects,
+		"exported_at": m.ExportedAt,
+	})
+	return summary, nil
+}
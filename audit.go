@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Severity int
+
+const (
+	SEVERITY_DEBUG Severity = iota
+	SEVERITY_INFO
+	SEVERITY_WARNING
+	SEVERITY_ERROR
+)
+
+var severityNames = []string{"debug", "info", "warning", "error"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return "unknown"
+	}
+	return severityNames[s]
+}
+
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Actor recorded for events which aren't caused by a member, such as
+// dependency failures.
+const SYSTEM_ACTOR = "system"
+
+// Audit actions
+const (
+	AUDIT_PLUG_UPLOADED         = "plug.uploaded"
+	AUDIT_PLUG_APPROVED         = "plug.approved"
+	AUDIT_PLUG_APPROVAL_VOTE    = "plug.approval_vote"
+	AUDIT_PLUG_APPROVAL_REFUSED = "plug.approval_refused"
+	AUDIT_PLUG_APPROVAL_FORCED  = "plug.approval_forced"
+	AUDIT_PLUG_UNAPPROVED       = "plug.unapproved"
+	AUDIT_PLUG_CLAIMED          = "plug.claimed"
+	AUDIT_PLUG_DELETED          = "plug.deleted"
+	AUDIT_PLUG_REJECTED         = "plug.rejected"
+	AUDIT_PLUG_SERVED           = "plug.served"
+	AUDIT_PLUG_PAUSED           = "plug.paused"
+	AUDIT_PLUG_RESUMED          = "plug.resumed"
+	AUDIT_PLUG_WITHDRAWN        = "plug.withdrawn"
+	AUDIT_PLUG_EXPIRED          = "plug.expired"
+	AUDIT_PLUG_IMAGE_PURGED     = "plug.image_purged"
+	AUDIT_PLUG_TOPPED_UP        = "plug.topped_up"
+	AUDIT_PLUG_SITES_SET        = "plug.sites_set"
+	AUDIT_NOTIFICATIONS_SET     = "notifications.set"
+	AUDIT_CREDITS_REFUNDED      = "credits.refunded"
+	AUDIT_SITE_CREATED          = "site.created"
+	AUDIT_SITE_DELETED          = "site.deleted"
+	AUDIT_SITE_TOKEN_ISSUED     = "site.token_issued"
+	AUDIT_PRICING_RULE_CREATED  = "pricing_rule.created"
+	AUDIT_PRICING_RULE_DELETED  = "pricing_rule.deleted"
+	AUDIT_HOUSE_AD_CREATED      = "house_ad.created"
+	AUDIT_HOUSE_AD_UPDATED      = "house_ad.updated"
+	AUDIT_HOUSE_AD_DELETED      = "house_ad.deleted"
+	AUDIT_SETTING_CHANGED       = "setting.changed"
+	AUDIT_ARCHIVE_EXPORTED      = "archive.exported"
+	AUDIT_ARCHIVE_IMPORTED      = "archive.imported"
+	AUDIT_OBJECTS_CHECKED       = "objects.checked"
+	AUDIT_WEBHOOK_CREATED       = "webhook.created"
+	AUDIT_WEBHOOK_UPDATED       = "webhook.updated"
+	AUDIT_WEBHOOK_DELETED       = "webhook.deleted"
+	AUDIT_LDAP_ERROR            = "ldap.error"
+	AUDIT_RATE_LIMITED          = "rate_limit.hit"
+	AUDIT_LEGACY_MESSAGE        = "legacy.message"
+)
+
+const AUDIT_PAGE_SIZE = 50
+
+// CSV exports aren't paginated, but are capped so one request can't pull
+// the whole table into memory.
+const AUDIT_EXPORT_LIMIT = 10000
+
+const AUDIT_FILTER_DATE_FORMAT = "2006-01-02"
+
+type AuditEvent struct {
+	ID       int                    `json:"id"`
+	Time     time.Time              `json:"time"`
+	Actor    string                 `json:"actor"`
+	Action   string                 `json:"action"`
+	PlugID   int                    `json:"plug_id,omitempty"`
+	Details  map[string]interface{} `json:"details"`
+	Severity Severity               `json:"severity"`
+}
+
+// DetailsJSON renders the details for display in the admin log viewer.
+func (e AuditEvent) DetailsJSON() string {
+	data, err := json.Marshal(e.Details)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Offset int
+}
+
+const SQL_CREATE_AUDIT_TABLE = `CREATE TABLE audit_events (
+id              SERIAL PRIMARY KEY,
+time            TIMESTAMP NOT NULL,
+actor           VARCHAR(32) NOT NULL,
+action          VARCHAR(64) NOT NULL,
+plug_id         INTEGER,
+details         JSONB NOT NULL DEFAULT '{}',
+severity        INTEGER NOT NULL
+);
+CREATE INDEX audit_events_time_idx ON audit_events (time);
+CREATE INDEX audit_events_actor_idx ON audit_events (actor);`
+
+// The old logs table stored free text with severities 0 (errors), 1 (admin
+// and upload actions) and 13 (plug served). Carry those rows over once when
+// the audit table is first created.
+const SQL_MIGRATE_LEGACY_LOGS = `INSERT INTO audit_events (time, actor, action, details, severity)
+SELECT time, 'system', 'legacy.message', json_build_object('message', message),
+CASE severity WHEN 0 THEN 3 WHEN 13 THEN 0 ELSE 1 END
+FROM logs`
+
+const SQL_INSERT_AUDIT_EVENT = `INSERT INTO audit_events (time, actor, action, plug_id, details, severity)
+VALUES ($1, $2::text, $3::text, $4, $5::jsonb, $6::integer)`
+
+const SQL_SEARCH_AUDIT_EVENTS = `SELECT id, time, actor, action, plug_id, details, severity, COUNT(*) OVER()
+FROM audit_events
+WHERE ($1::text = '' OR actor = $1::text)
+AND ($2::text = '' OR action = $2::text)
+AND ($3::timestamp IS NULL OR time >= $3::timestamp)
+AND ($4::timestamp IS NULL OR time < $4::timestamp)
+ORDER BY time DESC, id DESC
+LIMIT $5::integer OFFSET $6::integer`
+
+func (c DBConnection) Audit(actor, action string, plugID int, severity Severity, details map[string]interface{}) {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		log.Error(err)
+		encoded = []byte("{}")
+	}
+
+	var plug interface{}
+	if plugID > 0 {
+		plug = plugID
+	}
+
+	start := time.Now()
+	_, err = c.con.Exec(
+		SQL_INSERT_AUDIT_EVENT,
+		time.Now(),
+		actor,
+		action,
+		plug,
+		string(encoded),
+		int(severity))
+	c.app.metrics.ObserveDependency("postgres", "audit", start, err)
+
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (c DBConnection) SearchAuditEvents(filter AuditFilter) ([]AuditEvent, int) {
+	var since, until interface{}
+	if !filter.Since.IsZero() {
+		since = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		until = filter.Until
+	}
+
+	start := time.Now()
+	rows, err := c.con.Query(SQL_SEARCH_AUDIT_EVENTS,
+		filter.Actor,
+		filter.Action,
+		since,
+		until,
+		filter.Limit,
+		filter.Offset)
+	c.app.metrics.ObserveDependency("postgres", "search_audit", start, err)
+	if err != nil {
+		log.Error(err)
+		return nil, 0
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	total := 0
+	for rows.Next() {
+		var obj AuditEvent
+		var plugID sql.NullInt64
+		var details []byte
+		err = rows.Scan(&obj.ID, &obj.Time, &obj.Actor, &obj.Action, &plugID, &details, &obj.Severity, &total)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		obj.PlugID = int(plugID.Int64)
+		err = json.Unmarshal(details, &obj.Details)
+		if err != nil {
+			log.Error(err)
+		}
+		events = append(events, obj)
+	}
+
+	return events, total
+}
+
+// auditFilterFromQuery builds a filter from the admin log viewer's query
+// string. Dates are whole days, with "to" being inclusive.
+func auditFilterFromQuery(c *gin.Context) AuditFilter {
+	filter := AuditFilter{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Limit:  AUDIT_PAGE_SIZE,
+	}
+	if from, err := time.Parse(AUDIT_FILTER_DATE_FORMAT, c.Query("from")); err == nil {
+		filter.Since = from
+	}
+	if to, err := time.Parse(AUDIT_FILTER_DATE_FORMAT, c.Query("to")); err == nil {
+		filter.Until = to.AddDate(0, 0, 1)
+	}
+	if page, err := strconv.Atoi(c.Query("page")); err == nil && page > 1 {
+		filter.Offset = (page - 1) * AUDIT_PAGE_SIZE
+	}
+	return filter
+}
+
+func (r PlugRoutes) audit_log_view(c *gin.Context) {
+	if _, ok := r.requireAdmin(c); !ok {
+		return
+	}
+
+	filter := auditFilterFromQuery(c)
+	events, total := r.app.db.SearchAuditEvents(filter)
+	page := filter.Offset/AUDIT_PAGE_SIZE + 1
+
+	// Keep the filter when paging and exporting
+	query := c.Request.URL.Query()
+	query.Del("page")
+	pageURL := func(page int) string {
+		query.Set("page", strconv.Itoa(page))
+		return "/admin/logs?" + query.Encode()
+	}
+
+	r.page(c, "logs.tmpl", gin.H{
+		"events":     events,
+		"total":      total,
+		"page":       page,
+		"prev_url":   pageURL(page - 1),
+		"next_url":   pageURL(page + 1),
+		"has_prev":   page > 1,
+		"has_next":   filter.Offset+len(events) < total,
+		"export_url": "/admin/logs.csv?" + c.Request.URL.RawQuery,
+		"actor":      filter.Actor,
+		"action":     filter.Action,
+		"from":       c.Query("from"),
+		"to":         c.Query("to"),
+	})
+}
+
+func (r PlugRoutes) audit_log_json(c *gin.Context) {
+	if _, ok := r.requireAdmin(c); !ok {
+		return
+	}
+
+	filter := auditFilterFromQuery(c)
+	events, total := r.app.db.SearchAuditEvents(filter)
+	if events == nil {
+		events = []AuditEvent{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events":    events,
+		"total":     total,
+		"page":      filter.Offset/AUDIT_PAGE_SIZE + 1,
+		"page_size": AUDIT_PAGE_SIZE,
+	})
+}
+
+func (r PlugRoutes) audit_log_csv(c *gin.Context) {
+	if _, ok := r.requireAdmin(c); !ok {
+		return
+	}
+
+	filter := auditFilterFromQuery(c)
+	filter.Limit = AUDIT_EXPORT_LIMIT
+	filter.Offset = 0
+	events, _ := r.app.db.SearchAuditEvents(filter)
+
+	c.Header("Content-Disposition", "attachment; filename=plug-audit-log.csv")
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "time", "severity", "actor", "action", "plug_id", "details"})
+	for _, event := range events {
+		plugID := ""
+		if event.PlugID > 0 {
+			plugID = strconv.Itoa(event.PlugID)
+		}
+		w.Write([]string{
+			strconv.Itoa(event.ID),
+			event.Time.Format(time.RFC3339),
+			event.Severity.String(),
+			event.Actor,
+			event.Action,
+			plugID,
+			event.DetailsJSON(),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Error(err)
+	}
+}
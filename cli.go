@@ -0,0 +1,737 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Besides serving the web app, the plug binary runs admin commands against
+// the same database, S3 bucket and LDAP server, configured by the same
+// environment variables. They go through the same code as the admin pages,
+// so everything they change is audited and owners are notified as usual.
+
+// Output formats for commands, set with -format
+const (
+	FORMAT_TABLE = "table"
+	FORMAT_JSON  = "json"
+)
+
+// How often logs tail -follow checks for new events
+const LOG_FOLLOW_INTERVAL = 2 * time.Second
+
+const USAGE = `Usage: plug [command] [flags] [args]
+
+Commands:
+  serve                            run the web server, the default
+  migrate                          bring the database schema up to date
+  plugs list [-state s]            list pending, live, house, archived or all plugs
+  plugs approve [-force] <id>...   vote to approve plugs
+  plugs reject [-reason r] <id>... reject plugs, refunding whoever paid
+  plugs delete [-reason r] <id>... delete plugs without a refund
+  credits refund <uid> <credits>   give a member drink credits back
+  logs tail [-n 20] [-follow]      show the latest audit events
+  reconcile [-fix]                 check plugs against the credit ledger
+  export <file>                    write plugs, images and history to an archive
+  import [-dry-run] <file>         restore an archive into an empty deployment
+  objects check [-fix]             compare plug rows with the images in S3
+
+Commands take -format table or json. Those changing anything take -actor,
+the uid recorded in the audit log, which defaults to $USER.
+Run "plug <command> -h" for a command's flags.
+`
+
+type command struct {
+	name string
+	run  func(cfg Config, args []string) error
+}
+
+var commands = []command{
+	{"migrate", cmdMigrate},
+	{"plugs list", cmdPlugsList},
+	{"plugs approve", cmdPlugsApprove},
+	{"plugs reject", cmdPlugsReject},
+	{"plugs delete", cmdPlugsDelete},
+	{"credits refund", cmdCreditsRefund},
+	{"logs tail", cmdLogsTail},
+	{"reconcile", cmdReconcile},
+	{"export", cmdExport},
+	{"import", cmdImport},
+	{"objects check", cmdObjectsCheck},
+}
+
+// errUsage is returned by commands given bad arguments, once they've said
+// what was wrong.
+var errUsage = errors.New("usage")
+
+func usage() {
+	fmt.Fprint(os.Stderr, USAGE)
+}
+
+// runCommand runs the command named by args, returning the exit status.
+func runCommand(cfg Config, args []string) int {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) || strings.Join(args[:len(words)], " ") != cmd.name {
+			continue
+		}
+		err := cmd.run(cfg, args[len(words):])
+		if err == errUsage || err == flag.ErrHelp {
+			return 2
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "plug "+cmd.name+":", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", strings.Join(args, " "))
+	usage()
+	return 2
+}
+
+// commandOptions are the flags shared by commands.
+type commandOptions struct {
+	flags  *flag.FlagSet
+	format string
+	actor  string
+	out    io.Writer
+}
+
+func newCommandOptions(name, args string, changes bool) *commandOptions {
+	o := &commandOptions{out: os.Stdout}
+	o.flags = flag.NewFlagSet("plug "+name, flag.ContinueOnError)
+	o.flags.StringVar(&o.format, "format", FORMAT_TABLE, "output format, table or json")
+	if changes {
+		actor := os.Getenv("USER")
+		if actor == "" {
+			actor = SYSTEM_ACTOR
+		}
+		o.flags.StringVar(&o.actor, "actor", actor, "uid recorded in the audit log")
+	}
+	o.flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace("Usage: plug "+name+" [flags] "+args))
+		o.flags.PrintDefaults()
+	}
+	return o
+}
+
+// parse reads the command's flags, checking it was given between min and
+// max arguments. A max below zero means there's no limit.
+func (o *commandOptions) parse(args []string, min, max int) error {
+	if err := o.flags.Parse(args); err != nil {
+		return err
+	}
+	if o.format != FORMAT_TABLE && o.format != FORMAT_JSON {
+		fmt.Fprintln(os.Stderr, "-format must be table or json")
+		return errUsage
+	}
+	n := o.flags.NArg()
+	if n < min || (max >= 0 && n > max) {
+		o.flags.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// ids reads the command's arguments as plug IDs.
+func (o *commandOptions) ids() ([]int, error) {
+	var ids []int
+	for _, arg := range o.flags.Args() {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a plug id", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// print writes rows under header as a table, or value as JSON.
+func (o *commandOptions) print(header []string, rows [][]string, value interface{}) error {
+	if o.format == FORMAT_JSON {
+		enc := json.NewEncoder(o.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(value)
+	}
+
+	w := tabwriter.NewWriter(o.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// connect sets up the application for a command, which must call
+// disconnect when done.
+func connect(cfg Config) *PlugApplication {
+	app := &PlugApplication{}
+	app.Init(cfg)
+	app.notifier.Start()
+	return app
+}
+
+// disconnect waits for queued notifications before closing the database.
+// Webhooks are left in the outbox for the server to deliver.
+func (a *PlugApplication) disconnect() {
+	a.notifier.Stop()
+	a.db.Close()
+}
+
+func cmdMigrate(cfg Config, args []string) error {
+	o := newCommandOptions("migrate", "", false)
+	if err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	// Every table and column is created or added as the app starts
+	app := connect(cfg)
+	defer app.disconnect()
+	fmt.Fprintln(o.out, "Database schema is up to date")
+	return nil
+}
+
+// plugState describes where a plug is in its life for listings.
+func plugState(p Plug) string {
+	switch {
+	case p.IsDefault():
+		return "house"
+	case p.ArchivedAt != nil:
+		return "archived"
+	case p.ViewsRemaining == 0:
+		return "exhausted"
+	case !p.Approved:
+		return "pending"
+	case p.Paused:
+		return "paused"
+	case p.Ended(time.Now()):
+		return "ended"
+	}
+	return "live"
+}
+
+type plugRecord struct {
+	ID             int        `json:"id"`
+	State          string     `json:"state"`
+	Owner          string     `json:"owner"`
+	Group          string     `json:"group,omitempty"`
+	Title          string     `json:"title,omitempty"`
+	ViewsRemaining int        `json:"views_remaining"`
+	ViewsPurchased int        `json:"views_purchased"`
+	CreditsPaid    int        `json:"credits_paid"`
+	Created        time.Time  `json:"created"`
+	ApprovedAt     *time.Time `json:"approved_at,omitempty"`
+	EndsAt         *time.Time `json:"ends_at,omitempty"`
+	ArchivedAt     *time.Time `json:"archived_at,omitempty"`
+	ArchivedBy     string     `json:"archived_by,omitempty"`
+	ArchiveReason  string     `json:"archive_reason,omitempty"`
+	ImagePurgedAt  *time.Time `json:"image_purged_at,omitempty"`
+}
+
+func printPlugs(o *commandOptions, plugs []Plug) error {
+	records := []plugRecord{}
+	var rows [][]string
+	for _, p := range plugs {
+		records = append(records, plugRecord{
+			ID:             p.ID,
+			State:          plugState(p),
+			Owner:          p.Owner,
+			Group:          p.Group,
+			Title:          p.Title,
+			ViewsRemaining: p.ViewsRemaining,
+			ViewsPurchased: p.ViewsPurchased,
+			CreditsPaid:    p.CreditsPaid,
+			Created:        p.Created,
+			ApprovedAt:     p.ApprovedAt,
+			EndsAt:         p.EndsAt,
+			ArchivedAt:     p.ArchivedAt,
+			ArchivedBy:     p.ArchivedBy,
+			ArchiveReason:  p.ArchiveReason,
+			ImagePurgedAt:  p.ImagePurgedAt,
+		})
+
+		views := strconv.Itoa(p.ViewsRemaining) + "/" + strconv.Itoa(p.ViewsPurchased)
+		if p.IsDefault() {
+			views = "-"
+		}
+		ends := ""
+		if p.EndsAt != nil {
+			ends = p.EndsAt.Format("2006-01-02 15:04")
+		}
+		rows = append(rows, []string{
+			strconv.Itoa(p.ID),
+			plugState(p),
+			p.Owner,
+			p.Group,
+			views,
+			strconv.Itoa(p.CreditsPaid),
+			p.Created.Format("2006-01-02 15:04"),
+			ends,
+			p.Title,
+		})
+	}
+	header := []string{"ID", "STATE", "OWNER", "GROUP", "VIEWS", "CREDITS", "CREATED", "ENDS", "TITLE"}
+	return o.print(header, rows, records)
+}
+
+func cmdPlugsList(cfg Config, args []string) error {
+	o := newCommandOptions("plugs list", "", false)
+	state := o.flags.String("state", "all", "pending, live, house, archived or all")
+	if err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	app := connect(cfg)
+	defer app.disconnect()
+
+	var plugs []Plug
+	switch *state {
+	case "pending":
+		plugs = app.db.GetPendingPlugs()
+	case "live":
+		plugs = app.db.GetLivePlugs()
+	case "house":
+		plugs = app.db.GetHouseAds()
+	case "archived":
+		plugs = app.db.GetArchivedPlugs()
+	case "all":
+		var err error
+		plugs, err = app.db.GetAllPlugs()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown state %q", *state)
+	}
+	return printPlugs(o, plugs)
+}
+
+// lookupPlugs finds each of the given member plugs, failing if any of them
+// doesn't exist, has been archived or is a house ad.
+func lookupPlugs(app *PlugApplication, ids []int) ([]Plug, error) {
+	var plugs []Plug
+	for _, id := range ids {
+		plug, ok := app.db.GetPlugById(id)
+		if !ok {
+			return nil, fmt.Errorf("there's no plug %d", id)
+		}
+		if plug.IsDefault() {
+			return nil, fmt.Errorf("plug %d is a house ad, manage it from the house ads page", id)
+		}
+		plugs = append(plugs, plug)
+	}
+	return plugs, nil
+}
+
+func cmdPlugsApprove(cfg Config, args []string) error {
+	o := newCommandOptions("plugs approve", "<id>...", true)
+	force := o.flags.Bool("force", false, "put plugs live without waiting for votes, audited as an override")
+	if err := o.parse(args, 1, -1); err != nil {
+		return err
+	}
+	ids, err := o.ids()
+	if err != nil {
+		return err
+	}
+
+	app := connect(cfg)
+	defer app.disconnect()
+	plugs, err := lookupPlugs(app, ids)
+	if err != nil {
+		return err
+	}
+
+	var approved []Plug
+	if *force {
+		approved = app.ForceApprovePlugs(plugs, o.actor)
+	} else {
+		approved = app.ApprovePlugs(plugs, o.actor)
+	}
+	if len(approved) < len(ids) {
+		fmt.Fprintf(os.Stderr, "%d of %d plugs weren't put live, as they were already live, "+
+			"need more votes or are managed by %s\n", len(ids)-len(approved), len(ids), o.actor)
+	}
+	return printPlugs(o, approved)
+}
+
+type plugResult struct {
+	ID              int    `json:"id"`
+	Owner           string `json:"owner"`
+	Result          string `json:"result"`
+	CreditsRefunded int    `json:"credits_refunded"`
+}
+
+func printPlugResults(o *commandOptions, results []plugResult) error {
+	var rows [][]string
+	for _, result := range results {
+		rows = append(rows, []string{
+			strconv.Itoa(result.ID),
+			result.Owner,
+			result.Result,
+			strconv.Itoa(result.CreditsRefunded),
+		})
+	}
+	return o.print([]string{"ID", "OWNER", "RESULT", "REFUNDED"}, rows, results)
+}
+
+func cmdPlugsReject(cfg Config, args []string) error {
+	o := newCommandOptions("plugs reject", "<id>...", true)
+	reason := o.flags.String("reason", "", "reason given to the owner")
+	if err := o.parse(args, 1, -1); err != nil {
+		return err
+	}
+	ids, err := o.ids()
+	if err != nil {
+		return err
+	}
+
+	app := connect(cfg)
+	defer app.disconnect()
+	plugs, err := lookupPlugs(app, ids)
+	if err != nil {
+		return err
+	}
+
+	results := []plugResult{}
+	for _, plug := range plugs {
+		if plug.Approved {
+			results = append(results, plugResult{plug.ID, plug.Owner, "skipped, already live", 0})
+			continue
+		}
+		refundable := plug.RefundableCredits()
+		app.RejectPlug(plug, o.actor, *reason)
+		results = append(results, plugResult{plug.ID, plug.Owner, "rejected", refundable})
+	}
+	return printPlugResults(o, results)
+}
+
+func cmdPlugsDelete(cfg Config, args []string) error {
+	o := newCommandOptions("plugs delete", "<id>...", true)
+	reason := o.flags.String("reason", "", "reason given to the owner")
+	if err := o.parse(args, 1, -1); err != nil {
+		return err
+	}
+	ids, err := o.ids()
+	if err != nil {
+		return err
+	}
+
+	app := connect(cfg)
+	defer app.disconnect()
+	plugs, err := lookupPlugs(app, ids)
+	if err != nil {
+		return err
+	}
+
+	results := []plugResult{}
+	for _, plug := range plugs {
+		app.RemovePlug(plug, o.actor, *reason)
+		results = append(results, plugResult{plug.ID, plug.Owner, "deleted", 0})
+	}
+	return printPlugResults(o, results)
+}
+
+func cmdCreditsRefund(cfg Config, args []string) error {
+	o := newCommandOptions("credits refund", "<uid> <credits>", true)
+	plugID := o.flags.Int("plug", 0, "plug the refund is for, if any")
+	reason := o.flags.String("reason", "", "why the credits are being refunded")
+	if err := o.parse(args, 2, 2); err != nil {
+		return err
+	}
+	uid := o.flags.Arg(0)
+	credits, err := strconv.Atoi(o.flags.Arg(1))
+	if err != nil || credits <= 0 {
+		return fmt.Errorf("%q isn't a positive number of credits", o.flags.Arg(1))
+	}
+
+	app := connect(cfg)
+	defer app.disconnect()
+	if *plugID != 0 {
+		if _, ok := app.db.GetPlugById(*plugID); !ok {
+			return fmt.Errorf("there's no plug %d", *plugID)
+		}
+	}
+
+	if !app.ldap.IncrementCredits(uid, credits) {
+		return fmt.Errorf("couldn't give %s their credits, see the log for why", uid)
+	}
+	app.db.AddLedgerEntry(LedgerEntry{
+		UID:     uid,
+		PlugID:  *plugID,
+		Credits: -credits,
+		Reason:  LEDGER_REFUND,
+	})
+	app.db.Audit(o.actor, AUDIT_CREDITS_REFUNDED, *plugID, SEVERITY_WARNING, map[string]interface{}{
+		"uid":     uid,
+		"credits": credits,
+		"reason":  *reason,
+	})
+
+	refund := map[string]interface{}{"uid": uid, "credits": credits}
+	if *plugID != 0 {
+		refund["plug_id"] = *plugID
+	}
+	rows := [][]string{{uid, strconv.Itoa(credits), strconv.Itoa(*plugID)}}
+	return o.print([]string{"UID", "CREDITS", "PLUG"}, rows, refund)
+}
+
+// printEvents writes audit events oldest first. JSON is one event per line
+// so a followed log can be piped into other tools.
+func printEvents(o *commandOptions, events []AuditEvent) error {
+	if o.format == FORMAT_JSON {
+		enc := json.NewEncoder(o.out)
+		for _, event := range events {
+			if err := enc.Encode(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(o.out, 0, 4, 2, ' ', 0)
+	for _, event := range events {
+		plug := ""
+		if event.PlugID != 0 {
+			plug = strconv.Itoa(event.PlugID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			event.Time.Format("2006-01-02 15:04:05"),
+			event.Severity,
+			event.Actor,
+			event.Action,
+			plug,
+			event.DetailsJSON())
+	}
+	return w.Flush()
+}
+
+func cmdLogsTail(cfg Config, args []string) error {
+	o := newCommandOptions("logs tail", "", false)
+	n := o.flags.Int("n", 20, "number of events to show")
+	follow := o.flags.Bool("follow", false, "keep printing new events as they happen")
+	actor := o.flags.String("actor", "", "only show events by this uid")
+	action := o.flags.String("action", "", "only show this action, like plug.approved")
+	if err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	app := connect(cfg)
+	defer app.disconnect()
+
+	filter := AuditFilter{Actor: *actor, Action: *action, Limit: *n}
+	events, _ := app.db.SearchAuditEvents(filter)
+	// Events come newest first
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	if err := printEvents(o, events); err != nil {
+		return err
+	}
+	if !*follow {
+		return nil
+	}
+
+	lastID := 0
+	since := time.Now()
+	if len(events) > 0 {
+		lastID = events[len(events)-1].ID
+		since = events[len(events)-1].Time
+	}
+	for {
+		time.Sleep(LOG_FOLLOW_INTERVAL)
+		filter = AuditFilter{Actor: *actor, Action: *action, Since: since, Limit: AUDIT_EXPORT_LIMIT}
+		found, _ := app.db.SearchAuditEvents(filter)
+		var fresh []AuditEvent
+		for i := len(found) - 1; i >= 0; i-- {
+			if found[i].ID > lastID {
+				fresh = append(fresh, found[i])
+			}
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+		if err := printEvents(o, fresh); err != nil {
+			return err
+		}
+		lastID = fresh[len(fresh)-1].ID
+		since = fresh[len(fresh)-1].Time
+	}
+}
+
+type reconcileIssue struct {
+	PlugID int    `json:"plug_id"`
+	Owner  string `json:"owner"`
+	Issue  string `json:"issue"`
+	Detail string `json:"detail"`
+	Fixed  bool   `json:"fixed"`
+}
+
+// cmdReconcile looks for plugs whose credits don't match the ledger and
+// exhausted plugs the expiry worker hasn't cleaned up. Only the latter can
+// be fixed safely, credit mismatches need a person to decide who's owed
+// what.
+func cmdReconcile(cfg Config, args []string) error {
+	o := newCommandOptions("reconcile", "", true)
+	fix := o.flags.Bool("fix", false, "archive exhausted plugs left behind")
+	if err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	app := connect(cfg)
+	defer app.disconnect()
+
+	plugs, err := app.db.GetAllPlugs()
+	if err != nil {
+		return err
+	}
+	purchases := app.db.GetPlugPurchases()
+	issues := []reconcileIssue{}
+	for _, plug := range plugs {
+		if plug.IsDefault() {
+			continue
+		}
+
+		if paid, ok := purchases[plug.ID]; ok && paid != plug.CreditsPaid {
+			issues = append(issues, reconcileIssue{
+				PlugID: plug.ID,
+				Owner:  plug.Owner,
+				Issue:  "credits_mismatch",
+				Detail: fmt.Sprintf("plug says %d credits paid, ledger says %d", plug.CreditsPaid, paid),
+			})
+		}
+
+		if plug.ViewsRemaining == 0 && plug.ArchivedAt == nil {
+			issues = append(issues, reconcileIssue{
+				PlugID: plug.ID,
+				Owner:  plug.Owner,
+				Issue:  "exhausted",
+				Detail: "out of views but not archived",
+			})
+		}
+	}
+
+	if *fix {
+		expired := make(map[int]bool)
+		for _, plug := range app.expiry.Expire(o.actor) {
+			expired[plug.ID] = true
+		}
+		for i := range issues {
+			issues[i].Fixed = expired[issues[i].PlugID] && issues[i].Issue == "exhausted"
+		}
+	}
+
+	var rows [][]string
+	for _, issue := range issues {
+		rows = append(rows, []string{
+			strconv.Itoa(issue.PlugID),
+			issue.Owner,
+			issue.Issue,
+			issue.Detail,
+			strconv.FormatBool(issue.Fixed),
+		})
+	}
+	return o.print([]string{"PLUG", "OWNER", "ISSUE", "DETAIL", "FIXED"}, rows, issues)
+}
+
+func printArchiveSummary(o *commandOptions, summary ArchiveSummary) error {
+	rows := [][]string{
+		{"sites", strconv.Itoa(summary.Sites)},
+		{"plugs", strconv.Itoa(summary.Plugs)},
+		{"approvals", strconv.Itoa(summary.Approvals)},
+		{"impressions", strconv.Itoa(summary.Impressions)},
+		{"ledger", strconv.Itoa(summary.Ledger)},
+		{"audit_events", strconv.Itoa(summary.AuditEvents)},
+		{"objects", strconv.Itoa(summary.Objects)},
+	}
+	return o.print([]string{"KIND", "COUNT"}, rows, summary)
+}
+
+func cmdExport(cfg Config, args []string) error {
+	o := newCommandOptions("export", "<file>", true)
+	if err := o.parse(args, 1, 1); err != nil {
+		return err
+	}
+
+	app := connect(cfg)
+	defer app.disconnect()
+
+	file, err := os.Create(o.flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	summary, err := app.ExportArchive(file, o.actor)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(o.flags.Arg(0))
+		return err
+	}
+	return printArchiveSummary(o, summary)
+}
+
+func cmdImport(cfg Config, args []string) error {
+	o := newCommandOptions("import", "<file>", true)
+	dryRun := o.flags.Bool("dry-run", false, "check the archive without importing anything")
+	if err := o.parse(args, 1, 1); err != nil {
+		return err
+	}
+
+	file, err := os.Open(o.flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	app := connect(cfg)
+	defer app.disconnect()
+
+	summary, err := app.ImportArchive(file, *dryRun, o.actor)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Fprintln(os.Stderr, "Dry run, nothing was imported")
+	}
+	return printArchiveSummary(o, summary)
+}
+
+func cmdObjectsCheck(cfg Config, args []string) error {
+	o := newCommandOptions("objects check", "", true)
+	fix := o.flags.Bool("fix", false, "repair what can be repaired")
+	if err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	app := connect(cfg)
+	defer app.disconnect()
+
+	issues, err := app.CheckObjects(*fix, o.actor)
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, issue := range issues {
+		plug := ""
+		if issue.PlugID != 0 {
+			plug = strconv.Itoa(issue.PlugID)
+		}
+		rows = append(rows, []string{
+			issue.Kind,
+			issue.S3ID,
+			plug,
+			issue.Detail,
+			strconv.FormatBool(issue.Fixed),
+		})
+	}
+	return o.print([]string{"ISSUE", "S3ID", "PLUG", "DETAIL", "FIXED"}, rows, issues)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Images are written to S3 before their row and removed after it, with
+// failures only logged, so the bucket and the plugs table can drift apart.
+// The object checker compares the two, from the CLI or every
+// PLUG_OBJECT_CHECK_INTERVAL, and with PLUG_OBJECT_CHECK_FIX set repairs
+// what it can.
+
+// Kinds of problem the object checker finds
+const (
+	// An object no plug refers to, deleted when fixing
+	OBJECT_ISSUE_ORPHANED = "orphaned_object"
+	// A plug whose image is gone, which is archived and refunded when fixing
+	OBJECT_ISSUE_MISSING = "missing_object"
+	// An object which isn't the size uploaded, which needs a person to look
+	OBJECT_ISSUE_SIZE = "size_mismatch"
+	// An object served with the wrong type, which is corrected when fixing
+	OBJECT_ISSUE_TYPE = "type_mismatch"
+	// A plug from before image sizes and types were recorded, which are
+	// filled in from the object when fixing
+	OBJECT_ISSUE_UNRECORDED = "unrecorded_image"
+)
+
+var OBJECT_ISSUE_KINDS = []string{
+	OBJECT_ISSUE_ORPHANED,
+	OBJECT_ISSUE_MISSING,
+	OBJECT_ISSUE_SIZE,
+	OBJECT_ISSUE_TYPE,
+	OBJECT_ISSUE_UNRECORDED,
+}
+
+// Advisory lock held while fixing problems, so replicas running scheduled
+// checks don't all fix the same ones. It's a session lock, as a check takes
+// too long to keep a transaction open across.
+const OBJECT_CHECK_LOCK_ID = 0x706c7568
+
+var errObjectCheckRunning = errors.New("another object check is already fixing problems")
+
+// Objects younger than this may belong to an upload that hasn't written its
+// row yet, so aren't counted as orphaned.
+const OBJECT_ORPHAN_GRACE = time.Hour
+
+const SQL_SET_PLUG_IMAGE_INFO = `UPDATE plugs SET image_size=$2::bigint, content_type=$3::text WHERE id=$1::integer`
+
+type ObjectIssue struct {
+	Kind   string `json:"kind"`
+	S3ID   string `json:"s3id"`
+	PlugID int    `json:"plug_id,omitempty"`
+	Detail string `json:"detail"`
+	Fixed  bool   `json:"fixed"`
+}
+
+type ObjectChecker struct {
+	app      *PlugApplication
+	interval time.Duration
+	fix      bool
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	// Issues found by the last scheduled check, by kind
+	mu   sync.Mutex
+	last map[string]int
+}
+
+func (o *ObjectChecker) Init(app *PlugApplication, interval, fix string) {
+	o.app = app
+	o.stop = make(chan struct{})
+	o.last = make(map[string]int)
+
+	if interval != "" {
+		var err error
+		o.interval, err = time.ParseDuration(interval)
+		if err != nil || o.interval < 0 {
+			log.Fatal("PLUG_OBJECT_CHECK_INTERVAL must be a duration like 24h")
+		}
+	}
+	if fix != "" {
+		var err error
+		o.fix, err = strconv.ParseBool(fix)
+		if err != nil {
+			log.Fatal("PLUG_OBJECT_CHECK_FIX must be true or false")
+		}
+	}
+}
+
+// Start runs the check every interval until Stop is called, if there's an
+// interval.
+func (o *ObjectChecker) Start() {
+	if o.interval == 0 {
+		return
+	}
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-o.stop:
+				return
+			case <-ticker.C:
+				o.run()
+			}
+		}
+	}()
+}
+
+func (o *ObjectChecker) Stop() {
+	close(o.stop)
+	o.wg.Wait()
+}
+
+func (o *ObjectChecker) run() {
+	issues, err := o.app.CheckObjects(o.fix, SYSTEM_ACTOR)
+	if err == errObjectCheckRunning {
+		log.Info("Skipping object check, another replica is running one")
+		return
+	}
+	if err != nil {
+		log.Error("Object check failed: ", err)
+		return
+	}
+
+	o.mu.Lock()
+	o.last = countIssues(issues)
+	o.mu.Unlock()
+	if len(issues) > 0 {
+		log.WithFields(log.Fields{
+			"issues": len(issues),
+			"fixed":  o.fix,
+		}).Warn("Object check found problems")
+	}
+}
+
+// Counts collects the last scheduled check's results for metrics.
+func (o *ObjectChecker) Counts() map[string]float64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	counts := make(map[string]float64)
+	for _, kind := range OBJECT_ISSUE_KINDS {
+		counts[kind] = float64(o.last[kind])
+	}
+	return counts
+}
+
+func countIssues(issues []ObjectIssue) map[string]int {
+	counts := make(map[string]int)
+	for _, issue := range issues {
+		counts[issue.Kind]++
+	}
+	return counts
+}
+
+// MarkImagePurged records that a plug no longer has an image, returning
+// false if it had already been marked.
+func (c DBConnection) MarkImagePurged(plug Plug, at time.Time) bool {
+	start := time.Now()
+	result, err := c.con.Exec(SQL_SET_IMAGE_PURGED, plug.ID, at)
+	var marked int64
+	if err == nil {
+		marked, err = result.RowsAffected()
+	}
+	c.app.metrics.ObserveDependency("postgres", "set_image_purged", start, err)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return marked == 1
+}
+
+func (c DBConnection) SetPlugImageInfo(plug Plug, size int64, mime string) error {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_SET_PLUG_IMAGE_INFO, plug.ID, size, mime)
+	c.app.metrics.ObserveDependency("postgres", "set_plug_image_info", start, err)
+	return err
+}
+
+// CheckObjects compares the plugs table with the bucket, fixing what it
+// can if asked. Every run that finds anything is audited. Only one check at
+// a time may fix problems, others fail with errObjectCheckRunning.
+func (a *PlugApplication) CheckObjects(fix bool, actor string) ([]ObjectIssue, error) {
+	if !fix {
+		return a.checkObjects(false, actor)
+	}
+
+	var issues []ObjectIssue
+	locked, err := a.db.SessionLocked(OBJECT_CHECK_LOCK_ID, "object_check_lock", func() error {
+		var err error
+		issues, err = a.checkObjects(true, actor)
+		return err
+	})
+	if err == nil && !locked {
+		err = errObjectCheckRunning
+	}
+	return issues, err
+}
+
+func (a *PlugApplication) checkObjects(fix bool, actor string) ([]ObjectIssue, error) {
+	// Uploads write the object before the row, so reading the rows first
+	// means every row's object should be in the listing. Objects uploaded
+	// in between are covered by OBJECT_ORPHAN_GRACE. A partial list of
+	// plugs would make live images look orphaned, so nothing is checked
+	// unless every plug could be read.
+	plugs, err := a.db.GetAllPlugs()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := a.store.ListObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	bySize := make(map[string]int64)
+	for _, obj := range objects {
+		bySize[obj.Key] = obj.Size
+	}
+	referenced := make(map[string]bool)
+
+	issues := []ObjectIssue{}
+	for _, plug := range plugs {
+		// Purged images are meant to be gone
+		if plug.ImagePurgedAt != nil {
+			continue
+		}
+		referenced[plug.S3ID] = true
+		size, ok := bySize[plug.S3ID]
+		if !ok {
+			issue := ObjectIssue{
+				Kind:   OBJECT_ISSUE_MISSING,
+				S3ID:   plug.S3ID,
+				PlugID: plug.ID,
+				Detail: "plug's image isn't in the bucket",
+			}
+			if fix && plug.ArchivedAt != nil {
+				issue.Fixed = a.db.MarkImagePurged(plug, now)
+			} else if fix {
+				issue.Fixed = a.removeImagelessPlug(plug, actor)
+			}
+			issues = append(issues, issue)
+			continue
+		}
+
+		if plug.ImageSize == 0 && plug.ContentType == "" {
+			issue := ObjectIssue{
+				Kind:   OBJECT_ISSUE_UNRECORDED,
+				S3ID:   plug.S3ID,
+				PlugID: plug.ID,
+				Detail: "plug has no recorded image size or type",
+			}
+			if fix {
+				info, err := a.store.StatObject(plug.S3ID)
+				if err == nil {
+					err = a.db.SetPlugImageInfo(plug, info.Size, info.ContentType)
+				}
+				if err != nil {
+					log.Error(err)
+				}
+				issue.Fixed = err == nil
+			}
+			issues = append(issues, issue)
+			continue
+		}
+
+		if plug.ImageSize != size {
+			issues = append(issues, ObjectIssue{
+				Kind:   OBJECT_ISSUE_SIZE,
+				S3ID:   plug.S3ID,
+				PlugID: plug.ID,
+				Detail: fmt.Sprintf("uploaded %d bytes, bucket has %d", plug.ImageSize, size),
+			})
+		}
+
+		info, err := a.store.StatObject(plug.S3ID)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if info.ContentType != plug.ContentType {
+			issue := ObjectIssue{
+				Kind:   OBJECT_ISSUE_TYPE,
+				S3ID:   plug.S3ID,
+				PlugID: plug.ID,
+				Detail: fmt.Sprintf("uploaded as %s, served as %s", plug.ContentType, info.ContentType),
+			}
+			if fix {
+				err = a.store.SetContentType(plug.S3ID, plug.ContentType)
+				if err != nil {
+					log.Error(err)
+				}
+				issue.Fixed = err == nil
+			}
+			issues = append(issues, issue)
+		}
+	}
+
+	for _, obj := range objects {
+		if referenced[obj.Key] || now.Sub(obj.LastModified) < OBJECT_ORPHAN_GRACE {
+			continue
+		}
+		issue := ObjectIssue{
+			Kind:   OBJECT_ISSUE_ORPHANED,
+			S3ID:   obj.Key,
+			Detail: fmt.Sprintf("%d bytes, last modified %s", obj.Size, obj.LastModified.Format("2006-01-02 15:04")),
+		}
+		if fix {
+			err := a.store.DelFile(Plug{S3ID: obj.Key})
+			if err != nil {
+				log.Error(err)
+			}
+			issue.Fixed = err == nil
+		}
+		issues = append(issues, issue)
+	}
+
+	if len(issues) > 0 {
+		details := make(map[string]interface{})
+		for kind, count := range countIssues(issues) {
+			details[kind] = count
+		}
+		fixed := 0
+		for _, issue := range issues {
+			if issue.Fixed {
+				fixed++
+			}
+		}
+		details["fixed"] = fixed
+		a.db.Audit(actor, AUDIT_OBJECTS_CHECKED, 0, SEVERITY_WARNING, details)
+	}
+	return issues, nil
+}
+
+// removeImagelessPlug archives a plug whose image has gone, refunding its
+// unused views since it can never be shown again. House ads are deleted
+// outright. It checks again first, returning whether the plug was removed.
+func (a *PlugApplication) removeImagelessPlug(plug Plug, actor string) bool {
+	const reason = "Its image was lost"
+	plug, ok := a.db.GetPlugById(plug.ID)
+	if !ok {
+		return false
+	}
+	if _, err := a.store.StatObject(plug.S3ID); err == nil {
+		return false
+	}
+
+	if plug.IsDefault() {
+		a.db.DeletePlug(plug)
+		a.db.Audit(actor, AUDIT_HOUSE_AD_DELETED, plug.ID, SEVERITY_WARNING, map[string]interface{}{
+			"reason": reason,
+		})
+		return true
+	}
+
+	// Archiving only succeeds once, so a plug archived by someone else
+	// meanwhile isn't refunded twice
+	plug, ok = a.db.ArchivePlug(plug, actor, reason)
+	if !ok {
+		return false
+	}
+	a.db.MarkImagePurged(plug, time.Now())
+	refunded := a.RefundPlug(plug)
+	a.db.Audit(actor, AUDIT_PLUG_DELETED, plug.ID, SEVERITY_WARNING, map[string]interface{}{
+		"reason":           reason,
+		"credits_refunded": refunded,
+	})
+	a.webhooks.Emit(EVENT_PLUG_DELETED, plug, actor, map[string]interface{}{
+		"reason":           reason,
+		"credits_refunded": refunded,
+	})
+	a.notifier.Notify(Notification{
+		Kind:   NOTIFY_DELETED,
+		Plug:   plug,
+		Reason: reason,
+		Actor:  actor,
+	})
+	return true
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// Drink credits live in LDAP as each member's drinkBalance. Every change we
+// make to a balance is also written to credit_ledger so purchases and
+// refunds can be traced back to a plug.
+
+const (
+	LEDGER_PURCHASE = "purchase"
+	LEDGER_REFUND   = "refund"
+)
+
+type LedgerEntry struct {
+	ID     int
+	Time   time.Time
+	UID    string
+	PlugID int
+	// Positive when credits were taken from the member, negative when they
+	// were given back.
+	Credits int
+	Views   int
+	Reason  string
+}
+
+const SQL_CREATE_LEDGER_TABLE = `CREATE TABLE credit_ledger (
+id              SERIAL PRIMARY KEY,
+time            TIMESTAMP NOT NULL,
+uid             VARCHAR(32) NOT NULL,
+plug_id         INTEGER,
+credits         INTEGER NOT NULL,
+views           INTEGER NOT NULL,
+reason          VARCHAR(32) NOT NULL
+);
+CREATE INDEX credit_ledger_plug_idx ON credit_ledger (plug_id);`
+
+const SQL_INSERT_LEDGER_ENTRY = `INSERT INTO credit_ledger (time, uid, plug_id, credits, views, reason)
+VALUES ($1, $2::text, $3, $4::integer, $5::integer, $6::text)`
+
+const SQL_RETRIEVE_PLUG_PAYERS = `SELECT uid, SUM(credits) FROM credit_ledger
+WHERE plug_id=$1::integer
+GROUP BY uid
+HAVING SUM(credits) > 0
+ORDER BY SUM(credits) DESC, uid`
+
+const SQL_SUM_PLUG_PURCHASES = `SELECT plug_id, SUM(credits) FROM credit_ledger
+WHERE plug_id IS NOT NULL AND reason=$1::text
+GROUP BY plug_id`
+
+type payerShare struct {
+	uid     string
+	credits int
+}
+
+// GetPlugPayers returns the members who paid for a plug along with the net
+// credits each has spent on it, largest contributor first.
+func (c DBConnection) GetPlugPayers(plug Plug) []payerShare {
+	start := time.Now()
+	rows, err := c.con.Query(SQL_RETRIEVE_PLUG_PAYERS, plug.ID)
+	c.app.metrics.ObserveDependency("postgres", "get_plug_payers", start, err)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var payers []payerShare
+	for rows.Next() {
+		var payer payerShare
+		err = rows.Scan(&payer.uid, &payer.credits)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		payers = append(payers, payer)
+	}
+	return payers
+}
+
+// GetPlugPurchases returns the credits the ledger says were spent buying
+// views for each plug. Plugs from before the ledger existed are missing.
+func (c DBConnection) GetPlugPurchases() map[int]int {
+	start := time.Now()
+	rows, err := c.con.Query(SQL_SUM_PLUG_PURCHASES, LEDGER_PURCHASE)
+	c.app.metrics.ObserveDependency("postgres", "get_plug_purchases", start, err)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	purchases := make(map[int]int)
+	for rows.Next() {
+		var id, credits int
+		err = rows.Scan(&id, &credits)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		purchases[id] = credits
+	}
+	return purchases
+}
+
+func (c DBConnection) AddLedgerEntry(entry LedgerEntry) {
+	var plug interface{}
+	if entry.PlugID > 0 {
+		plug = entry.PlugID
+	}
+
+	start := time.Now()
+	_, err := c.con.Exec(
+		SQL_INSERT_LEDGER_ENTRY,
+		time.Now(),
+		entry.UID,
+		plug,
+		entry.Credits,
+		entry.Views,
+		entry.Reason)
+	c.app.metrics.ObserveDependency("postgres", "add_ledger_entry", start, err)
+
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// RecordPurchase logs credits already taken from uid's balance for views on
+// plug.
+func (a *PlugApplication) RecordPurchase(uid string, plug Plug, credits, views int) {
+	a.db.AddLedgerEntry(LedgerEntry{
+		UID:     uid,
+		PlugID:  plug.ID,
+		Credits: credits,
+		Views:   views,
+		Reason:  LEDGER_PURCHASE,
+	})
+}
+
+// splitRefund divides credits between payers in proportion to what each put
+// in. Shares are rounded down, then the credits left over go one each to
+// those who lost most to rounding, the largest payer first on a tie, so
+// nobody gets back more than they paid.
+func splitRefund(credits int, payers []payerShare) []int {
+	if len(payers) == 0 {
+		return nil
+	}
+	totalPaid := 0
+	for _, payer := range payers {
+		totalPaid += payer.credits
+	}
+	shares := make([]int, len(payers))
+	if totalPaid <= 0 {
+		shares[0] = credits
+		return shares
+	}
+
+	order := make([]int, len(payers))
+	rounding := make([]int, len(payers))
+	allocated := 0
+	for i, payer := range payers {
+		shares[i] = credits * payer.credits / totalPaid
+		rounding[i] = credits * payer.credits % totalPaid
+		allocated += shares[i]
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return rounding[order[a]] > rounding[order[b]]
+	})
+	for i := 0; i < credits-allocated; i++ {
+		shares[order[i]]++
+	}
+	return shares
+}
+
+// RefundPlug returns the credits covering plug's unused views to whoever
+// paid for it, split in proportion to what each member put in. It returns
+// the total refunded.
+func (a *PlugApplication) RefundPlug(plug Plug) int {
+	credits := plug.RefundableCredits()
+	if credits <= 0 {
+		return 0
+	}
+
+	payers := a.db.GetPlugPayers(plug)
+	if len(payers) == 0 {
+		// Plugs from before the ledger existed were paid for by their owner
+		payers = []payerShare{{uid: plug.Owner, credits: plug.CreditsPaid}}
+	}
+
+	shares := splitRefund(credits, payers)
+	refunded := 0
+	for i, payer := range payers {
+		if shares[i] <= 0 {
+			continue
+		}
+		if !a.ldap.IncrementCredits(payer.uid, shares[i]) {
+			log.WithFields(log.Fields{
+				"uid":     payer.uid,
+				"plug_id": plug.ID,
+				"credits": shares[i],
+			}).Error("Failed to refund credits")
+			continue
+		}
+
+		a.db.AddLedgerEntry(LedgerEntry{
+			UID:     payer.uid,
+			PlugID:  plug.ID,
+			Credits: -shares[i],
+			Views:   -plug.ViewsRemaining * shares[i] / credits,
+			Reason:  LEDGER_REFUND,
+		})
+		refunded += shares[i]
+	}
+	return refunded
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitRefund(t *testing.T) {
+	tests := []struct {
+		name    string
+		credits int
+		payers  []payerShare
+		want    []int
+	}{
+		{"no payers", 5, nil, nil},
+		{"one payer", 7, []payerShare{{"alice", 10}}, []int{7}},
+		{"even split", 10, []payerShare{{"alice", 5}, {"bob", 5}}, []int{5, 5}},
+		{"in proportion", 6, []payerShare{{"alice", 20}, {"bob", 10}}, []int{4, 2}},
+		// 3.33 and 1.67, so the credit left over goes to bob
+		{"remainder to whoever lost most to rounding", 5, []payerShare{{"alice", 2}, {"bob", 1}}, []int{3, 2}},
+		{"tie goes to the largest payer", 3, []payerShare{{"alice", 5}, {"bob", 5}}, []int{2, 1}},
+		// 0.8, 0.6 and 0.6
+		{"small refund", 2, []payerShare{{"alice", 4}, {"bob", 3}, {"carol", 3}}, []int{1, 1, 0}},
+		{"partial refund", 3, []payerShare{{"alice", 6}, {"bob", 4}}, []int{2, 1}},
+		// 6.46, 4.62 and 0.92, alice mustn't get back more than her 7
+		{"nearly everything", 12, []payerShare{{"alice", 7}, {"bob", 5}, {"carol", 1}}, []int{6, 5, 1}},
+		{"nothing paid", 3, []payerShare{{"alice", 0}}, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares := splitRefund(tt.credits, tt.payers)
+			if !reflect.DeepEqual(shares, tt.want) {
+				t.Errorf("splitRefund(%d, %v) = %v, want %v", tt.credits, tt.payers, shares, tt.want)
+			}
+			total := 0
+			for _, share := range shares {
+				if share < 0 {
+					t.Errorf("negative share in %v", shares)
+				}
+				total += share
+			}
+			if len(tt.payers) > 0 && total != tt.credits {
+				t.Errorf("shares %v add up to %d, want %d", shares, total, tt.credits)
+			}
+		})
+	}
+}
+
+func TestSplitRefundNeverOverpays(t *testing.T) {
+	// Every payer gets their exact share of any refund, rounded one way or
+	// the other
+	payers := []payerShare{{"alice", 7}, {"bob", 5}, {"carol", 1}}
+	total := 13
+	for credits := 0; credits <= total; credits++ {
+		shares := splitRefund(credits, payers)
+		for i, payer := range payers {
+			low := credits * payer.credits / total
+			high := (credits*payer.credits + total - 1) / total
+			if shares[i] < low || shares[i] > high || shares[i] > payer.credits {
+				t.Errorf("refunding %d gave %s %d of %v", credits, payer.uid, shares[i], shares)
+			}
+		}
+	}
+}
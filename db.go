@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	_ "github.com/lib/pq"
+	"database/sql/driver"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
-	"strings"
 	"time"
 )
 
@@ -22,36 +23,161 @@ views           INTEGER NOT NULL,
 approved        BOOLEAN NOT NULL
 );`
 
-const SQL_CREATE_LOG_TABLE = `CREATE TABLE logs (
-time            TIMESTAMP PRIMARY KEY,
-severity        INTEGER NOT NULL,
-message         TEXT NOT NULL
-);`
+// Columns added to plugs since it was first created. They're applied on
+// every startup so existing deployments pick them up.
+var plugColumnMigrations = []struct {
+	name       string
+	definition string
+}{
+	{"paused", "BOOLEAN NOT NULL DEFAULT false"},
+	{"credits_paid", "INTEGER NOT NULL DEFAULT 0"},
+	{"views_purchased", "INTEGER NOT NULL DEFAULT 0"},
+	{"owner_group", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"created", "TIMESTAMP NOT NULL DEFAULT now()"},
+	{"claimed_by", "VARCHAR(32) NOT NULL DEFAULT ''"},
+	{"claimed_at", "TIMESTAMP"},
+	{"title", "VARCHAR(100) NOT NULL DEFAULT ''"},
+	{"alt_text", "VARCHAR(250) NOT NULL DEFAULT ''"},
+	{"description", "TEXT NOT NULL DEFAULT ''"},
+	{"approved_at", "TIMESTAMP"},
+	{"ends_at", "TIMESTAMP"},
+	{"paced", "BOOLEAN NOT NULL DEFAULT false"},
+	{"weight", "INTEGER NOT NULL DEFAULT 1"},
+	{"image_size", "BIGINT NOT NULL DEFAULT 0"},
+	{"content_type", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"exhausted_at", "TIMESTAMP"},
+	{"archived_at", "TIMESTAMP"},
+	{"archived_by", "VARCHAR(32) NOT NULL DEFAULT ''"},
+	{"archive_reason", "TEXT NOT NULL DEFAULT ''"},
+	{"image_purged_at", "TIMESTAMP"},
+}
 
-const SQL_CREATE_PLUG = `INSERT into plugs (s3id, owner, views, approved)
-VALUES ($1::text, $2::text, $3::integer, false)`
+// Every query returning plugs selects these columns, in this order, so the
+// rows can be read with scanPlug.
+const PLUG_COLUMNS = `id, s3id, owner, owner_group, views, approved, paused, credits_paid, views_purchased,
+created, claimed_by, claimed_at, title, alt_text, description, approved_at, ends_at, paced, weight,
+image_size, content_type, archived_at, archived_by, archive_reason, image_purged_at`
+
+const SQL_CREATE_PLUG = `INSERT into plugs (s3id, owner, owner_group, views, approved, credits_paid, views_purchased, created,
+title, alt_text, description, ends_at, paced, image_size, content_type)
+VALUES ($1::text, $2::text, $3::text, $4::integer, false, $5::integer, $6::integer, $7,
+$8::text, $9::text, $10::text, $11, $12::boolean, $13::bigint, $14::text)
+RETURNING id`
+
+// Plugs which may be shown on site $1 at time $2, those restricted to other
+// sites, past their end date or waiting to be expired are left out.
+const SQL_RETRIEVE_APPROVED_PLUGS = `SELECT ` + PLUG_COLUMNS + ` FROM plugs
+WHERE approved=true AND NOT paused AND views<>0 AND archived_at IS NULL AND (ends_at IS NULL OR ends_at > $2)
+AND (NOT EXISTS (SELECT 1 FROM plug_sites ps WHERE ps.plug_id = plugs.id)
+OR EXISTS (SELECT 1 FROM plug_sites ps WHERE ps.plug_id = plugs.id AND ps.site_id = $1::integer))`
+
+const SQL_RETRIEVE_PLUG_BY_ID = `SELECT ` + PLUG_COLUMNS + ` FROM plugs WHERE id=$1::integer AND archived_at IS NULL`
+
+// Plugs waiting on a decision, oldest first so nothing sits in the queue
+const SQL_RETRIEVE_PENDING_PLUGS = `SELECT ` + PLUG_COLUMNS + ` FROM plugs
+WHERE NOT approved AND views>=0 AND archived_at IS NULL
+ORDER BY created, id`
+
+const SQL_RETRIEVE_LIVE_PLUGS = `SELECT ` + PLUG_COLUMNS + ` FROM plugs
+WHERE approved AND views>=0 AND archived_at IS NULL
+ORDER BY created, id`
+
+const SQL_RETRIEVE_ALL_PLUGS = `SELECT ` + PLUG_COLUMNS + ` FROM plugs ORDER BY id`
+
+const SQL_RETRIEVE_USER_PLUGS = `SELECT ` + PLUG_COLUMNS + ` FROM plugs
+WHERE views>=0 AND archived_at IS NULL AND (owner=$1::text OR owner_group = ANY($2::text[]))`
+
+// A member's archived plugs, most recently archived first
+const SQL_RETRIEVE_USER_ARCHIVED_PLUGS = `SELECT ` + PLUG_COLUMNS + ` FROM plugs
+WHERE archived_at IS NOT NULL AND (owner=$1::text OR owner_group = ANY($2::text[]))
+ORDER BY archived_at DESC, id DESC
+LIMIT $3::integer`
+
+const SQL_RETRIEVE_ARCHIVED_PLUGS = `SELECT ` + PLUG_COLUMNS + ` FROM plugs
+WHERE archived_at IS NOT NULL
+ORDER BY archived_at, id`
+
+// Counts a view, recording when the last one is served so the plug is
+// archived as of then rather than when the expiry worker next runs
+const SQL_COUNT_PLUG_VIEW = `UPDATE plugs
+SET views = views - 1, exhausted_at = CASE WHEN views = 1 THEN $2::timestamp END
+WHERE id=$1::integer AND views > 0
+RETURNING views`
+
+const SQL_SET_PLUG_PAUSED = `UPDATE plugs SET paused=$2::boolean WHERE id=$1::integer`
+
+const SQL_ADD_PLUG_VIEWS = `UPDATE plugs
+SET views = views + $2::integer,
+views_purchased = views_purchased + $2::integer,
+credits_paid = credits_paid + $3::integer
+WHERE id=$1::integer AND views>=0 AND archived_at IS NULL
+RETURNING views`
+
+const SQL_REVOKE_PLUG_APPROVALS = `UPDATE plugs
+SET approved = false
+WHERE approved AND views>=0 AND archived_at IS NULL AND id = ANY($1::integer[])
+RETURNING ` + PLUG_COLUMNS
+
+const SQL_APPROVE_PLUGS = `UPDATE plugs
+SET approved = true, approved_at = $2, claimed_by = '', claimed_at = NULL
+WHERE NOT approved AND views>=0 AND archived_at IS NULL AND id = ANY($1::integer[])
+RETURNING ` + PLUG_COLUMNS
+
+const SQL_COUNT_PLUGS_BY_STATE = `SELECT
+COUNT(*) FILTER (WHERE approved AND views > 0 AND archived_at IS NULL),
+COUNT(*) FILTER (WHERE NOT approved AND views >= 0 AND archived_at IS NULL),
+COUNT(*) FILTER (WHERE views = 0 AND archived_at IS NULL),
+COUNT(*) FILTER (WHERE archived_at IS NOT NULL)
+FROM plugs`
 
-const SQL_RETRIEVE_APPROVED_PLUGS = `SELECT id, s3id, owner, views FROM plugs WHERE approved=true`
+const SQL_DELETE_PLUG = `DELETE from plugs WHERE id=$1::integer;`
 
-const SQL_RETRIEVE_PLUG_BY_ID = `SELECT s3id, owner, views, approved FROM plugs WHERE id=$1::integer`
+// Reasons recorded when a plug is archived without one being given
+const (
+	ARCHIVE_REASON_EXHAUSTED = "Ran out of views"
+	ARCHIVE_REASON_WITHDRAWN = "Withdrawn by its owner"
+	ARCHIVE_REASON_REJECTED  = "Rejected"
+	ARCHIVE_REASON_REMOVED   = "Removed by an admin"
+)
 
-const SQL_RETRIEVE_PENDING_PLUGS = `SELECT id, s3id, owner, views, approved FROM plugs WHERE views>=0`
+// Archives a plug, returning nothing if it was already archived
+const SQL_ARCHIVE_PLUG = `UPDATE plugs
+SET archived_at = $2, archived_by = $3::text, archive_reason = $4::text, claimed_by = '', claimed_at = NULL
+WHERE id=$1::integer AND archived_at IS NULL
+RETURNING ` + PLUG_COLUMNS
 
-const SQL_SET_PENDING_PLUGS = `UPDATE plugs
-SET approved = true
-WHERE $1::text LIKE CONCAT('%,',id,',%');`
+const SQL_TRY_ADVISORY_LOCK = `SELECT pg_try_advisory_xact_lock($1::bigint)`
 
-const SQL_DELETE_PLUG = `DELETE from plugs WHERE id=$1::integer;`
+const SQL_TRY_ADVISORY_SESSION_LOCK = `SELECT pg_try_advisory_lock($1::bigint)`
 
-const SQL_INSERT_LOG = `INSERT into logs (time, severity, message)
-VALUES ($1, $2::integer, $3::text)`
+const SQL_ADVISORY_UNLOCK = `SELECT pg_advisory_unlock($1::bigint)`
 
 func (c *DBConnection) Init(app *PlugApplication, db_uri string) {
 	c.app = app
 	c.db_uri = db_uri
 	c.reconnectToDB()
 	c.create_table_safe("plugs", SQL_CREATE_PLUGS)
-	c.create_table_safe("logs", SQL_CREATE_LOG_TABLE)
+	for _, column := range plugColumnMigrations {
+		c.add_column_safe("plugs", column.name, column.definition)
+	}
+	c.create_table_safe("credit_ledger", SQL_CREATE_LEDGER_TABLE)
+	c.create_table_safe("notification_prefs", SQL_CREATE_NOTIFICATION_PREFS_TABLE)
+	c.create_table_safe("webhooks", SQL_CREATE_WEBHOOKS_TABLE)
+	c.create_table_safe("webhook_outbox", SQL_CREATE_WEBHOOK_OUTBOX_TABLE)
+	c.create_table_safe("admin_visits", SQL_CREATE_ADMIN_VISITS_TABLE)
+	c.create_table_safe("plug_approvals", SQL_CREATE_PLUG_APPROVALS_TABLE)
+	c.create_table_safe("sites", SQL_CREATE_SITES_TABLE)
+	c.add_column_safe("sites", "token", "VARCHAR(48) NOT NULL DEFAULT ''")
+	c.create_table_safe("plug_sites", SQL_CREATE_PLUG_SITES_TABLE)
+	c.create_table_safe("impressions", SQL_CREATE_IMPRESSIONS_TABLE)
+	c.create_table_safe("pricing_rules", SQL_CREATE_PRICING_RULES_TABLE)
+	c.create_table_safe("settings", SQL_CREATE_SETTINGS_TABLE)
+	if c.create_table_safe("audit_events", SQL_CREATE_AUDIT_TABLE) && c.table_exists("logs") {
+		_, err := c.con.Exec(SQL_MIGRATE_LEGACY_LOGS)
+		if err != nil {
+			log.Error(err)
+		}
+	}
 }
 
 func (c *DBConnection) reconnectToDB() {
@@ -71,170 +197,366 @@ func (c DBConnection) pingDBAlive() {
 	}
 }
 
-func (c DBConnection) create_table_safe(name, sql string) {
-	c.pingDBAlive()
-	rows, err := c.con.Query("SELECT 1::integer FROM pg_tables WHERE schemaname = 'public' AND tablename = $1::text;",
-		name)
+func (c DBConnection) CheckAlive() error {
+	start := time.Now()
+	err := c.con.Ping()
+	c.app.metrics.ObserveDependency("postgres", "ping", start, err)
+	return err
+}
+
+func (c DBConnection) Close() {
+	err := c.con.Close()
 	if err != nil {
 		log.Error(err)
 	}
-	if !rows.Next() {
-		_, err = c.con.Exec(sql)
-		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-	}
 }
 
-func (c DBConnection) GetPlug() Plug {
-	rows, err := c.con.Query(SQL_RETRIEVE_APPROVED_PLUGS)
-
+// Locked runs work in a transaction holding an advisory lock, so only one
+// replica does it at a time, committing if work succeeds. It returns false
+// without running work if someone else holds the lock.
+func (c DBConnection) Locked(lock int64, operation string, work func(tx *sql.Tx) error) (bool, error) {
+	start := time.Now()
+	tx, err := c.con.Begin()
 	if err != nil {
-		log.Fatal(err)
+		c.app.metrics.ObserveDependency("postgres", operation, start, err)
+		return false, err
 	}
+	defer tx.Rollback()
 
-	var plugs []Plug
-	for rows.Next() {
-		var obj Plug
-		err = rows.Scan(&obj.ID, &obj.S3ID, &obj.Owner, &obj.ViewsRemaining)
-
-		if err != nil {
-			log.Error(err)
-		}
-
-		plugs = append(plugs, obj)
+	var locked bool
+	err = tx.QueryRow(SQL_TRY_ADVISORY_LOCK, lock).Scan(&locked)
+	if err == nil && locked {
+		err = work(tx)
 	}
-	finalPlug := ChoosePlug(plugs)
-
-	if finalPlug.ViewsRemaining > 0 {
-		finalPlug.ViewsRemaining -= 1
-		_, err = c.con.Exec("UPDATE plugs SET views=$2::integer WHERE id=$1::integer;",
-			finalPlug.ID, finalPlug.ViewsRemaining)
-		if err != nil {
-			log.Error(err)
-		}
-	}
-	if finalPlug.ViewsRemaining == 0 {
-		c.DeletePlug(finalPlug)
-		// try again
-		return c.GetPlug()
+	if err == nil {
+		err = tx.Commit()
 	}
-
-	return finalPlug
+	c.app.metrics.ObserveDependency("postgres", operation, start, err)
+	return locked, err
 }
 
-func (c DBConnection) GetPlugById(id int) Plug {
-	rows, err := c.con.Query(SQL_RETRIEVE_PLUG_BY_ID, id)
-
+// SessionLocked runs work holding an advisory lock on a connection of its
+// own, for work too slow to keep a transaction open across, like walking the
+// bucket. It returns false without running work if someone else holds the
+// lock.
+func (c DBConnection) SessionLocked(lock int64, operation string, work func() error) (bool, error) {
+	ctx := context.Background()
+	start := time.Now()
+	conn, err := c.con.Conn(ctx)
 	if err != nil {
-		log.Fatal(err)
+		c.app.metrics.ObserveDependency("postgres", operation, start, err)
+		return false, err
 	}
+	defer conn.Close()
 
-	var obj Plug
-	obj.ID = id
-	for rows.Next() {
-		err = rows.Scan(&obj.S3ID, &obj.Owner, &obj.ViewsRemaining, &obj.Approved)
-
-		if err != nil {
-			log.Error(err)
+	var locked bool
+	err = conn.QueryRowContext(ctx, SQL_TRY_ADVISORY_SESSION_LOCK, lock).Scan(&locked)
+	c.app.metrics.ObserveDependency("postgres", operation, start, err)
+	if err != nil || !locked {
+		return false, err
+	}
+	defer func() {
+		var unlocked bool
+		err := conn.QueryRowContext(ctx, SQL_ADVISORY_UNLOCK, lock).Scan(&unlocked)
+		if err != nil || !unlocked {
+			log.Error("Failed to release advisory lock, dropping its connection: ", err)
+			// Closing the connection releases the lock rather than
+			// leaving it held by one sitting in the pool
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
 		}
+	}()
+	return true, work()
+}
 
-		// Return after first result
-		return obj
+func (c DBConnection) table_exists(name string) bool {
+	rows, err := c.con.Query("SELECT 1::integer FROM pg_tables WHERE schemaname = 'public' AND tablename = $1::text;",
+		name)
+	if err != nil {
+		log.Error(err)
+		return false
 	}
+	defer rows.Close()
+	return rows.Next()
+}
 
-	log.Fatal("We should not be able to reach this point!")
-	return obj
+// create_table_safe creates the table if it doesn't exist yet, returning
+// whether it did so.
+func (c DBConnection) create_table_safe(name, sql string) bool {
+	c.pingDBAlive()
+	if c.table_exists(name) {
+		return false
+	}
+	_, err := c.con.Exec(sql)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return true
 }
 
-func (c DBConnection) DeletePlug(plug Plug) {
-	_, err := c.con.Exec(SQL_DELETE_PLUG, plug.ID)
+func (c DBConnection) add_column_safe(table, column, definition string) {
+	_, err := c.con.Exec("ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS " + column + " " + definition)
 	if err != nil {
-		log.Error(err)
+		log.Fatal(err)
 	}
-	c.app.s3.DelFile(plug)
+}
 
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-func (c DBConnection) GetPendingPlugs() []Plug {
-	rows, err := c.con.Query(SQL_RETRIEVE_PENDING_PLUGS)
+func scanPlug(row rowScanner) (Plug, error) {
+	var obj Plug
+	err := row.Scan(
+		&obj.ID,
+		&obj.S3ID,
+		&obj.Owner,
+		&obj.Group,
+		&obj.ViewsRemaining,
+		&obj.Approved,
+		&obj.Paused,
+		&obj.CreditsPaid,
+		&obj.ViewsPurchased,
+		&obj.Created,
+		&obj.ClaimedBy,
+		&obj.ClaimedAt,
+		&obj.Title,
+		&obj.AltText,
+		&obj.Description,
+		&obj.ApprovedAt,
+		&obj.EndsAt,
+		&obj.Paced,
+		&obj.Weight,
+		&obj.ImageSize,
+		&obj.ContentType,
+		&obj.ArchivedAt,
+		&obj.ArchivedBy,
+		&obj.ArchiveReason,
+		&obj.ImagePurgedAt,
+	)
+	return obj, err
+}
 
+// scanPlugRows reads every plug from a query, failing if any of them can't
+// be read.
+func scanPlugRows(rows *sql.Rows, err error) ([]Plug, error) {
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer rows.Close()
 
 	var plugs []Plug
 	for rows.Next() {
-		var obj Plug
-		err = rows.Scan(&obj.ID, &obj.S3ID, &obj.Owner, &obj.ViewsRemaining, &obj.Approved)
-
+		obj, err := scanPlug(rows)
 		if err != nil {
-			log.Error(err)
+			return nil, err
 		}
 		plugs = append(plugs, obj)
 	}
-
-	return plugs
+	return plugs, rows.Err()
 }
 
-func (c DBConnection) GetUserPlugs(user string) []Plug {
-	rows, err := c.con.Query(SQL_RETRIEVE_PENDING_PLUGS)
+// queryPlugs runs a query selecting PLUG_COLUMNS, recording it against
+// operation in the dependency metrics.
+func (c DBConnection) queryPlugs(operation, query string, args ...interface{}) []Plug {
+	start := time.Now()
+	rows, err := c.con.Query(query, args...)
+	c.app.metrics.ObserveDependency("postgres", operation, start, err)
 
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer rows.Close()
 
 	var plugs []Plug
 	for rows.Next() {
-		var obj Plug
-		err = rows.Scan(&obj.ID, &obj.S3ID, &obj.Owner, &obj.ViewsRemaining, &obj.Approved)
-
+		obj, err := scanPlug(rows)
 		if err != nil {
 			log.Error(err)
+			continue
 		}
-		if obj.Owner == user {
-			plugs = append(plugs, obj)
-		}
+		plugs = append(plugs, obj)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error(err)
 	}
 
 	return plugs
 }
 
-func (c DBConnection) SetPendingPlugs(approvedList []string) {
-	_, err := c.con.Exec("UPDATE plugs SET approved = false;")
+// GetPlug picks a plug to serve and counts the view, returning false if
+// there's nothing to show.
+func (c DBConnection) GetPlug(req ServeRequest) (Plug, bool) {
+	now := time.Now()
+	plugs := c.queryPlugs("get_plug", SQL_RETRIEVE_APPROVED_PLUGS, req.SiteID, now)
+	plugs = c.app.frequency.Filter(req.Viewer, PacePlugs(plugs, now))
+	finalPlug, ok := ChoosePlug(plugs, c.GetFillRatio())
+	if !ok {
+		return Plug{}, false
+	}
+
+	// Exhausted plugs are cleaned up by the expiry worker. One which ran
+	// out after it was picked is still shown, rather than looking again.
+	if finalPlug.ViewsRemaining > 0 {
+		start := time.Now()
+		err := c.con.QueryRow(SQL_COUNT_PLUG_VIEW, finalPlug.ID, now).Scan(&finalPlug.ViewsRemaining)
+		c.app.metrics.ObserveDependency("postgres", "update_views", start, err)
+		if err == nil {
+			c.app.notifier.ViewsChanged(finalPlug)
+		} else if err != sql.ErrNoRows {
+			log.Error(err)
+		}
+	}
+
+	return finalPlug, true
+}
+
+// GetPlugById looks up a plug, returning false if there's no such plug.
+func (c DBConnection) GetPlugById(id int) (Plug, bool) {
+	plugs := c.queryPlugs("get_plug_by_id", SQL_RETRIEVE_PLUG_BY_ID, id)
+	if len(plugs) == 0 {
+		return Plug{}, false
+	}
+	return plugs[0], true
+}
+
+// DeletePlug removes a plug and its image for good. Only house ads are
+// deleted, member plugs are archived with ArchivePlug.
+func (c DBConnection) DeletePlug(plug Plug) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_DELETE_PLUG, plug.ID)
+	c.app.metrics.ObserveDependency("postgres", "delete_plug", start, err)
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err)
 	}
+	c.app.store.DelFile(plug)
 
-	stringList := "," + strings.Join(approvedList, ",") + ","
-	_, err = c.con.Exec(SQL_SET_PENDING_PLUGS, stringList)
+}
 
+// ArchivePlug takes a plug down for good, keeping its row and image so its
+// owner and admins can look back at it. It returns the plug as archived, with
+// the views it had left at that moment, or false if it had already been
+// archived so callers don't refund or notify twice.
+func (c DBConnection) ArchivePlug(plug Plug, actor, reason string) (Plug, bool) {
+	start := time.Now()
+	archived, err := scanPlug(c.con.QueryRow(SQL_ARCHIVE_PLUG, plug.ID, time.Now(), actor, reason))
+	c.app.metrics.ObserveDependency("postgres", "archive_plug", start, err)
 	if err != nil {
-		log.Fatal(err)
+		if err != sql.ErrNoRows {
+			log.Error(err)
+		}
+		return plug, false
 	}
+	archived.Sites = plug.Sites
+	return archived, true
 }
 
-func (c DBConnection) AddLog(severity int, message string) {
-	_, err := c.con.Exec(
-		SQL_INSERT_LOG,
-		time.Now(),
-		severity,
-		message)
+func (c DBConnection) GetPendingPlugs() []Plug {
+	return c.queryPlugs("get_pending_plugs", SQL_RETRIEVE_PENDING_PLUGS)
+}
+
+func (c DBConnection) GetLivePlugs() []Plug {
+	return c.queryPlugs("get_live_plugs", SQL_RETRIEVE_LIVE_PLUGS)
+}
+
+// GetAllPlugs returns every plug, including archived ones. Unlike the other
+// listings it fails rather than leaving out plugs it can't read, as callers
+// act on what's missing.
+func (c DBConnection) GetAllPlugs() ([]Plug, error) {
+	start := time.Now()
+	plugs, err := scanPlugRows(c.con.Query(SQL_RETRIEVE_ALL_PLUGS))
+	c.app.metrics.ObserveDependency("postgres", "get_all_plugs", start, err)
+	return plugs, err
+}
+
+func (c DBConnection) GetArchivedPlugs() []Plug {
+	return c.queryPlugs("get_archived_plugs", SQL_RETRIEVE_ARCHIVED_PLUGS)
+}
+
+// GetUserPlugs returns the plugs a member uploaded along with those owned by
+// any of the given groups.
+func (c DBConnection) GetUserPlugs(user string, groups []string) []Plug {
+	return c.queryPlugs("get_user_plugs", SQL_RETRIEVE_USER_PLUGS, user, pq.Array(groups))
+}
+
+// GetUserArchivedPlugs returns the member's most recently archived plugs,
+// along with those of the given groups.
+func (c DBConnection) GetUserArchivedPlugs(user string, groups []string) []Plug {
+	return c.queryPlugs("get_user_archived_plugs", SQL_RETRIEVE_USER_ARCHIVED_PLUGS, user, pq.Array(groups), PAST_PLUGS_LIMIT)
+}
 
+func (c DBConnection) SetPlugPaused(plug Plug, paused bool) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_SET_PLUG_PAUSED, plug.ID, paused)
+	c.app.metrics.ObserveDependency("postgres", "set_plug_paused", start, err)
 	if err != nil {
 		log.Error(err)
 	}
 }
 
-func (c DBConnection) MakePlug(plug Plug) {
-	_, err := c.con.Exec(
+// AddPlugViews adds purchased views to a plug, returning its new view count
+// or false if the plug has gone away in the meantime.
+func (c DBConnection) AddPlugViews(plug Plug, views, credits int) (int, bool) {
+	var remaining int
+	start := time.Now()
+	err := c.con.QueryRow(SQL_ADD_PLUG_VIEWS, plug.ID, views, credits).Scan(&remaining)
+	c.app.metrics.ObserveDependency("postgres", "add_plug_views", start, err)
+	if err != nil {
+		log.Error(err)
+		return 0, false
+	}
+	return remaining, true
+}
+
+// ApprovePlugs approves the given plugs, returning those which weren't
+// approved before.
+func (c DBConnection) ApprovePlugs(ids []int) []Plug {
+	return c.queryPlugs("approve_plugs", SQL_APPROVE_PLUGS, pq.Array(ids), time.Now())
+}
+
+// RevokePlugApprovals sends approved plugs back to the queue, returning those
+// which were approved.
+func (c DBConnection) RevokePlugApprovals(ids []int) []Plug {
+	return c.queryPlugs("revoke_plug_approvals", SQL_REVOKE_PLUG_APPROVALS, pq.Array(ids))
+}
+
+func (c DBConnection) MakePlug(plug Plug) (int, error) {
+	var id int
+	start := time.Now()
+	err := c.con.QueryRow(
 		SQL_CREATE_PLUG,
 		plug.S3ID,
 		plug.Owner,
+		plug.Group,
 		plug.ViewsRemaining,
-	)
+		plug.CreditsPaid,
+		plug.ViewsPurchased,
+		time.Now(),
+		plug.Title,
+		plug.AltText,
+		plug.Description,
+		plug.EndsAt,
+		plug.Paced,
+		plug.ImageSize,
+		plug.ContentType,
+	).Scan(&id)
+	c.app.metrics.ObserveDependency("postgres", "make_plug", start, err)
+	return id, err
+}
+
+func (c DBConnection) CountPlugsByState() map[string]float64 {
+	var approved, pending, exhausted, archived int
+	start := time.Now()
+	err := c.con.QueryRow(SQL_COUNT_PLUGS_BY_STATE).Scan(&approved, &pending, &exhausted, &archived)
+	c.app.metrics.ObserveDependency("postgres", "count_plugs", start, err)
 	if err != nil {
 		log.Error(err)
+		return nil
+	}
+
+	return map[string]float64{
+		"approved":  float64(approved),
+		"pending":   float64(pending),
+		"exhausted": float64(exhausted),
+		"archived":  float64(archived),
 	}
 }
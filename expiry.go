@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Serving a plug's last view only marks it exhausted. The expiry worker
+// then archives it and tells its owner and webhooks, keeping all of that out
+// of viewers' requests. It also deletes the images of plugs archived longer
+// than PLUG_IMAGE_RETENTION_DAYS, keeping their rows for the history. Every
+// replica runs the worker, but a Postgres advisory lock lets only one of
+// them work at a time.
+
+const DEFAULT_EXPIRY_INTERVAL = time.Minute
+
+// Days archived plugs keep their images, zero keeps them forever
+const DEFAULT_IMAGE_RETENTION_DAYS = 90
+
+// Most images purged each time the worker runs, so a backlog is worked
+// through a bit at a time
+const IMAGE_PURGE_BATCH = 100
+
+// Advisory lock held while expiring plugs, shared by every replica
+const EXPIRY_LOCK_ID = 0x706c7567
+
+// Plugs which ran out before exhausted_at was recorded are archived as of now
+const SQL_ARCHIVE_EXHAUSTED_PLUGS = `UPDATE plugs
+SET archived_at = COALESCE(exhausted_at, $1), archived_by = $2::text, archive_reason = $3::text
+WHERE views = 0 AND archived_at IS NULL
+RETURNING ` + PLUG_COLUMNS
+
+const SQL_RETRIEVE_PURGEABLE_PLUGS = `SELECT ` + PLUG_COLUMNS + ` FROM plugs
+WHERE archived_at < $1 AND image_purged_at IS NULL
+ORDER BY archived_at, id
+LIMIT $2::integer`
+
+const SQL_SET_IMAGE_PURGED = `UPDATE plugs SET image_purged_at=$2 WHERE id=$1::integer AND image_purged_at IS NULL`
+
+type ExpiryWorker struct {
+	app       *PlugApplication
+	interval  time.Duration
+	retention time.Duration
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func (e *ExpiryWorker) Init(app *PlugApplication, interval, retention string) {
+	e.app = app
+	e.interval = DEFAULT_EXPIRY_INTERVAL
+	e.retention = DEFAULT_IMAGE_RETENTION_DAYS * 24 * time.Hour
+	e.stop = make(chan struct{})
+
+	if interval != "" {
+		var err error
+		e.interval, err = time.ParseDuration(interval)
+		if err != nil || e.interval <= 0 {
+			log.Fatal("PLUG_EXPIRY_INTERVAL must be a positive duration like 1m")
+		}
+	}
+	if retention != "" {
+		days, err := strconv.Atoi(retention)
+		if err != nil || days < 0 {
+			log.Fatal("PLUG_IMAGE_RETENTION_DAYS must be a number of days")
+		}
+		e.retention = time.Duration(days) * 24 * time.Hour
+	}
+}
+
+// Start runs the worker until Stop is called.
+func (e *ExpiryWorker) Start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				e.Expire(SYSTEM_ACTOR)
+				e.PurgeImages(SYSTEM_ACTOR)
+			}
+		}
+	}()
+}
+
+func (e *ExpiryWorker) Stop() {
+	close(e.stop)
+	e.wg.Wait()
+}
+
+// locked runs work holding the expiry lock, see DBConnection.Locked.
+func (e *ExpiryWorker) locked(operation string, work func(tx *sql.Tx) error) error {
+	_, err := e.app.db.Locked(EXPIRY_LOCK_ID, operation, work)
+	return err
+}
+
+// Expire archives exhausted plugs, returning them. It does nothing if
+// another replica is already at it.
+func (e *ExpiryWorker) Expire(actor string) []Plug {
+	var expired []Plug
+	err := e.locked("expire_plugs", func(tx *sql.Tx) error {
+		var err error
+		expired, err = archiveExhaustedPlugs(tx, actor)
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	// The plugs are archived, so nothing below will be repeated if it fails
+	db := e.app.db
+	for _, plug := range expired {
+		db.Audit(actor, AUDIT_PLUG_EXPIRED, plug.ID, SEVERITY_INFO, map[string]interface{}{
+			"views_purchased": plug.ViewsPurchased,
+		})
+		e.app.webhooks.Emit(EVENT_PLUG_EXHAUSTED, plug, actor, nil)
+		e.app.notifier.Notify(Notification{Kind: NOTIFY_EXHAUSTED, Plug: plug})
+	}
+	if len(expired) > 0 {
+		log.WithField("plugs", len(expired)).Info("Expired exhausted plugs")
+	}
+	return expired
+}
+
+// PurgeImages deletes the images of plugs archived for longer than the
+// retention period, returning the plugs whose images went.
+func (e *ExpiryWorker) PurgeImages(actor string) []Plug {
+	if e.retention == 0 {
+		return nil
+	}
+
+	// Only the plugs are picked under the lock, so slow deletes don't hold a
+	// transaction open. Another replica may pick the same plugs meanwhile,
+	// but deleting an image twice is harmless and only one marks it purged.
+	var plugs []Plug
+	err := e.locked("purge_images", func(tx *sql.Tx) error {
+		var err error
+		plugs, err = scanPlugRows(tx.Query(SQL_RETRIEVE_PURGEABLE_PLUGS, time.Now().Add(-e.retention), IMAGE_PURGE_BATCH))
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	// Each plug is marked as its image goes, so a failure part way through
+	// leaves the rest for next time
+	var purged []Plug
+	for _, plug := range plugs {
+		if err := e.app.store.DelFile(plug); err != nil {
+			continue
+		}
+		now := time.Now()
+		if !e.app.db.MarkImagePurged(plug, now) {
+			continue
+		}
+		plug.ImagePurgedAt = &now
+		purged = append(purged, plug)
+		e.app.db.Audit(actor, AUDIT_PLUG_IMAGE_PURGED, plug.ID, SEVERITY_INFO, map[string]interface{}{
+			"s3id": plug.S3ID,
+		})
+	}
+	if len(purged) > 0 {
+		log.WithField("plugs", len(purged)).Info("Purged archived plug images")
+	}
+	return purged
+}
+
+func archiveExhaustedPlugs(tx *sql.Tx, actor string) ([]Plug, error) {
+	return scanPlugRows(tx.Query(SQL_ARCHIVE_EXHAUSTED_PLUGS, time.Now(), actor, ARCHIVE_REASON_EXHAUSTED))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Frequency capping stops one viewer seeing the same plug over and over.
+// Once a viewer has been shown a plug cap times within the window it's
+// skipped for them until older views age out. House ads are never capped.
+
+const (
+	DEFAULT_FREQUENCY_CAP    = 3
+	DEFAULT_FREQUENCY_WINDOW = time.Hour
+)
+
+// Where viewer exposures are kept, set with PLUG_EXPOSURE_STORE. The memory
+// store is per process so only suits a single replica.
+const (
+	EXPOSURE_STORE_MEMORY   = "memory"
+	EXPOSURE_STORE_POSTGRES = "postgres"
+)
+
+// The memory store drops expired exposures for every viewer after this many
+// records, rather than only when a viewer comes back.
+const MEMORY_EXPOSURE_SWEEP_INTERVAL = 1000
+
+const SQL_CREATE_VIEWER_EXPOSURES_TABLE = `CREATE TABLE viewer_exposures (
+viewer          VARCHAR(64) NOT NULL,
+plug_id         INTEGER NOT NULL,
+time            TIMESTAMP NOT NULL
+);
+CREATE INDEX viewer_exposures_viewer_idx ON viewer_exposures (viewer, time);`
+
+// Recording an exposure also clears out the viewer's expired ones
+const SQL_RECORD_VIEWER_EXPOSURE = `WITH expired AS (
+DELETE FROM viewer_exposures WHERE viewer=$1::text AND time < $4
+)
+INSERT INTO viewer_exposures (viewer, plug_id, time) VALUES ($1::text, $2::integer, $3)`
+
+const SQL_COUNT_VIEWER_EXPOSURES = `SELECT plug_id, COUNT(*) FROM viewer_exposures
+WHERE viewer=$1::text AND time >= $2
+GROUP BY plug_id`
+
+// ExposureStore remembers which plugs each viewer has been shown.
+type ExposureStore interface {
+	// Exposures counts how many times viewer has seen each plug since the
+	// given time.
+	Exposures(viewer string, since time.Time) (map[int]int, error)
+	// Record notes that viewer was shown plugID. Exposures from before
+	// expireBefore will no longer be asked about and may be dropped.
+	Record(viewer string, plugID int, at, expireBefore time.Time) error
+}
+
+type exposure struct {
+	plugID int
+	at     time.Time
+}
+
+// MemoryExposureStore keeps exposures in process.
+type MemoryExposureStore struct {
+	mu      sync.Mutex
+	viewers map[string][]exposure
+	records int
+}
+
+func NewMemoryExposureStore() *MemoryExposureStore {
+	return &MemoryExposureStore{viewers: make(map[string][]exposure)}
+}
+
+func (s *MemoryExposureStore) Exposures(viewer string, since time.Time) (map[int]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[int]int)
+	for _, e := range s.viewers[viewer] {
+		if !e.at.Before(since) {
+			counts[e.plugID]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *MemoryExposureStore) Record(viewer string, plugID int, at, expireBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.viewers[viewer] = append(expireExposures(s.viewers[viewer], expireBefore), exposure{plugID, at})
+
+	s.records++
+	if s.records%MEMORY_EXPOSURE_SWEEP_INTERVAL == 0 {
+		for v, exposures := range s.viewers {
+			if remaining := expireExposures(exposures, expireBefore); len(remaining) > 0 {
+				s.viewers[v] = remaining
+			} else {
+				delete(s.viewers, v)
+			}
+		}
+	}
+	return nil
+}
+
+// expireExposures drops exposures from before the given time. They're kept
+// in the order they were recorded so the expired ones are at the front.
+func expireExposures(exposures []exposure, before time.Time) []exposure {
+	i := 0
+	for i < len(exposures) && exposures[i].at.Before(before) {
+		i++
+	}
+	return exposures[i:]
+}
+
+// PostgresExposureStore shares exposures between replicas.
+type PostgresExposureStore struct {
+	db *DBConnection
+}
+
+func (s PostgresExposureStore) Exposures(viewer string, since time.Time) (map[int]int, error) {
+	start := time.Now()
+	rows, err := s.db.con.Query(SQL_COUNT_VIEWER_EXPOSURES, viewer, since)
+	s.db.app.metrics.ObserveDependency("postgres", "count_viewer_exposures", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var id, count int
+		err = rows.Scan(&id, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[id] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s PostgresExposureStore) Record(viewer string, plugID int, at, expireBefore time.Time) error {
+	start := time.Now()
+	_, err := s.db.con.Exec(SQL_RECORD_VIEWER_EXPOSURE, viewer, plugID, at, expireBefore)
+	s.db.app.metrics.ObserveDependency("postgres", "record_viewer_exposure", start, err)
+	return err
+}
+
+type FrequencyCap struct {
+	store ExposureStore
+	// Views of one plug allowed per viewer per window, 0 disables capping
+	cap    int
+	window time.Duration
+}
+
+func (f *FrequencyCap) Init(app *PlugApplication, store, cap, window string) {
+	f.cap = DEFAULT_FREQUENCY_CAP
+	if cap != "" {
+		parsed, err := strconv.Atoi(cap)
+		if err != nil || parsed < 0 {
+			log.Fatal("PLUG_FREQUENCY_CAP must be a number, or 0 to disable capping")
+		}
+		f.cap = parsed
+	}
+
+	f.window = DEFAULT_FREQUENCY_WINDOW
+	if window != "" {
+		parsed, err := time.ParseDuration(window)
+		if err != nil || parsed <= 0 {
+			log.Fatal("PLUG_FREQUENCY_WINDOW must be a duration such as 1h")
+		}
+		f.window = parsed
+	}
+
+	switch store {
+	case "", EXPOSURE_STORE_MEMORY:
+		f.store = NewMemoryExposureStore()
+	case EXPOSURE_STORE_POSTGRES:
+		app.db.create_table_safe("viewer_exposures", SQL_CREATE_VIEWER_EXPOSURES_TABLE)
+		f.store = PostgresExposureStore{db: &app.db}
+	default:
+		log.Fatal("PLUG_EXPOSURE_STORE must be memory or postgres")
+	}
+}
+
+// Filter drops plugs viewer has already seen as often as the cap allows.
+func (f *FrequencyCap) Filter(viewer string, plugs []Plug) []Plug {
+	if f.cap == 0 || viewer == "" {
+		return plugs
+	}
+
+	seen, err := f.store.Exposures(viewer, time.Now().Add(-f.window))
+	if err != nil {
+		// Better to show a plug too often than not at all
+		log.Error(err)
+		return plugs
+	}
+
+	var eligible []Plug
+	for _, plug := range plugs {
+		if plug.IsDefault() || seen[plug.ID] < f.cap {
+			eligible = append(eligible, plug)
+		}
+	}
+	return eligible
+}
+
+// Record notes that viewer was shown plug.
+func (f *FrequencyCap) Record(viewer string, plug Plug) {
+	if f.cap == 0 || viewer == "" || plug.IsDefault() {
+		return
+	}
+
+	now := time.Now()
+	err := f.store.Record(viewer, plug.ID, now, now.Add(-f.window))
+	if err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const READINESS_CHECK_TIMEOUT = 5 * time.Second
+
+var errCheckTimeout = errors.New("check timed out")
+
+type DependencyStatus struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type namedDependencyStatus struct {
+	name   string
+	status DependencyStatus
+}
+
+type ReadinessReport struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// checkDependency runs a single readiness probe, giving up once
+// READINESS_CHECK_TIMEOUT has passed so one hung backend can't stall /readyz.
+func checkDependency(check func() error) DependencyStatus {
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- check()
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(READINESS_CHECK_TIMEOUT):
+		err = errCheckTimeout
+	}
+
+	status := DependencyStatus{
+		Status:    "ok",
+		LatencyMS: int64(time.Since(start) / time.Millisecond),
+	}
+	if err != nil {
+		status.Status = "error"
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func (a *PlugApplication) IsDraining() bool {
+	return atomic.LoadInt32(&a.draining) == 1
+}
+
+func (a *PlugApplication) StartDraining() {
+	atomic.StoreInt32(&a.draining, 1)
+}
+
+func (r PlugRoutes) healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (r PlugRoutes) readyz(c *gin.Context) {
+	checks := map[string]func() error{
+		"postgres":         r.app.db.CheckAlive,
+		"ldap":             r.app.ldap.CheckAlive,
+		r.app.store.Name(): r.app.store.CheckAlive,
+	}
+
+	results := make(chan namedDependencyStatus, len(checks))
+	for name, check := range checks {
+		go func(name string, check func() error) {
+			results <- namedDependencyStatus{name, checkDependency(check)}
+		}(name, check)
+	}
+
+	report := ReadinessReport{
+		Status:       "ok",
+		Dependencies: make(map[string]DependencyStatus),
+	}
+	for range checks {
+		result := <-results
+		report.Dependencies[result.name] = result.status
+		if result.status.Status != "ok" {
+			report.Status = "error"
+		}
+	}
+
+	if r.app.IsDraining() {
+		report.Status = "draining"
+	}
+
+	if report.Status != "ok" {
+		c.JSON(http.StatusServiceUnavailable, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// House ads are the plugs shown when members haven't bought the slot. They
+// never run out (views is negative, see IsDefault), are uploaded by admins
+// without spending credits and are switched on and off with paused.
+
+// Percentage of requests given to member plugs while there are any, the
+// rest going to house ads. Admins can change it from the house ads page.
+const DEFAULT_FILL_RATIO = 95
+
+// Weight new house ads are given, relative to the others
+const DEFAULT_HOUSE_AD_WEIGHT = 1
+
+// Keys in the settings table
+const SETTING_FILL_RATIO = "fill_ratio"
+
+const SQL_CREATE_SETTINGS_TABLE = `CREATE TABLE settings (
+key             VARCHAR(64) PRIMARY KEY,
+value           TEXT NOT NULL
+);`
+
+const SQL_RETRIEVE_SETTING = `SELECT value FROM settings WHERE key=$1::text`
+
+const SQL_SET_SETTING = `INSERT INTO settings (key, value) VALUES ($1::text, $2::text)
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`
+
+const SQL_RETRIEVE_HOUSE_ADS = `SELECT ` + PLUG_COLUMNS + ` FROM plugs
+WHERE views<0
+ORDER BY created, id`
+
+const SQL_CREATE_HOUSE_AD = `INSERT INTO plugs (s3id, owner, views, approved, approved_at, created, title, alt_text, description, weight,
+image_size, content_type)
+VALUES ($1::text, $2::text, -1, true, $3, $3, $4::text, $5::text, $6::text, $7::integer, $8::bigint, $9::text)
+RETURNING id`
+
+const SQL_SET_HOUSE_AD_WEIGHT = `UPDATE plugs SET weight=$2::integer WHERE id=$1::integer AND views<0`
+
+// Enabling also approves house ads that were added by hand before there was
+// a page for them.
+const SQL_SET_HOUSE_AD_ENABLED = `UPDATE plugs
+SET approved = approved OR $2::boolean, paused = NOT $2::boolean
+WHERE id=$1::integer AND views<0`
+
+// Enabled reports whether a house ad is being shown.
+func (p Plug) Enabled() bool {
+	return p.Approved && !p.Paused
+}
+
+func (c DBConnection) GetSetting(key string) (string, bool) {
+	var value string
+	start := time.Now()
+	err := c.con.QueryRow(SQL_RETRIEVE_SETTING, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	c.app.metrics.ObserveDependency("postgres", "get_setting", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+	return value, value != ""
+}
+
+func (c DBConnection) SetSetting(key, value string) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_SET_SETTING, key, value)
+	c.app.metrics.ObserveDependency("postgres", "set_setting", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// GetFillRatio is the percentage of requests member plugs get while there
+// are any to show.
+func (c DBConnection) GetFillRatio() int {
+	value, ok := c.GetSetting(SETTING_FILL_RATIO)
+	if !ok {
+		return DEFAULT_FILL_RATIO
+	}
+	ratio, err := strconv.Atoi(value)
+	if err != nil || ratio < 0 || ratio > 100 {
+		log.Error("invalid fill ratio setting: ", value)
+		return DEFAULT_FILL_RATIO
+	}
+	return ratio
+}
+
+func (c DBConnection) GetHouseAds() []Plug {
+	return c.queryPlugs("get_house_ads", SQL_RETRIEVE_HOUSE_ADS)
+}
+
+func (c DBConnection) MakeHouseAd(plug Plug) int {
+	var id int
+	start := time.Now()
+	err := c.con.QueryRow(
+		SQL_CREATE_HOUSE_AD,
+		plug.S3ID,
+		plug.Owner,
+		time.Now(),
+		plug.Title,
+		plug.AltText,
+		plug.Description,
+		plug.Weight,
+		plug.ImageSize,
+		plug.ContentType,
+	).Scan(&id)
+	c.app.metrics.ObserveDependency("postgres", "make_house_ad", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+	return id
+}
+
+func (c DBConnection) SetHouseAdWeight(plug Plug, weight int) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_SET_HOUSE_AD_WEIGHT, plug.ID, weight)
+	c.app.metrics.ObserveDependency("postgres", "set_house_ad_weight", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (c DBConnection) SetHouseAdEnabled(plug Plug, enabled bool) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_SET_HOUSE_AD_ENABLED, plug.ID, enabled)
+	c.app.metrics.ObserveDependency("postgres", "set_house_ad_enabled", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// houseAd looks up the house ad named in the URL for an admin, writing an
+// error response and returning false if there isn't one.
+func (r PlugRoutes) houseAd(c *gin.Context) (string, Plug, bool) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return "", Plug{}, false
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid house ad id!")
+		return "", Plug{}, false
+	}
+	plug, ok := r.app.db.GetPlugById(id)
+	if !ok || !plug.IsDefault() {
+		c.String(http.StatusNotFound, "No such house ad!")
+		return "", Plug{}, false
+	}
+	return claims.UserInfo.Username, plug, true
+}
+
+// parseWeight reads a house ad's weight from the form, which must be at
+// least 1.
+func parseWeight(c *gin.Context) (int, bool) {
+	weight, err := strconv.Atoi(c.PostForm("weight"))
+	if err != nil || weight < 1 {
+		c.String(http.StatusBadRequest, "Weights must be a whole number of at least 1!")
+		return 0, false
+	}
+	return weight, true
+}
+
+type houseAdItem struct {
+	Plug
+	// Share of house ad views this one gets while enabled, as a percentage
+	Share int
+}
+
+func (r PlugRoutes) house_ads_view(c *gin.Context) {
+	if _, ok := r.requireAdmin(c); !ok {
+		return
+	}
+
+	plugs := r.app.db.GetHouseAds()
+	total := 0
+	for _, plug := range plugs {
+		if plug.Enabled() {
+			total += plug.Weight
+		}
+	}
+
+	var ads []houseAdItem
+	for _, plug := range plugs {
+		item := houseAdItem{Plug: plug}
+		item.PresignedURL = r.app.store.PresignPlug(plug).String()
+		if plug.Enabled() && total > 0 {
+			item.Share = plug.Weight * 100 / total
+		}
+		ads = append(ads, item)
+	}
+
+	r.page(c, "house_ads.tmpl", gin.H{
+		"ads":            ads,
+		"fill_ratio":     r.app.db.GetFillRatio(),
+		"default_weight": DEFAULT_HOUSE_AD_WEIGHT,
+	})
+}
+
+func (r PlugRoutes) house_ad_create(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	plug := Plug{Owner: claims.UserInfo.Username}
+	if !plugTextFromForm(c, &plug) {
+		return
+	}
+	if plug.Weight, ok = parseWeight(c); !ok {
+		return
+	}
+
+	file, data, mime, ok := readPlugImage(c)
+	if !ok {
+		return
+	}
+	defer data.Close()
+
+	plug.S3ID = time.Now().Format("2006/01/02/150405") + "-house-" + file.Filename
+	plug.ImageSize = file.Size
+	plug.ContentType = mime
+	r.app.store.AddFile(plug, data, mime)
+	plug.ID = r.app.db.MakeHouseAd(plug)
+
+	r.app.db.Audit(plug.Owner, AUDIT_HOUSE_AD_CREATED, plug.ID, SEVERITY_INFO, map[string]interface{}{
+		"s3id":   plug.S3ID,
+		"weight": plug.Weight,
+	})
+	flash(c, FLASH_SUCCESS, "House ad added.")
+	c.Redirect(http.StatusFound, "/admin/house")
+}
+
+func (r PlugRoutes) house_ad_weight(c *gin.Context) {
+	actor, plug, ok := r.houseAd(c)
+	if !ok {
+		return
+	}
+	weight, ok := parseWeight(c)
+	if !ok {
+		return
+	}
+
+	r.app.db.SetHouseAdWeight(plug, weight)
+	r.app.db.Audit(actor, AUDIT_HOUSE_AD_UPDATED, plug.ID, SEVERITY_INFO, map[string]interface{}{
+		"weight": weight,
+	})
+	flash(c, FLASH_SUCCESS, "House ad weight saved.")
+	c.Redirect(http.StatusFound, "/admin/house")
+}
+
+func (r PlugRoutes) house_ad_toggle(c *gin.Context) {
+	actor, plug, ok := r.houseAd(c)
+	if !ok {
+		return
+	}
+
+	enabled := c.PostForm("enabled") == "true"
+	r.app.db.SetHouseAdEnabled(plug, enabled)
+	r.app.db.Audit(actor, AUDIT_HOUSE_AD_UPDATED, plug.ID, SEVERITY_INFO, map[string]interface{}{
+		"enabled": enabled,
+	})
+	if enabled {
+		flash(c, FLASH_SUCCESS, "House ad enabled.")
+	} else {
+		flash(c, FLASH_SUCCESS, "House ad disabled.")
+	}
+	c.Redirect(http.StatusFound, "/admin/house")
+}
+
+func (r PlugRoutes) house_ad_deletion(c *gin.Context) {
+	actor, plug, ok := r.houseAd(c)
+	if !ok {
+		return
+	}
+
+	r.app.db.DeletePlug(plug)
+	r.app.db.Audit(actor, AUDIT_HOUSE_AD_DELETED, plug.ID, SEVERITY_INFO, map[string]interface{}{
+		"s3id": plug.S3ID,
+	})
+	flash(c, FLASH_SUCCESS, "House ad deleted.")
+	c.Redirect(http.StatusFound, "/admin/house")
+}
+
+func (r PlugRoutes) fill_ratio_set(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	ratio, err := strconv.Atoi(c.PostForm("fillRatio"))
+	if err != nil || ratio < 0 || ratio > 100 {
+		c.String(http.StatusBadRequest, "The fill ratio must be a percentage!")
+		return
+	}
+
+	r.app.db.SetSetting(SETTING_FILL_RATIO, strconv.Itoa(ratio))
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_SETTING_CHANGED, 0, SEVERITY_INFO, map[string]interface{}{
+		"key":   SETTING_FILL_RATIO,
+		"value": ratio,
+	})
+	flash(c, FLASH_SUCCESS, fmt.Sprintf("Member plugs now get %d%% of requests.", ratio))
+	c.Redirect(http.StatusFound, "/admin/house")
+}
@@ -6,6 +6,8 @@ import (
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/ldap.v2"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type LDAPConnection struct {
@@ -34,18 +36,25 @@ func (c *LDAPConnection) reconnectToLDAP() {
 	lcon, err := ldap.DialTLS("tcp", c.host,
 		&tls.Config{ServerName: "ldap.csh.rit.edu"})
 	if err != nil {
-		c.app.db.AddLog(0, "ldap connection error: "+err.Error())
+		c.auditError("connect", err)
 		log.Fatal(err)
 	}
 	err = lcon.Bind(c.bind_dn, c.bind_pw)
 	if err != nil {
-		c.app.db.AddLog(0, "ldap bind error: "+err.Error())
+		c.auditError("bind", err)
 		log.Fatal(err)
 	}
 	c.con = lcon
 }
 
-func (c LDAPConnection) pingLDAPAlive() {
+func (c LDAPConnection) auditError(operation string, err error) {
+	c.app.db.Audit(SYSTEM_ACTOR, AUDIT_LDAP_ERROR, 0, SEVERITY_ERROR, map[string]interface{}{
+		"operation": operation,
+		"error":     err.Error(),
+	})
+}
+
+func (c LDAPConnection) CheckAlive() error {
 	searchReq := ldap.NewSearchRequest(
 		"dc=csh,dc=rit,dc=edu",
 		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
@@ -53,8 +62,14 @@ func (c LDAPConnection) pingLDAPAlive() {
 		[]string{"dn"},
 		nil,
 	)
+	start := time.Now()
 	_, err := c.con.Search(searchReq)
-	if err != nil {
+	c.app.metrics.ObserveDependency("ldap", "ping", start, err)
+	return err
+}
+
+func (c LDAPConnection) pingLDAPAlive() {
+	if c.CheckAlive() != nil {
 		c.reconnectToLDAP()
 	}
 }
@@ -69,35 +84,115 @@ func (c LDAPConnection) CheckIfAdmin(username string) bool {
 		nil,
 	)
 
+	start := time.Now()
 	sr, err := c.con.Search(searchRequest)
+	c.app.metrics.ObserveDependency("ldap", "check_admin", start, err)
 	if err != nil {
-		c.app.db.AddLog(0, "ldap search error: "+err.Error())
+		c.auditError("search", err)
 		log.Fatal(err)
 		return false
 	}
 	return len(sr.Entries) > 0
 }
 
-func (c LDAPConnection) CheckIfIntroMember(username string) bool {
+func (c LDAPConnection) CheckIfGroupMember(username, group string) bool {
 	c.pingLDAPAlive()
 	searchRequest := ldap.NewSearchRequest(
 		"cn=users,cn=accounts,dc=csh,dc=rit,dc=edu",
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		"(&(memberof=cn=intromembers,cn=groups,cn=accounts,dc=csh,dc=rit,dc=edu)(uid="+username+"))",
+		"(&(memberof=cn="+ldap.EscapeFilter(group)+",cn=groups,cn=accounts,dc=csh,dc=rit,dc=edu)(uid="+ldap.EscapeFilter(username)+"))",
 		[]string{"uid"},
 		nil,
 	)
 
+	start := time.Now()
 	sr, err := c.con.Search(searchRequest)
+	c.app.metrics.ObserveDependency("ldap", "check_group_member", start, err)
 	if err != nil {
-		c.app.db.AddLog(0, "ldap search error: "+err.Error())
-		log.Fatal(err)
+		c.auditError("search", err)
+		log.Error(err)
 		return false
 	}
 	return len(sr.Entries) > 0
 }
 
+// GetUserGroups returns the cn of every group the member belongs to.
+func (c LDAPConnection) GetUserGroups(username string) []string {
+	c.pingLDAPAlive()
+	searchRequest := ldap.NewSearchRequest(
+		"uid="+username+",cn=users,cn=accounts,dc=csh,dc=rit,dc=edu",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"memberOf"},
+		nil,
+	)
+
+	start := time.Now()
+	sr, err := c.con.Search(searchRequest)
+	c.app.metrics.ObserveDependency("ldap", "get_groups", start, err)
+	if err != nil {
+		c.auditError("search", err)
+		log.Error(err)
+		return nil
+	}
+	if len(sr.Entries) == 0 {
+		return nil
+	}
+
+	var groups []string
+	for _, groupDN := range sr.Entries[0].GetAttributeValues("memberOf") {
+		dn, err := ldap.ParseDN(groupDN)
+		if err != nil || len(dn.RDNs) == 0 {
+			continue
+		}
+		for _, attr := range dn.RDNs[0].Attributes {
+			if strings.EqualFold(attr.Type, "cn") {
+				groups = append(groups, attr.Value)
+			}
+		}
+	}
+	return groups
+}
+
+// GetEmail returns the member's mail attribute, falling back to their CSH
+// address.
+func (c LDAPConnection) GetEmail(username string) string {
+	fallback := username + "@csh.rit.edu"
+
+	c.pingLDAPAlive()
+	searchRequest := ldap.NewSearchRequest(
+		"uid="+username+",cn=users,cn=accounts,dc=csh,dc=rit,dc=edu",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"mail"},
+		nil,
+	)
+
+	start := time.Now()
+	sr, err := c.con.Search(searchRequest)
+	c.app.metrics.ObserveDependency("ldap", "get_email", start, err)
+	if err != nil {
+		c.auditError("search", err)
+		log.Error(err)
+		return fallback
+	}
+	if len(sr.Entries) == 0 || sr.Entries[0].GetAttributeValue("mail") == "" {
+		return fallback
+	}
+	return sr.Entries[0].GetAttributeValue("mail")
+}
+
 func (c LDAPConnection) DecrementCredits(username string, credits int) bool {
+	return c.adjustCredits(username, -credits)
+}
+
+func (c LDAPConnection) IncrementCredits(username string, credits int) bool {
+	return c.adjustCredits(username, credits)
+}
+
+// adjustCredits changes a member's drink balance by delta, refusing to take
+// it below zero.
+func (c LDAPConnection) adjustCredits(username string, delta int) bool {
 	c.pingLDAPAlive()
 	searchRequest := ldap.NewSearchRequest(
 		"uid="+username+",cn=users,cn=accounts,dc=csh,dc=rit,dc=edu",
@@ -107,34 +202,38 @@ func (c LDAPConnection) DecrementCredits(username string, credits int) bool {
 		nil,
 	)
 
+	start := time.Now()
 	sr, err := c.con.Search(searchRequest)
+	c.app.metrics.ObserveDependency("ldap", "get_balance", start, err)
 	if err != nil {
-		c.app.db.AddLog(0, "ldap search error: "+err.Error())
+		c.auditError("search", err)
 		log.Fatal(err)
 	}
 
 	balance, err := strconv.Atoi(sr.Entries[0].GetAttributeValue("drinkBalance"))
 	if err != nil {
-		c.app.db.AddLog(0, "ldap result parse error: "+err.Error())
+		c.auditError("parse_balance", err)
 		log.Fatal(err)
 	}
-	log.Info("current balance for %s is %d", username, balance)
+	log.Infof("current balance for %s is %d", username, balance)
 
-	newBalance := balance - credits
+	newBalance := balance + delta
 
 	if newBalance < 0 {
-		log.Info("Insufficient Credits! %d", balance)
+		log.Infof("Insufficient Credits! %d", balance)
 		return false
 	}
 
 	modifyRequest := ldap.NewModifyRequest("uid=" + username + ",cn=users,cn=accounts,dc=csh,dc=rit,dc=edu")
 	modifyRequest.Replace("drinkBalance", []string{fmt.Sprintf("%d", newBalance)})
+	start = time.Now()
 	err = c.con.Modify(modifyRequest)
+	c.app.metrics.ObserveDependency("ldap", "set_balance", start, err)
 	if err != nil {
-		c.app.db.AddLog(0, "ldap modification error: "+err.Error())
+		c.auditError("modify", err)
 		log.Fatal(err)
 	}
-	log.Info("current balance for %s is %d", username, newBalance)
+	log.Infof("current balance for %s is %d", username, newBalance)
 
 	return true
 }
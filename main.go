@@ -1,126 +1,429 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/gin-gonic/gin"
 	csh_auth "github.com/liam-middlebrook/csh-auth"
 	log "github.com/sirupsen/logrus"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+
+const DEFAULT_METRICS_ADDRESS = ":9100"
+
+// How long /readyz reports draining before the listeners close, so load
+// balancers stop sending requests first
+const DEFAULT_DRAIN_DELAY = 5 * time.Second
+
 type PlugApplication struct {
 
 	// Internal
 	// --------
 
 	// Service Connections
-	db     DBConnection
-	ldap   LDAPConnection
-	s3     S3Connection
-	router *gin.Engine
-	auth   csh_auth.CSHAuth
+	db       DBConnection
+	ldap     LDAPConnection
+	store    ObjectStore
+	metrics  Metrics
+	notifier Notifier
+	webhooks WebhookDispatcher
+	objects  ObjectChecker
+	expiry   ExpiryWorker
+	router   *gin.Engine
+	auth     csh_auth.CSHAuth
+
+	// Keeps members from seeing one plug too often
+	frequency FrequencyCap
+
+	// Serves logged out visitors on public sites
+	public PublicServing
+
+	// Keeps scripts from hammering /data and /upload
+	limits RateLimits
+
+	// Set once SIGTERM is received so /readyz reports we're going away
+	draining int32
 
 	// Service Connection Credentials
 	base_path        string
 	auth_login_route string
+
+	// LDAP groups which may own plugs
+	owner_groups []string
+
+	// Distinct admins who must approve a plug before it's shown
+	required_approvals int
+}
+
+// Config is everything read from the environment at startup, see
+// configFromEnv.
+type Config struct {
+	db_uri              string
+	s3_host             string
+	s3_access_id        string
+	s3_secret_key       string
+	ldap_host           string
+	ldap_bind_dn        string
+	ldap_bind_pw        string
+	base_path           string
+	auth_client_id      string
+	auth_client_secret  string
+	auth_jwt_secret     string
+	auth_state          string
+	auth_server_host    string
+	auth_redirect_uri   string
+	auth_login_route    string
+	owner_groups        string
+	smtp_host           string
+	smtp_from           string
+	smtp_username       string
+	smtp_password       string
+	public_url          string
+	low_views_threshold string
+	required_approvals  string
+	exposure_store      string
+	frequency_cap       string
+	frequency_window    string
+	signing_key         string
+	rate_limit_store    string
+	rate_limits         string
+
+	// Scheduled object checks, see ObjectChecker
+	object_check_interval string
+	object_check_fix      string
+
+	expiry_interval string
+	image_retention string
+
+	// Where plug images are kept, see ObjectStore
+	object_store string
+	object_dir   string
+
+	// Proxies whose X-Forwarded-For is believed, see RateLimits.ClientIP
+	trusted_proxies string
 }
 
-func (a *PlugApplication) Init(
-	db_uri,
-	s3_host,
-	s3_access_id,
-	s3_secret_key,
-	ldap_host,
-	ldap_bind_dn,
-	ldap_bind_pw,
-	base_path,
-	auth_client_id,
-	auth_client_secret,
-	auth_jwt_secret,
-	auth_state,
-	auth_server_host,
-	auth_redirect_uri,
-	auth_login_route string) {
+func configFromEnv() Config {
+	return Config{
+		db_uri:              os.Getenv("DB_URI"),
+		s3_host:             os.Getenv("S3_HOST"),
+		s3_access_id:        os.Getenv("S3_ACCESS_ID"),
+		s3_secret_key:       os.Getenv("S3_SECRET_KEY"),
+		ldap_host:           os.Getenv("LDAP_HOST"),
+		ldap_bind_dn:        os.Getenv("LDAP_BIND_DN"),
+		ldap_bind_pw:        os.Getenv("LDAP_BIND_PW"),
+		base_path:           os.Getenv("BASE_PATH"),
+		auth_client_id:      os.Getenv("csh_auth_client_id"),
+		auth_client_secret:  os.Getenv("csh_auth_client_secret"),
+		auth_jwt_secret:     os.Getenv("csh_auth_jwt_secret"),
+		auth_state:          os.Getenv("csh_auth_state"),
+		auth_server_host:    os.Getenv("csh_auth_server_host"),
+		auth_redirect_uri:   os.Getenv("csh_auth_redirect_uri"),
+		auth_login_route:    "/auth/login",
+		owner_groups:        os.Getenv("PLUG_OWNER_GROUPS"),
+		smtp_host:           os.Getenv("SMTP_HOST"),
+		smtp_from:           os.Getenv("SMTP_FROM"),
+		smtp_username:       os.Getenv("SMTP_USERNAME"),
+		smtp_password:       os.Getenv("SMTP_PASSWORD"),
+		public_url:          os.Getenv("PLUG_PUBLIC_URL"),
+		low_views_threshold: os.Getenv("PLUG_LOW_VIEWS_THRESHOLD"),
+		required_approvals:  os.Getenv("PLUG_REQUIRED_APPROVALS"),
+		exposure_store:      os.Getenv("PLUG_EXPOSURE_STORE"),
+		frequency_cap:       os.Getenv("PLUG_FREQUENCY_CAP"),
+		frequency_window:    os.Getenv("PLUG_FREQUENCY_WINDOW"),
+		signing_key:         os.Getenv("PLUG_SIGNING_KEY"),
+		rate_limit_store:    os.Getenv("PLUG_RATE_LIMIT_STORE"),
+		rate_limits:         os.Getenv("PLUG_RATE_LIMITS"),
+
+		object_check_interval: os.Getenv("PLUG_OBJECT_CHECK_INTERVAL"),
+		object_check_fix:      os.Getenv("PLUG_OBJECT_CHECK_FIX"),
+
+		expiry_interval: os.Getenv("PLUG_EXPIRY_INTERVAL"),
+		image_retention: os.Getenv("PLUG_IMAGE_RETENTION_DAYS"),
+
+		object_store: os.Getenv("PLUG_OBJECT_STORE"),
+		object_dir:   os.Getenv("PLUG_OBJECT_DIR"),
+
+		trusted_proxies: os.Getenv("PLUG_TRUSTED_PROXIES"),
+	}
+}
+
+// Init connects to the services every command needs, bringing the database
+// schema up to date on the way.
+func (a *PlugApplication) Init(cfg Config) {
+	a.metrics.Init()
+	a.base_path = cfg.base_path
 
 	// Database Connection
-	a.db.Init(a, db_uri)
+	a.db.Init(a, cfg.db_uri)
+
+	a.frequency.Init(a, cfg.exposure_store, cfg.frequency_cap, cfg.frequency_window)
+	a.public.Init(cfg.signing_key)
+	a.limits.Init(a, cfg.rate_limit_store, cfg.rate_limits, cfg.trusted_proxies)
 
-	// S3 Connection
-	a.s3.Init(s3_host,
-		s3_access_id,
-		s3_secret_key)
+	// Object Store
+	switch cfg.object_store {
+	case "", OBJECT_STORE_S3:
+		s3 := &S3Connection{}
+		s3.Init(a,
+			cfg.s3_host,
+			cfg.s3_access_id,
+			cfg.s3_secret_key)
+		a.store = s3
+	case OBJECT_STORE_LOCAL:
+		local := &LocalStore{}
+		local.Init(a, cfg.object_dir, cfg.signing_key, cfg.public_url)
+		a.store = local
+	default:
+		log.Fatal("PLUG_OBJECT_STORE must be s3 or local")
+	}
 
 	// LDAP connection
-	a.ldap.Init(a, ldap_host, ldap_bind_dn, ldap_bind_pw)
+	a.ldap.Init(a, cfg.ldap_host, cfg.ldap_bind_dn, cfg.ldap_bind_pw)
 
-	a.base_path = base_path
+	a.notifier.Init(a,
+		cfg.smtp_host,
+		cfg.smtp_from,
+		cfg.smtp_username,
+		cfg.smtp_password,
+		cfg.public_url,
+		cfg.low_views_threshold)
+
+	a.webhooks.Init(a)
+	a.objects.Init(a, cfg.object_check_interval, cfg.object_check_fix)
+	a.expiry.Init(a, cfg.expiry_interval, cfg.image_retention)
+
+	a.owner_groups = splitList(cfg.owner_groups)
+	a.required_approvals = parseRequiredApprovals(cfg.required_approvals)
+}
+
+// InitServer sets up what's only needed to serve the web app: the router
+// and CSH auth.
+func (a *PlugApplication) InitServer(cfg Config) {
 	a.router = a.createGinEngine()
 
 	a.auth.Init(
-		auth_client_id,
-		auth_client_secret,
-		auth_jwt_secret,
-		auth_state,
-		auth_server_host,
-		auth_redirect_uri,
-		auth_login_route,
+		cfg.auth_client_id,
+		cfg.auth_client_secret,
+		cfg.auth_jwt_secret,
+		cfg.auth_state,
+		cfg.auth_server_host,
+		cfg.auth_redirect_uri,
+		cfg.auth_login_route,
 	)
-	a.auth_login_route = auth_login_route
+	a.auth_login_route = cfg.auth_login_route
+
+	a.metrics.RegisterGauge("plug_plugs", "Plugs by moderation state.", "state", a.db.CountPlugsByState)
+	a.metrics.RegisterGauge("plug_object_issues", "Problems found by the last scheduled object check.", "kind", a.objects.Counts)
+	a.registerRoutes()
 }
 
-func (a PlugApplication) createGinEngine() *gin.Engine {
+func (a *PlugApplication) createGinEngine() *gin.Engine {
 	var r *gin.Engine
 	r = gin.Default()
+	// X-Forwarded-For is only believed from PLUG_TRUSTED_PROXIES, see
+	// RateLimits.ClientIP
+	r.ForwardedByClientIP = false
 
-	// TODO we should probably look into a different templating solution that
-	// allows for inheritance so we can have a navigation and base page layout
-	// not be repeated.
-	r.LoadHTMLGlob(a.base_path + "templates/*")
+	r.HTMLRender = loadPages(a.base_path + "templates")
 	r.Static("/static", a.base_path+"static")
 
 	return r
 }
 
-func main() {
-	flag.Parse()
+// handle registers a route on the router, recording request metrics
+// labelled with its pattern.
+func (a *PlugApplication) handle(method, path string, handler gin.HandlerFunc) {
+	a.router.Handle(method, path, a.metrics.Instrument(path), handler)
+}
 
-	var app PlugApplication
+// splitList parses a comma separated configuration value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
-	app.Init(
-		os.Getenv("DB_URI"),
-		os.Getenv("S3_HOST"),
-		os.Getenv("S3_ACCESS_ID"),
-		os.Getenv("S3_SECRET_KEY"),
-		os.Getenv("LDAP_HOST"),
-		os.Getenv("LDAP_BIND_DN"),
-		os.Getenv("LDAP_BIND_PW"),
-		os.Getenv("BASE_PATH"),
-		os.Getenv("csh_auth_client_id"),
-		os.Getenv("csh_auth_client_secret"),
-		os.Getenv("csh_auth_jwt_secret"),
-		os.Getenv("csh_auth_state"),
-		os.Getenv("csh_auth_server_host"),
-		os.Getenv("csh_auth_redirect_uri"),
-		"/auth/login",
-	)
+func listenAddress() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
 
-	log.Info("Starting server...")
+// metricsAddress is where /metrics is served, apart from the app so it isn't
+// reachable from outside the deployment.
+func metricsAddress() string {
+	if address := os.Getenv("PLUG_METRICS_ADDRESS"); address != "" {
+		return address
+	}
+	return DEFAULT_METRICS_ADDRESS
+}
+
+func shutdownTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	return timeout
+}
+
+func drainDelay() time.Duration {
+	value := os.Getenv("PLUG_DRAIN_DELAY")
+	if value == "" {
+		return DEFAULT_DRAIN_DELAY
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil || delay < 0 {
+		log.Fatal("PLUG_DRAIN_DELAY must be a duration like 5s")
+	}
+	return delay
+}
+
+// serve runs the router until SIGINT or SIGTERM is received. It then reports
+// draining from /readyz for the drain delay before it stops accepting
+// connections, and gives in-flight requests (uploads especially) until the
+// shutdown timeout to finish.
+func (a *PlugApplication) serve() {
+	delay := drainDelay()
+	srv := &http.Server{
+		Addr:    listenAddress(),
+		Handler: a.router,
+	}
+
+	metricsRouter := gin.New()
+	metricsRouter.GET("/metrics", a.metrics.Handler)
+	metricsSrv := &http.Server{
+		Addr:    metricsAddress(),
+		Handler: metricsRouter,
+	}
+
+	for _, s := range []*http.Server{srv, metricsSrv} {
+		go func(s *http.Server) {
+			err := s.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(s)
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
 
+	timeout := shutdownTimeout()
+	log.WithFields(log.Fields{
+		"signal":      sig.String(),
+		"drain_delay": delay.String(),
+		"timeout":     timeout.String(),
+	}).Info("Shutting down server...")
+	a.StartDraining()
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Error(err)
+	}
+	metricsSrv.Close()
+	// The workers notify owners, so they're stopped before the notifier
+	a.objects.Stop()
+	a.expiry.Stop()
+	a.notifier.Stop()
+	a.webhooks.Stop()
+	a.db.Close()
+
+	log.Info("Server stopped")
+}
+
+// registerRoutes sets up every page and endpoint on the router.
+func (a *PlugApplication) registerRoutes() {
 	var r PlugRoutes
-	r.app = &app
+	r.app = a
+
+	a.router.GET(a.auth_login_route, a.auth.AuthRequest)
+	a.router.GET("/auth/redir", a.auth.AuthCallback)
+	a.router.GET("/auth/logout", a.auth.AuthLogout)
+
+	a.router.GET("/healthz", r.healthz)
+	a.router.GET("/readyz", r.readyz)
+
+	a.handle("GET", "/", a.auth.AuthWrapper(r.index))
+	a.handle("GET", "/data", a.auth.AuthWrapper(a.limits.Limit(LIMIT_DATA, r.action)))
+	a.handle("GET", "/data.json", a.auth.AuthWrapper(a.limits.Limit(LIMIT_DATA, r.action_json)))
+	a.handle("GET", "/public/data", r.public_action)
+	a.handle("GET", "/public/data.json", r.public_action_json)
+	if local, ok := a.store.(*LocalStore); ok {
+		a.handle("GET", "/objects/*key", local.object_view)
+	}
+	a.handle("GET", "/upload", a.auth.AuthWrapper(r.upload_view))
+	a.handle("POST", "/upload", a.auth.AuthWrapper(a.limits.Limit(LIMIT_UPLOAD, r.upload)))
+	a.handle("GET", "/quote", a.auth.AuthWrapper(r.quote))
+	a.handle("POST", "/plug/:id/pause", a.auth.AuthWrapper(r.plug_pause))
+	a.handle("POST", "/plug/:id/resume", a.auth.AuthWrapper(r.plug_resume))
+	a.handle("POST", "/plug/:id/withdraw", a.auth.AuthWrapper(r.plug_withdraw))
+	a.handle("POST", "/plug/:id/topup", a.auth.AuthWrapper(r.plug_topup))
+	a.handle("POST", "/plug/:id/sites", a.auth.AuthWrapper(r.plug_sites))
+	a.handle("POST", "/notifications", a.auth.AuthWrapper(r.notification_prefs))
 
-	app.router.GET(app.auth_login_route, app.auth.AuthRequest)
-	app.router.GET("/auth/redir", app.auth.AuthCallback)
-	app.router.GET("/auth/logout", app.auth.AuthLogout)
+	a.handle("GET", "/admin", a.auth.AuthWrapper(r.get_pending_plugs))
+	a.handle("POST", "/admin", a.auth.AuthWrapper(r.plug_moderation))
+	a.handle("POST", "/admin/claim/:id", a.auth.AuthWrapper(r.plug_claim))
+	a.handle("POST", "/admin/release/:id", a.auth.AuthWrapper(r.plug_release))
+	a.handle("POST", "/admin/delete/:id", a.auth.AuthWrapper(r.plug_deletion))
+	a.handle("POST", "/admin/reject/:id", a.auth.AuthWrapper(r.plug_rejection))
+	a.handle("GET", "/admin/logs", a.auth.AuthWrapper(r.audit_log_view))
+	a.handle("GET", "/admin/logs.json", a.auth.AuthWrapper(r.audit_log_json))
+	a.handle("GET", "/admin/logs.csv", a.auth.AuthWrapper(r.audit_log_csv))
+	a.handle("GET", "/admin/house", a.auth.AuthWrapper(r.house_ads_view))
+	a.handle("POST", "/admin/house", a.auth.AuthWrapper(r.house_ad_create))
+	a.handle("POST", "/admin/house/:id/weight", a.auth.AuthWrapper(r.house_ad_weight))
+	a.handle("POST", "/admin/house/:id/toggle", a.auth.AuthWrapper(r.house_ad_toggle))
+	a.handle("POST", "/admin/house/:id/delete", a.auth.AuthWrapper(r.house_ad_deletion))
+	a.handle("POST", "/admin/fill_ratio", a.auth.AuthWrapper(r.fill_ratio_set))
+	a.handle("GET", "/admin/pricing", a.auth.AuthWrapper(r.pricing_view))
+	a.handle("POST", "/admin/pricing", a.auth.AuthWrapper(r.pricing_rule_create))
+	a.handle("POST", "/admin/pricing/:id/delete", a.auth.AuthWrapper(r.pricing_rule_deletion))
+	a.handle("GET", "/admin/sites", a.auth.AuthWrapper(r.sites_view))
+	a.handle("POST", "/admin/sites", a.auth.AuthWrapper(r.site_create))
+	a.handle("POST", "/admin/sites/:id/token", a.auth.AuthWrapper(r.site_token_issue))
+	a.handle("POST", "/admin/sites/:id/delete", a.auth.AuthWrapper(r.site_deletion))
+	a.handle("GET", "/admin/webhooks", a.auth.AuthWrapper(r.webhooks_view))
+	a.handle("POST", "/admin/webhooks", a.auth.AuthWrapper(r.webhook_create))
+	a.handle("POST", "/admin/webhooks/:id/toggle", a.auth.AuthWrapper(r.webhook_toggle))
+	a.handle("POST", "/admin/webhooks/:id/delete", a.auth.AuthWrapper(r.webhook_deletion))
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
 
-	app.router.GET("/", app.auth.AuthWrapper(r.index))
-	app.router.GET("/data", app.auth.AuthWrapper(r.action))
-	app.router.GET("/upload", app.auth.AuthWrapper(r.upload_view))
-	app.router.POST("/upload", app.auth.AuthWrapper(r.upload))
+	cfg := configFromEnv()
+	if flag.NArg() > 0 && flag.Arg(0) != "serve" {
+		os.Exit(runCommand(cfg, flag.Args()))
+	}
 
-	app.router.GET("/admin", app.auth.AuthWrapper(r.get_pending_plugs))
-	app.router.POST("/admin", app.auth.AuthWrapper(r.plug_approval))
-	app.router.POST("/admin/delete/:id", app.auth.AuthWrapper(r.plug_deletion))
+	var app PlugApplication
+	app.Init(cfg)
+	app.InitServer(cfg)
+
+	log.Info("Starting server...")
 
-	app.router.Run()
+	app.notifier.Start()
+	app.webhooks.Start()
+	app.objects.Start()
+	app.expiry.Start()
+	app.serve()
 }
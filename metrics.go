@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are rendered in the Prometheus text exposition format. We only
+// need counters, histograms and a handful of gauges, so rather than pull in
+// client_golang and its dependency tree we keep a small registry here.
+
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Plug impressions are labelled per plug, but only for the first
+// MAX_PLUG_IMPRESSION_SERIES plugs seen by this process; the rest are folded
+// into plug="other" so a busy semester can't blow up the series count.
+const MAX_PLUG_IMPRESSION_SERIES = 100
+
+var DEFAULT_LATENCY_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type Metrics struct {
+	mu sync.Mutex
+
+	requests        counterVec
+	requestDuration histogramVec
+	depDuration     histogramVec
+	depErrors       counterVec
+	impressions     counterVec
+	rateLimited     counterVec
+
+	// Gauges are computed at scrape time
+	gauges []gaugeFunc
+}
+
+type gaugeFunc struct {
+	name    string
+	help    string
+	collect func() map[string]float64
+	label   string
+}
+
+func (m *Metrics) Init() {
+	m.requests = counterVec{
+		name:   "plug_http_requests_total",
+		help:   "HTTP requests handled, by route, method and status code.",
+		labels: []string{"route", "method", "status"},
+		values: make(map[string]float64),
+	}
+	m.requestDuration = histogramVec{
+		name:    "plug_http_request_duration_seconds",
+		help:    "HTTP request latency, by route and method.",
+		labels:  []string{"route", "method"},
+		buckets: DEFAULT_LATENCY_BUCKETS,
+		values:  make(map[string]*histogram),
+	}
+	m.depDuration = histogramVec{
+		name:    "plug_dependency_duration_seconds",
+		help:    "Latency of calls to Postgres, LDAP and S3, by operation.",
+		labels:  []string{"dependency", "operation"},
+		buckets: DEFAULT_LATENCY_BUCKETS,
+		values:  make(map[string]*histogram),
+	}
+	m.depErrors = counterVec{
+		name:   "plug_dependency_errors_total",
+		help:   "Failed calls to Postgres, LDAP and S3, by operation.",
+		labels: []string{"dependency", "operation"},
+		values: make(map[string]float64),
+	}
+	m.impressions = counterVec{
+		name:   "plug_impressions_total",
+		help:   "Plugs served, by plug id.",
+		labels: []string{"plug"},
+		values: make(map[string]float64),
+	}
+	m.rateLimited = counterVec{
+		name:   "plug_rate_limited_total",
+		help:   "Requests refused by a rate limit, by limit and whether the uid or IP was over it.",
+		labels: []string{"limit", "key"},
+		values: make(map[string]float64),
+	}
+}
+
+// RegisterGauge adds a gauge family whose samples are collected on every
+// scrape. collect returns the gauge value keyed by the value of label.
+func (m *Metrics) RegisterGauge(name, help, label string, collect func() map[string]float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges = append(m.gauges, gaugeFunc{name: name, help: help, label: label, collect: collect})
+}
+
+// Instrument returns middleware recording request counts and latency for a
+// route. gin doesn't expose the matched pattern to middleware, so the route
+// is passed in when the handler is registered.
+func (m *Metrics) Instrument(route string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		method := c.Request.Method
+		status := strconv.Itoa(c.Writer.Status())
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.requests.add(1, route, method, status)
+		m.requestDuration.observe(time.Since(start).Seconds(), route, method)
+	}
+}
+
+// ObserveDependency records the latency of a call to an external service
+// started at start, counting it as an error if err is non-nil.
+func (m *Metrics) ObserveDependency(dependency, operation string, start time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.depDuration.observe(time.Since(start).Seconds(), dependency, operation)
+	if err != nil {
+		m.depErrors.add(1, dependency, operation)
+	}
+}
+
+func (m *Metrics) RecordImpression(plug Plug) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	label := strconv.Itoa(plug.ID)
+	if _, ok := m.impressions.values[label]; !ok && len(m.impressions.values) >= MAX_PLUG_IMPRESSION_SERIES {
+		label = "other"
+	}
+	m.impressions.add(1, label)
+}
+
+// RecordRateLimited counts a request refused by the named limit. keyKind is
+// uid or ip, never the key itself, to keep the number of series down.
+func (m *Metrics) RecordRateLimited(limit, keyKind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rateLimited.add(1, limit, keyKind)
+}
+
+func (m *Metrics) Handler(c *gin.Context) {
+	// Gauges may hit the database, so collect them outside the lock.
+	m.mu.Lock()
+	gauges := append([]gaugeFunc(nil), m.gauges...)
+	m.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, g := range gauges {
+		writeHeader(&buf, g.name, g.help, "gauge")
+		values := g.collect()
+		for _, k := range sortedKeys(values) {
+			fmt.Fprintf(&buf, "%s%s %s\n", g.name, formatLabels([]string{g.label}, []string{k}, "", ""), formatFloat(values[k]))
+		}
+	}
+
+	m.mu.Lock()
+	m.requests.write(&buf)
+	m.requestDuration.write(&buf)
+	m.depDuration.write(&buf)
+	m.depErrors.write(&buf)
+	m.impressions.write(&buf)
+	m.rateLimited.write(&buf)
+	m.mu.Unlock()
+
+	c.Data(http.StatusOK, METRICS_CONTENT_TYPE, buf.Bytes())
+}
+
+func (v *counterVec) add(delta float64, labelValues ...string) {
+	v.values[strings.Join(labelValues, "\xff")] += delta
+}
+
+func (v *counterVec) write(buf *bytes.Buffer) {
+	writeHeader(buf, v.name, v.help, "counter")
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", v.name, formatLabels(v.labels, strings.Split(key, "\xff"), "", ""), formatFloat(v.values[key]))
+	}
+}
+
+func (v *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h, ok := v.values[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.values[key] = h
+	}
+	for i, upper := range v.buckets {
+		if value <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (v *histogramVec) write(buf *bytes.Buffer) {
+	writeHeader(buf, v.name, v.help, "histogram")
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := v.values[key]
+		labelValues := strings.Split(key, "\xff")
+		for i, upper := range v.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, labelValues, "le", formatFloat(upper)), h.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, labelValues, "le", "+Inf"), h.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", v.name, formatLabels(v.labels, labelValues, "", ""), formatFloat(h.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", v.name, formatLabels(v.labels, labelValues, "", ""), h.count)
+	}
+}
+
+func writeHeader(buf *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+"=\""+escapeLabelValue(values[i])+"\"")
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+extraValue+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
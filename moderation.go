@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An admin's claim on a plug lapses after this long so a forgotten claim
+// doesn't hold up the queue.
+const CLAIM_TIMEOUT = 30 * time.Minute
+
+// Bulk actions on the admin page
+const (
+	MODERATE_APPROVE   = "approve"
+	MODERATE_UNAPPROVE = "unapprove"
+	MODERATE_REJECT    = "reject"
+	MODERATE_DELETE    = "delete"
+	MODERATE_CLAIM     = "claim"
+	MODERATE_RELEASE   = "release"
+)
+
+// How each action is described once it's done
+var MODERATE_DONE = map[string]string{
+	MODERATE_APPROVE:   "Approved",
+	MODERATE_UNAPPROVE: "Unapproved",
+	MODERATE_REJECT:    "Rejected",
+	MODERATE_DELETE:    "Deleted",
+	MODERATE_CLAIM:     "Claimed",
+	MODERATE_RELEASE:   "Released",
+}
+
+const SQL_CREATE_ADMIN_VISITS_TABLE = `CREATE TABLE admin_visits (
+uid             VARCHAR(32) PRIMARY KEY,
+last_visit      TIMESTAMP NOT NULL
+);`
+
+// Returns the previous visit, or NULL on the first one
+const SQL_RECORD_ADMIN_VISIT = `WITH previous AS (
+SELECT last_visit FROM admin_visits WHERE uid=$1::text
+), upsert AS (
+INSERT INTO admin_visits (uid, last_visit) VALUES ($1::text, $2)
+ON CONFLICT (uid) DO UPDATE SET last_visit = EXCLUDED.last_visit
+)
+SELECT last_visit FROM previous`
+
+// Claims can be taken over once they've lapsed
+const SQL_CLAIM_PLUGS = `UPDATE plugs
+SET claimed_by = $2::text, claimed_at = $3
+WHERE id = ANY($1::integer[]) AND NOT approved AND views>=0 AND archived_at IS NULL
+AND (claimed_by = '' OR claimed_by = $2::text OR claimed_at < $4)
+RETURNING id`
+
+const SQL_RELEASE_PLUGS = `UPDATE plugs
+SET claimed_by = '', claimed_at = NULL
+WHERE id = ANY($1::integer[]) AND claimed_by = $2::text
+RETURNING id`
+
+// ActiveClaim returns the admin currently reviewing the plug, or "" if
+// nobody holds an unexpired claim on it.
+func (p Plug) ActiveClaim() string {
+	if p.ClaimedBy == "" || p.ClaimedAt == nil || time.Since(*p.ClaimedAt) > CLAIM_TIMEOUT {
+		return ""
+	}
+	return p.ClaimedBy
+}
+
+// ClaimedByOther reports whether an admin other than uid is reviewing the
+// plug.
+func (p Plug) ClaimedByOther(uid string) bool {
+	claim := p.ActiveClaim()
+	return claim != "" && claim != uid
+}
+
+// RecordAdminVisit stores the time of uid's visit to the admin page,
+// returning when they last visited. It's the zero time on a first visit.
+func (c DBConnection) RecordAdminVisit(uid string) time.Time {
+	var previous time.Time
+	start := time.Now()
+	rows, err := c.con.Query(SQL_RECORD_ADMIN_VISIT, uid, time.Now())
+	c.app.metrics.ObserveDependency("postgres", "record_admin_visit", start, err)
+	if err != nil {
+		log.Error(err)
+		return previous
+	}
+	defer rows.Close()
+	if rows.Next() {
+		err = rows.Scan(&previous)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	return previous
+}
+
+// ClaimPlugs marks the given pending plugs as being reviewed by uid,
+// returning the ids it was able to claim.
+func (c DBConnection) ClaimPlugs(uid string, ids []int) []int {
+	now := time.Now()
+	return c.updatePlugIds("claim_plugs", SQL_CLAIM_PLUGS, pq.Array(ids), uid, now, now.Add(-CLAIM_TIMEOUT))
+}
+
+// ReleasePlugs drops uid's claims on the given plugs.
+func (c DBConnection) ReleasePlugs(uid string, ids []int) []int {
+	return c.updatePlugIds("release_plugs", SQL_RELEASE_PLUGS, pq.Array(ids), uid)
+}
+
+func (c DBConnection) updatePlugIds(operation, query string, args ...interface{}) []int {
+	start := time.Now()
+	rows, err := c.con.Query(query, args...)
+	c.app.metrics.ObserveDependency("postgres", operation, start, err)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func parsePlugIds(list []string) []int {
+	var ids []int
+	for _, id := range list {
+		parsed, err := strconv.Atoi(id)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		ids = append(ids, parsed)
+	}
+	return ids
+}
+
+// UnapprovePlugs takes live plugs down and puts them back in the queue,
+// where they'll need a fresh set of approvals.
+func (a *PlugApplication) UnapprovePlugs(ids []int, actor string) []Plug {
+	revoked := a.db.RevokePlugApprovals(ids)
+	a.db.ClearPlugApprovals(ids)
+	for _, plug := range revoked {
+		a.db.Audit(actor, AUDIT_PLUG_UNAPPROVED, plug.ID, SEVERITY_INFO, nil)
+	}
+	return revoked
+}
+
+// RejectPlug turns down a plug awaiting review, refunding whoever paid for
+// it and telling its owner why.
+func (a *PlugApplication) RejectPlug(plug Plug, actor, reason string) {
+	archived := reason
+	if archived == "" {
+		archived = ARCHIVE_REASON_REJECTED
+	}
+	plug, ok := a.db.ArchivePlug(plug, actor, archived)
+	if !ok {
+		return
+	}
+	refunded := a.RefundPlug(plug)
+
+	a.db.Audit(actor, AUDIT_PLUG_REJECTED, plug.ID, SEVERITY_INFO, map[string]interface{}{
+		"reason":           reason,
+		"credits_refunded": refunded,
+	})
+	a.webhooks.Emit(EVENT_PLUG_REJECTED, plug, actor, map[string]interface{}{
+		"reason":           reason,
+		"credits_refunded": refunded,
+	})
+	a.notifier.Notify(Notification{
+		Kind:   NOTIFY_REJECTED,
+		Plug:   plug,
+		Reason: reason,
+		Actor:  actor,
+	})
+}
+
+// RemovePlug takes a plug down without a refund.
+func (a *PlugApplication) RemovePlug(plug Plug, actor, reason string) {
+	archived := reason
+	if archived == "" {
+		archived = ARCHIVE_REASON_REMOVED
+	}
+	plug, ok := a.db.ArchivePlug(plug, actor, archived)
+	if !ok {
+		return
+	}
+	a.db.Audit(actor, AUDIT_PLUG_DELETED, plug.ID, SEVERITY_INFO, map[string]interface{}{
+		"reason": reason,
+	})
+	a.webhooks.Emit(EVENT_PLUG_DELETED, plug, actor, map[string]interface{}{
+		"reason": reason,
+	})
+	a.notifier.Notify(Notification{
+		Kind:   NOTIFY_DELETED,
+		Plug:   plug,
+		Reason: reason,
+		Actor:  actor,
+	})
+}
+
+// moderationItem is a plug as shown on the admin page
+type moderationItem struct {
+	Plug
+	New       bool
+	Approvers []string
+}
+
+func (r PlugRoutes) get_pending_plugs(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+	uid := claims.UserInfo.Username
+	lastVisit := r.app.db.RecordAdminVisit(uid)
+
+	pending := r.app.db.GetPendingPlugs()
+	var ids []int
+	for _, plug := range pending {
+		ids = append(ids, plug.ID)
+	}
+	approvers := r.app.db.GetPlugApprovers(ids)
+	r.app.db.AttachPlugSites(pending)
+
+	var queue []moderationItem
+	newCount := 0
+	for _, plug := range pending {
+		plug.PresignedURL = r.app.store.PresignPlug(plug).String()
+		item := moderationItem{
+			Plug:      plug,
+			New:       plug.Created.After(lastVisit),
+			Approvers: approvers[plug.ID],
+		}
+		if item.New {
+			newCount++
+		}
+		queue = append(queue, item)
+	}
+
+	var live []moderationItem
+	livePlugs := r.app.db.GetLivePlugs()
+	r.app.db.AttachPlugSites(livePlugs)
+	for _, plug := range livePlugs {
+		plug.PresignedURL = r.app.store.PresignPlug(plug).String()
+		live = append(live, moderationItem{Plug: plug})
+	}
+
+	r.page(c, "view_plugs.tmpl", gin.H{
+		"uid":       uid,
+		"queue":     queue,
+		"live":      live,
+		"new_count": newCount,
+		"required":  r.app.required_approvals,
+	})
+}
+
+// plug_moderation applies one action to every selected plug. Plugs another
+// admin has claimed are skipped.
+func (r PlugRoutes) plug_moderation(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+	uid := claims.UserInfo.Username
+
+	var plugList PlugList
+	c.Bind(&plugList)
+	ids := parsePlugIds(plugList.Data)
+	selected := len(ids)
+	action := c.PostForm("action")
+	reason := strings.TrimSpace(c.PostForm("reason"))
+
+	if action == MODERATE_REJECT && reason == "" {
+		flash(c, FLASH_ERROR, "Please give a reason for rejecting the plugs.")
+		c.Redirect(http.StatusFound, "/admin")
+		return
+	}
+
+	switch action {
+	case MODERATE_CLAIM:
+		claimed := r.app.db.ClaimPlugs(uid, ids)
+		for _, id := range claimed {
+			r.app.db.Audit(uid, AUDIT_PLUG_CLAIMED, id, SEVERITY_DEBUG, nil)
+		}
+		ids = claimed
+	case MODERATE_RELEASE:
+		ids = r.app.db.ReleasePlugs(uid, ids)
+	case MODERATE_UNAPPROVE:
+		revoked := r.app.UnapprovePlugs(ids, uid)
+		ids = ids[:0]
+		for _, plug := range revoked {
+			ids = append(ids, plug.ID)
+		}
+	case MODERATE_APPROVE, MODERATE_REJECT, MODERATE_DELETE:
+		ids = r.moderatePlugs(uid, action, reason, ids)
+	default:
+		c.String(http.StatusBadRequest, "Unknown action!")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"uid":    uid,
+		"action": action,
+		"plugs":  ids,
+	}).Info("Moderated plugs")
+	kind := FLASH_SUCCESS
+	if len(ids) < selected {
+		kind = FLASH_INFO
+	}
+	flash(c, kind, fmt.Sprintf("%s %d of %d selected plug(s).", MODERATE_DONE[action], len(ids), selected))
+	c.Redirect(http.StatusFound, "/admin")
+}
+
+// moderatePlugs approves, rejects or deletes the given plugs, returning the
+// ids it acted on.
+func (r PlugRoutes) moderatePlugs(uid, action, reason string, ids []int) []int {
+	var plugs []Plug
+	for _, id := range ids {
+		plug, ok := r.app.db.GetPlugById(id)
+		if !ok || plug.IsDefault() {
+			continue
+		}
+		if plug.ClaimedByOther(uid) {
+			log.WithFields(log.Fields{
+				"uid":        uid,
+				"plug_id":    plug.ID,
+				"claimed_by": plug.ClaimedBy,
+			}).Warn("Skipping plug claimed by another admin")
+			continue
+		}
+		plugs = append(plugs, plug)
+	}
+
+	var done []int
+	switch action {
+	case MODERATE_APPROVE:
+		for _, plug := range r.app.ApprovePlugs(plugs, uid) {
+			done = append(done, plug.ID)
+		}
+	case MODERATE_REJECT:
+		for _, plug := range plugs {
+			if plug.Approved {
+				continue
+			}
+			r.app.RejectPlug(plug, uid, reason)
+			done = append(done, plug.ID)
+		}
+	case MODERATE_DELETE:
+		for _, plug := range plugs {
+			r.app.RemovePlug(plug, uid, reason)
+			done = append(done, plug.ID)
+		}
+	}
+	return done
+}
+
+func (r PlugRoutes) plug_claim(c *gin.Context) {
+	r.setClaim(c, true)
+}
+
+func (r PlugRoutes) plug_release(c *gin.Context) {
+	r.setClaim(c, false)
+}
+
+func (r PlugRoutes) setClaim(c *gin.Context, claim bool) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+	uid := claims.UserInfo.Username
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid plug id!")
+		return
+	}
+
+	if !claim {
+		r.app.db.ReleasePlugs(uid, []int{id})
+		c.Redirect(http.StatusFound, "/admin")
+		return
+	}
+
+	if len(r.app.db.ClaimPlugs(uid, []int{id})) == 0 {
+		flash(c, FLASH_ERROR, "Someone else is already reviewing that plug.")
+		c.Redirect(http.StatusFound, "/admin")
+		return
+	}
+	r.app.db.Audit(uid, AUDIT_PLUG_CLAIMED, id, SEVERITY_DEBUG, nil)
+	c.Redirect(http.StatusFound, "/admin")
+}
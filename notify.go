@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	csh_auth "github.com/liam-middlebrook/csh-auth"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Email templates live in templates/email/<kind>.tmpl. The first line of the
+// rendered template is the subject, everything after it is the body.
+const (
+	NOTIFY_APPROVED  = "approved"
+	NOTIFY_REJECTED  = "rejected"
+	NOTIFY_DELETED   = "deleted"
+	NOTIFY_LOW_VIEWS = "low_views"
+	NOTIFY_EXHAUSTED = "exhausted"
+)
+
+const DEFAULT_LOW_VIEWS_THRESHOLD = 50
+
+// Notifications are sent from a background worker so serving a plug never
+// waits on SMTP. If the queue backs up this far we drop new ones instead.
+const NOTIFY_QUEUE_SIZE = 256
+
+const SQL_CREATE_NOTIFICATION_PREFS_TABLE = `CREATE TABLE notification_prefs (
+uid             VARCHAR(32) PRIMARY KEY,
+email_opt_out   BOOLEAN NOT NULL
+);`
+
+const SQL_RETRIEVE_EMAIL_OPT_OUT = `SELECT email_opt_out FROM notification_prefs WHERE uid=$1::text`
+
+const SQL_SET_EMAIL_OPT_OUT = `INSERT INTO notification_prefs (uid, email_opt_out)
+VALUES ($1::text, $2::boolean)
+ON CONFLICT (uid) DO UPDATE SET email_opt_out = EXCLUDED.email_opt_out`
+
+type Notification struct {
+	Kind   string
+	UID    string
+	Plug   Plug
+	Reason string
+	Actor  string
+}
+
+type Notifier struct {
+	app       *PlugApplication
+	smtp_host string
+	from      string
+	username  string
+	password  string
+
+	public_url          string
+	low_views_threshold int
+
+	templates *template.Template
+	queue     chan Notification
+	wg        sync.WaitGroup
+
+	// Set by Stop, after which notifications are dropped rather than sent
+	// on the closed queue
+	mu      sync.Mutex
+	stopped bool
+}
+
+func (n *Notifier) Init(
+	app *PlugApplication,
+	smtp_host,
+	from,
+	username,
+	password,
+	public_url,
+	low_views_threshold string) {
+
+	n.app = app
+	n.smtp_host = smtp_host
+	n.from = from
+	n.username = username
+	n.password = password
+	n.public_url = strings.TrimRight(public_url, "/")
+
+	n.low_views_threshold = DEFAULT_LOW_VIEWS_THRESHOLD
+	if low_views_threshold != "" {
+		threshold, err := strconv.Atoi(low_views_threshold)
+		if err != nil {
+			log.Fatal(err)
+		}
+		n.low_views_threshold = threshold
+	}
+
+	n.templates = template.Must(template.ParseGlob(app.base_path + "templates/email/*.tmpl"))
+	n.queue = make(chan Notification, NOTIFY_QUEUE_SIZE)
+
+	if n.smtp_host == "" {
+		log.Warn("SMTP_HOST is not set, email notifications are disabled")
+	}
+}
+
+// Start runs the delivery worker until Stop is called.
+func (n *Notifier) Start() {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for notification := range n.queue {
+			n.deliver(notification)
+		}
+	}()
+}
+
+// Stop waits for queued notifications to be sent.
+func (n *Notifier) Stop() {
+	n.mu.Lock()
+	if !n.stopped {
+		n.stopped = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+func (n *Notifier) Notify(notification Notification) {
+	if notification.UID == "" {
+		notification.UID = notification.Plug.Owner
+	}
+	fields := log.Fields{
+		"kind":    notification.Kind,
+		"uid":     notification.UID,
+		"plug_id": notification.Plug.ID,
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		log.WithFields(fields).Error("Notifier stopped, dropping notification")
+		return
+	}
+	select {
+	case n.queue <- notification:
+	default:
+		log.WithFields(fields).Error("Notification queue full, dropping notification")
+	}
+}
+
+// ViewsChanged lets the plug's owner know when it's running low on views.
+// The expiry worker lets them know when it has run out.
+func (n *Notifier) ViewsChanged(plug Plug) {
+	if plug.IsDefault() {
+		return
+	}
+
+	if plug.ViewsRemaining == n.low_views_threshold {
+		n.Notify(Notification{Kind: NOTIFY_LOW_VIEWS, Plug: plug})
+	}
+}
+
+func (n *Notifier) deliver(notification Notification) {
+	fields := log.Fields{
+		"kind":    notification.Kind,
+		"uid":     notification.UID,
+		"plug_id": notification.Plug.ID,
+	}
+
+	if n.smtp_host == "" {
+		log.WithFields(fields).Debug("Skipping notification, SMTP is not configured")
+		return
+	}
+	if n.app.db.GetEmailOptOut(notification.UID) {
+		log.WithFields(fields).Debug("Skipping notification, member opted out")
+		return
+	}
+
+	var buf bytes.Buffer
+	err := n.templates.ExecuteTemplate(&buf, notification.Kind+".tmpl", gin.H{
+		"uid":        notification.UID,
+		"plug":       notification.Plug,
+		"reason":     notification.Reason,
+		"actor":      notification.Actor,
+		"threshold":  n.low_views_threshold,
+		"public_url": n.public_url,
+	})
+	if err != nil {
+		log.WithFields(fields).Error(err)
+		return
+	}
+
+	rendered := buf.String()
+	subject := rendered
+	body := ""
+	if i := strings.Index(rendered, "\n"); i >= 0 {
+		subject = rendered[:i]
+		body = strings.TrimLeft(rendered[i+1:], "\n")
+	}
+
+	to := n.app.ldap.GetEmail(notification.UID)
+	err = n.send(to, strings.TrimSpace(subject), body)
+	if err != nil {
+		log.WithFields(fields).Error(err)
+		return
+	}
+	log.WithFields(fields).Info("Sent notification")
+}
+
+func (n *Notifier) send(to, subject, body string) error {
+	var msg bytes.Buffer
+	msg.WriteString("From: " + n.from + "\r\n")
+	msg.WriteString("To: " + to + "\r\n")
+	msg.WriteString("Subject: " + subject + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	var auth smtp.Auth
+	if n.username != "" {
+		host := n.smtp_host
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+
+	start := time.Now()
+	err := smtp.SendMail(n.smtp_host, auth, n.from, []string{to}, msg.Bytes())
+	n.app.metrics.ObserveDependency("smtp", "send", start, err)
+	return err
+}
+
+func (c DBConnection) GetEmailOptOut(uid string) bool {
+	var optOut bool
+	start := time.Now()
+	rows, err := c.con.Query(SQL_RETRIEVE_EMAIL_OPT_OUT, uid)
+	c.app.metrics.ObserveDependency("postgres", "get_email_opt_out", start, err)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	defer rows.Close()
+	if rows.Next() {
+		err = rows.Scan(&optOut)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	return optOut
+}
+
+func (c DBConnection) SetEmailOptOut(uid string, optOut bool) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_SET_EMAIL_OPT_OUT, uid, optOut)
+	c.app.metrics.ObserveDependency("postgres", "set_email_opt_out", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (r PlugRoutes) notification_prefs(c *gin.Context) {
+	claims, ok := c.Value(csh_auth.AuthKey).(csh_auth.CSHClaims)
+	if !ok {
+		log.Fatal("error finding claims")
+		return
+	}
+
+	optOut := c.PostForm("emailOptOut") == "on"
+	r.app.db.SetEmailOptOut(claims.UserInfo.Username, optOut)
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_NOTIFICATIONS_SET, 0, SEVERITY_INFO, map[string]interface{}{
+		"email_opt_out": optOut,
+	})
+	flash(c, FLASH_SUCCESS, "Notification preferences saved.")
+	c.Redirect(http.StatusFound, "/upload")
+}
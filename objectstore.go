@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Plug images live in an ObjectStore, chosen with PLUG_OBJECT_STORE. The s3
+// store needs an S3 compatible server with a plugs bucket. The local store
+// keeps images under PLUG_OBJECT_DIR instead, for development and small
+// deployments, and serves them itself through signed /objects URLs which
+// expire like S3's presigned ones.
+
+const (
+	OBJECT_STORE_S3    = "s3"
+	OBJECT_STORE_LOCAL = "local"
+)
+
+const DEFAULT_OBJECT_DIR = "objects"
+
+// How long a link to a plug's image works
+const OBJECT_URL_EXPIRY = 60 * time.Second
+
+// The local store keeps each object's content type in a file alongside it,
+// and writes objects to a temporary file before renaming them into place.
+// Object file names are base64, which never contains a dot, so neither can
+// be mistaken for an object.
+const (
+	OBJECT_META_SUFFIX = ".meta"
+	OBJECT_TEMP_PREFIX = ".tmp-"
+)
+
+// ObjectStore keeps plug images, keyed by their plug's S3ID.
+type ObjectStore interface {
+	// Name labels the store in metrics and readiness checks
+	Name() string
+	CheckAlive() error
+	// PresignPlug links to a plug's image for a short while
+	PresignPlug(plug Plug) *url.URL
+	AddFile(plug Plug, data io.Reader, mime string)
+	DelFile(plug Plug) error
+	StatObject(s3id string) (ObjectInfo, error)
+	// GetObject opens an object, which the caller must close
+	GetObject(s3id string) (io.ReadCloser, error)
+	// PutObject stores size bytes from data
+	PutObject(s3id string, data io.Reader, size int64, mime string) error
+	IsEmpty() (bool, error)
+	ListObjects() ([]ObjectInfo, error)
+	SetContentType(s3id, mime string) error
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// LocalStore keeps objects on disk, spread over two levels of directories
+// named from a hash of their key so no directory gets too big.
+type LocalStore struct {
+	app *PlugApplication
+	dir string
+	// Key object URLs are signed with
+	signing_key []byte
+	// Where object URLs point, relative to the page when there's no
+	// PLUG_PUBLIC_URL
+	base *url.URL
+}
+
+type localObjectMeta struct {
+	ContentType string `json:"content_type"`
+}
+
+func (s *LocalStore) Init(app *PlugApplication, dir, signing_key, public_url string) {
+	s.app = app
+	s.dir = dir
+	if s.dir == "" {
+		s.dir = DEFAULT_OBJECT_DIR
+	}
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s.signing_key = []byte(signing_key)
+	if len(s.signing_key) == 0 {
+		log.Warn("PLUG_SIGNING_KEY isn't set, object URLs will only work on this replica until it restarts")
+		s.signing_key = make([]byte, 32)
+		_, err = rand.Read(s.signing_key)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	s.base, err = url.Parse(strings.TrimSuffix(public_url, "/"))
+	if err != nil {
+		log.Fatal("PLUG_PUBLIC_URL must be a URL: ", err)
+	}
+}
+
+func (s *LocalStore) Name() string {
+	return OBJECT_STORE_LOCAL
+}
+
+func (s *LocalStore) CheckAlive() error {
+	start := time.Now()
+	info, err := os.Stat(s.dir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s isn't a directory", s.dir)
+	}
+	s.app.metrics.ObserveDependency(OBJECT_STORE_LOCAL, "ping", start, err)
+	return err
+}
+
+var errEmptyObjectKey = errors.New("objects need a key")
+
+// path is where the object stored under key lives. Keys are base64 encoded,
+// so whatever they contain the path stays in its shard directory.
+func (s *LocalStore) path(key string) (string, error) {
+	if key == "" {
+		return "", errEmptyObjectKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	shard := hex.EncodeToString(sum[:2])
+	return filepath.Join(s.dir, shard[:2], shard[2:], base64.RawURLEncoding.EncodeToString([]byte(key))), nil
+}
+
+func (s *LocalStore) sign(key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.signing_key)
+	// Prefixed so these can't be passed off as placement signatures, which
+	// may share the key
+	fmt.Fprintf(mac, "object\n%s\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *LocalStore) PresignPlug(plug Plug) *url.URL {
+	expires := time.Now().Add(OBJECT_URL_EXPIRY).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", s.sign(plug.S3ID, expires))
+
+	signed := *s.base
+	signed.Path = s.base.Path + "/objects/" + plug.S3ID
+	signed.RawQuery = query.Encode()
+	return &signed
+}
+
+func (s *LocalStore) AddFile(plug Plug, data io.Reader, mime string) {
+	err := s.PutObject(plug.S3ID, data, -1, mime)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (s *LocalStore) DelFile(plug Plug) error {
+	start := time.Now()
+	path, err := s.path(plug.S3ID)
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil {
+		err = os.Remove(path + OBJECT_META_SUFFIX)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	s.app.metrics.ObserveDependency(OBJECT_STORE_LOCAL, "remove_object", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func (s *LocalStore) StatObject(s3id string) (ObjectInfo, error) {
+	start := time.Now()
+	path, err := s.path(s3id)
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(path)
+	}
+	s.app.metrics.ObserveDependency(OBJECT_STORE_LOCAL, "stat_object", start, err)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          s3id,
+		Size:         info.Size(),
+		ContentType:  contentType(path),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// contentType reads the type the object at path was stored with.
+func contentType(path string) string {
+	var meta localObjectMeta
+	raw, err := ioutil.ReadFile(path + OBJECT_META_SUFFIX)
+	if err == nil {
+		err = json.Unmarshal(raw, &meta)
+	}
+	if err != nil || meta.ContentType == "" {
+		return "application/octet-stream"
+	}
+	return meta.ContentType
+}
+
+func (s *LocalStore) GetObject(s3id string) (io.ReadCloser, error) {
+	start := time.Now()
+	path, err := s.path(s3id)
+	var file *os.File
+	if err == nil {
+		file, err = os.Open(path)
+	}
+	s.app.metrics.ObserveDependency(OBJECT_STORE_LOCAL, "get_object", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// PutObject writes the object's type then the object, each to a temporary
+// file renamed into place, so readers never see half an object or one
+// without its type. size may be -1 if it isn't known.
+func (s *LocalStore) PutObject(s3id string, data io.Reader, size int64, mime string) error {
+	start := time.Now()
+	path, err := s.path(s3id)
+	if err == nil {
+		err = s.writeMeta(path, mime)
+	}
+	if err == nil {
+		err = writeFileAtomic(path, data, size)
+		// Don't leave a type behind for an object that was never written
+		if _, statErr := os.Stat(path); err != nil && os.IsNotExist(statErr) {
+			os.Remove(path + OBJECT_META_SUFFIX)
+		}
+	}
+	s.app.metrics.ObserveDependency(OBJECT_STORE_LOCAL, "put_object", start, err)
+	return err
+}
+
+func (s *LocalStore) writeMeta(path, mime string) error {
+	raw, err := json.Marshal(localObjectMeta{ContentType: mime})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path+OBJECT_META_SUFFIX, strings.NewReader(string(raw)), int64(len(raw)))
+}
+
+func writeFileAtomic(path string, data io.Reader, size int64) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, OBJECT_TEMP_PREFIX)
+	if err != nil {
+		return err
+	}
+
+	written, err := io.Copy(tmp, data)
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("wrote %d bytes of %d", written, size)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// errFoundObject stops a walk once an object has been found
+var errFoundObject = errors.New("found an object")
+
+func (s *LocalStore) IsEmpty() (bool, error) {
+	start := time.Now()
+	err := s.walk(func(ObjectInfo) error {
+		return errFoundObject
+	})
+	if err == errFoundObject {
+		s.app.metrics.ObserveDependency(OBJECT_STORE_LOCAL, "list_objects", start, nil)
+		return false, nil
+	}
+	s.app.metrics.ObserveDependency(OBJECT_STORE_LOCAL, "list_objects", start, err)
+	return err == nil, err
+}
+
+// ListObjects lists every object. Like S3 listings, they don't include
+// content types, see StatObject.
+func (s *LocalStore) ListObjects() ([]ObjectInfo, error) {
+	start := time.Now()
+	var objects []ObjectInfo
+	err := s.walk(func(obj ObjectInfo) error {
+		objects = append(objects, obj)
+		return nil
+	})
+	s.app.metrics.ObserveDependency(OBJECT_STORE_LOCAL, "list_objects", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// walk calls fn with each object under the store's directory, skipping
+// type and temporary files.
+func (s *LocalStore) walk(fn func(ObjectInfo) error) error {
+	return filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.Contains(info.Name(), ".") {
+			return nil
+		}
+		key, err := base64.RawURLEncoding.DecodeString(info.Name())
+		if err != nil {
+			log.WithField("path", path).Warn("Skipping file that isn't an object")
+			return nil
+		}
+		return fn(ObjectInfo{
+			Key:          string(key),
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	})
+}
+
+func (s *LocalStore) SetContentType(s3id, mime string) error {
+	start := time.Now()
+	path, err := s.path(s3id)
+	if err == nil {
+		_, err = os.Stat(path)
+	}
+	if err == nil {
+		err = s.writeMeta(path, mime)
+	}
+	s.app.metrics.ObserveDependency(OBJECT_STORE_LOCAL, "set_content_type", start, err)
+	return err
+}
+
+// object_view serves an object to anyone holding an unexpired signed URL
+// from PresignPlug.
+func (s *LocalStore) object_view(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(s.sign(key, expires)), []byte(c.Query("sig"))) {
+		c.String(http.StatusForbidden, "This link has expired or isn't valid!")
+		return
+	}
+
+	path, err := s.path(key)
+	var file *os.File
+	if err == nil {
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		c.String(http.StatusNotFound, "No such object!")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		log.Error(err)
+		c.String(http.StatusInternalServerError, "Couldn't read that object!")
+		return
+	}
+
+	c.Header("Content-Type", contentType(path))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "private, max-age="+strconv.Itoa(int(OBJECT_URL_EXPIRY.Seconds())))
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime(), file)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocalStore(t *testing.T) *LocalStore {
+	dir, err := ioutil.TempDir("", "plug-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	app := &PlugApplication{}
+	app.metrics.Init()
+	s := &LocalStore{}
+	s.Init(app, dir, "test-key", "")
+	return s
+}
+
+func TestLocalStorePathStaysInStore(t *testing.T) {
+	s := newTestLocalStore(t)
+	root, err := filepath.Abs(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.path(""); err == nil {
+		t.Error("path(\"\") succeeded, want an error rather than the shard directory")
+	}
+	if err := s.PutObject("", strings.NewReader("image"), 5, "image/png"); err == nil {
+		t.Error("PutObject() stored an object without a key")
+	}
+
+	for _, key := range []string{
+		"0b7e5c1a-plug",
+		".",
+		"..",
+		"../../etc/passwd",
+		"/etc/passwd",
+		"a/../../b",
+		`..\..\windows`,
+		"key\x00with-nul",
+	} {
+		path, err := s.path(key)
+		if err == nil {
+			path, err = filepath.Abs(path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			t.Errorf("path(%q) = %s, outside %s", key, path, root)
+		}
+		if depth := len(strings.Split(rel, string(filepath.Separator))); depth != 3 {
+			t.Errorf("path(%q) = %s, want two shard directories and a file", key, rel)
+		}
+		if name := filepath.Base(path); strings.Contains(name, ".") {
+			t.Errorf("path(%q) has file name %q, which could be taken for a type or temporary file", key, name)
+		}
+	}
+
+	a, _ := s.path("a")
+	b, _ := s.path("b")
+	if a == b {
+		t.Error("different keys share a path")
+	}
+}
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	s := newTestLocalStore(t)
+
+	empty, err := s.IsEmpty()
+	if err != nil || !empty {
+		t.Fatalf("IsEmpty() = %v, %v on a new store", empty, err)
+	}
+
+	if err := s.PutObject("plug-1", strings.NewReader("image"), 5, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutObject("plug-2", strings.NewReader("image"), 4, "image/png"); err == nil {
+		t.Error("PutObject() accepted the wrong size")
+	}
+	if _, err := s.StatObject("plug-2"); err == nil {
+		t.Error("a failed write left an object behind")
+	}
+
+	info, err := s.StatObject("plug-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "plug-1" || info.Size != 5 || info.ContentType != "image/png" {
+		t.Errorf("StatObject() = %+v", info)
+	}
+
+	if err := s.SetContentType("plug-1", "image/gif"); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := s.StatObject("plug-1"); info.ContentType != "image/gif" {
+		t.Errorf("content type = %q after SetContentType, want image/gif", info.ContentType)
+	}
+	if err := s.SetContentType("missing", "image/gif"); err == nil {
+		t.Error("SetContentType() succeeded for a missing object")
+	}
+
+	obj, err := s.GetObject("plug-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(obj)
+	obj.Close()
+	if string(data) != "image" {
+		t.Errorf("GetObject() read %q", data)
+	}
+
+	// Stray files in the directory aren't objects
+	ioutil.WriteFile(filepath.Join(s.dir, "README.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(s.dir, "not base64!"), []byte("hello"), 0644)
+
+	objects, err := s.ListObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "plug-1" || objects[0].Size != 5 {
+		t.Errorf("ListObjects() = %+v, want just plug-1", objects)
+	}
+
+	if err := s.DelFile(Plug{S3ID: "plug-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DelFile(Plug{S3ID: "plug-1"}); err != nil {
+		t.Errorf("deleting a deleted object failed: %v", err)
+	}
+	if empty, err := s.IsEmpty(); err != nil || !empty {
+		t.Errorf("IsEmpty() = %v, %v after deleting everything", empty, err)
+	}
+
+	// Nothing should be left over from writes
+	filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(info.Name(), OBJECT_TEMP_PREFIX) {
+			t.Errorf("temporary file %s left behind", path)
+		}
+		if err == nil && strings.HasSuffix(info.Name(), OBJECT_META_SUFFIX) {
+			t.Errorf("type file %s left behind", path)
+		}
+		return nil
+	})
+}
+
+func TestLocalStoreSignedURLs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := newTestLocalStore(t)
+	if err := s.PutObject("plug-1", strings.NewReader("image"), 5, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/objects/*key", s.object_view)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	signed := s.PresignPlug(Plug{S3ID: "plug-1"})
+	if !strings.HasPrefix(signed.String(), "/objects/plug-1?") {
+		t.Errorf("PresignPlug() = %s", signed)
+	}
+	w := get(signed.String())
+	if w.Code != http.StatusOK || w.Body.String() != "image" {
+		t.Fatalf("signed URL gave %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "image/png" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("headers = %v", w.Header())
+	}
+
+	query := signed.Query()
+	expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+	past := time.Now().Add(-time.Minute).Unix()
+	other := &LocalStore{app: s.app, dir: s.dir, signing_key: []byte("other-key"), base: s.base}
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"no signature", "/objects/plug-1", http.StatusForbidden},
+		{"tampered signature", "/objects/plug-1?expires=" + query.Get("expires") + "&sig=0" + query.Get("sig")[1:], http.StatusForbidden},
+		{"signature for another key", "/objects/plug-2?" + signed.RawQuery, http.StatusForbidden},
+		{"extended expiry", "/objects/plug-1?expires=" + strconv.FormatInt(expires+3600, 10) + "&sig=" + query.Get("sig"), http.StatusForbidden},
+		{"expired", "/objects/plug-1?expires=" + strconv.FormatInt(past, 10) + "&sig=" + s.sign("plug-1", past), http.StatusForbidden},
+		{"signed with another key", other.PresignPlug(Plug{S3ID: "plug-1"}).String(), http.StatusForbidden},
+		{"missing object", s.PresignPlug(Plug{S3ID: "plug-2"}).String(), http.StatusNotFound},
+		{"escaping key", s.PresignPlug(Plug{S3ID: "../../etc/passwd"}).String(), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := get(tt.target); w.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.target, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalStorePublicURL(t *testing.T) {
+	s := newTestLocalStore(t)
+	s.Init(s.app, s.dir, "test-key", "https://plug.example.com/")
+	signed := s.PresignPlug(Plug{S3ID: "plug-1"})
+	if signed.Scheme != "https" || signed.Host != "plug.example.com" || signed.Path != "/objects/plug-1" {
+		t.Errorf("PresignPlug() = %s", signed)
+	}
+}
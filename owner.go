@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	csh_auth "github.com/liam-middlebrook/csh-auth"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+// Most archived plugs shown in a member's past plugs
+const PAST_PLUGS_LIMIT = 50
+
+// ManageableGroups filters a member's groups down to those configured as
+// plug owner groups, which are the ones they may hand plugs to.
+func (a *PlugApplication) ManageableGroups(memberOf []string) []string {
+	var groups []string
+	for _, group := range memberOf {
+		for _, allowed := range a.owner_groups {
+			if group == allowed {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// CanManagePlug reports whether uid owns plug, either directly or through
+// membership of the group it belongs to.
+func (a *PlugApplication) CanManagePlug(uid string, plug Plug) bool {
+	if plug.Owner == uid {
+		return true
+	}
+	return plug.Group != "" && a.ldap.CheckIfGroupMember(uid, plug.Group)
+}
+
+// ownedPlug loads the plug named in the route and checks the caller may
+// manage it, writing an error response and returning false otherwise.
+func (r PlugRoutes) ownedPlug(c *gin.Context) (csh_auth.CSHClaims, Plug, bool) {
+	claims, ok := c.Value(csh_auth.AuthKey).(csh_auth.CSHClaims)
+	if !ok {
+		log.Fatal("error finding claims")
+		return claims, Plug{}, false
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid plug id!")
+		return claims, Plug{}, false
+	}
+
+	plug, ok := r.app.db.GetPlugById(id)
+	if !ok || plug.IsDefault() {
+		c.String(http.StatusNotFound, "No such plug!")
+		return claims, Plug{}, false
+	}
+
+	if !r.app.CanManagePlug(claims.UserInfo.Username, plug) {
+		log.WithFields(log.Fields{
+			"uid":     claims.UserInfo.Username,
+			"plug_id": plug.ID,
+		}).Warn("Refused owner action on a plug they don't manage")
+		c.String(http.StatusForbidden, "That's not your plug!")
+		return claims, Plug{}, false
+	}
+
+	return claims, plug, true
+}
+
+func (r PlugRoutes) plug_pause(c *gin.Context) {
+	claims, plug, ok := r.ownedPlug(c)
+	if !ok {
+		return
+	}
+
+	r.app.db.SetPlugPaused(plug, true)
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_PLUG_PAUSED, plug.ID, SEVERITY_INFO, nil)
+	flash(c, FLASH_SUCCESS, "Plug paused, it won't be shown until you resume it.")
+	c.Redirect(http.StatusFound, "/upload")
+}
+
+func (r PlugRoutes) plug_resume(c *gin.Context) {
+	claims, plug, ok := r.ownedPlug(c)
+	if !ok {
+		return
+	}
+
+	r.app.db.SetPlugPaused(plug, false)
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_PLUG_RESUMED, plug.ID, SEVERITY_INFO, nil)
+	flash(c, FLASH_SUCCESS, "Plug resumed.")
+	c.Redirect(http.StatusFound, "/upload")
+}
+
+// plug_withdraw takes a plug down for good, archiving it and giving back
+// the credits for whatever views it had left.
+func (r PlugRoutes) plug_withdraw(c *gin.Context) {
+	claims, plug, ok := r.ownedPlug(c)
+	if !ok {
+		return
+	}
+
+	// The refund is worked out from the row the archive changed, so a second
+	// withdrawal or views served meanwhile can't be refunded
+	plug, ok = r.app.db.ArchivePlug(plug, claims.UserInfo.Username, ARCHIVE_REASON_WITHDRAWN)
+	if !ok {
+		flash(c, FLASH_INFO, "That plug had already been taken down.")
+		c.Redirect(http.StatusFound, "/upload")
+		return
+	}
+	refunded := r.app.RefundPlug(plug)
+
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_PLUG_WITHDRAWN, plug.ID, SEVERITY_INFO, map[string]interface{}{
+		"s3id":             plug.S3ID,
+		"views_remaining":  plug.ViewsRemaining,
+		"credits_refunded": refunded,
+	})
+	r.app.webhooks.Emit(EVENT_PLUG_DELETED, plug, claims.UserInfo.Username, map[string]interface{}{
+		"withdrawn":        true,
+		"credits_refunded": refunded,
+	})
+	log.WithFields(log.Fields{
+		"uid":              claims.UserInfo.Username,
+		"plug_id":          plug.ID,
+		"credits_refunded": refunded,
+	}).Info("Plug withdrawn by owner")
+	flash(c, FLASH_SUCCESS, fmt.Sprintf("Plug withdrawn, %d credit(s) refunded.", refunded))
+	c.Redirect(http.StatusFound, "/upload")
+}
+
+// plug_topup buys more views for an existing plug at the member's current
+// price for the plug's sites. The plug keeps its approval, so there's no
+// second trip through the admin queue.
+func (r PlugRoutes) plug_topup(c *gin.Context) {
+	claims, plug, ok := r.ownedPlug(c)
+	if !ok {
+		return
+	}
+
+	numCredits, err := strconv.Atoi(c.PostForm("numCredits"))
+	if err != nil || numCredits <= 0 {
+		c.String(http.StatusBadRequest, "Specify a positive numCredits")
+		return
+	}
+
+	uid := claims.UserInfo.Username
+	plugs := []Plug{plug}
+	r.app.db.AttachPlugSites(plugs)
+	quote := r.app.Quote(uid, plugs[0].SiteIDs(), numCredits)
+	if !checkQuote(c, quote) {
+		return
+	}
+
+	if !r.app.ldap.DecrementCredits(uid, numCredits) {
+		flash(c, FLASH_ERROR, "You don't have enough drink credits for that.")
+		c.Redirect(http.StatusFound, "/upload")
+		return
+	}
+
+	views := quote.Views
+	remaining, ok := r.app.db.AddPlugViews(plug, views, numCredits)
+	if !ok {
+		// The plug ran out and was removed while we were charging for it
+		r.app.ldap.IncrementCredits(uid, numCredits)
+		flash(c, FLASH_ERROR, "That plug is no longer running, your credits have been returned.")
+		c.Redirect(http.StatusFound, "/upload")
+		return
+	}
+	r.app.RecordPurchase(uid, plug, numCredits, views)
+
+	r.app.db.Audit(uid, AUDIT_PLUG_TOPPED_UP, plug.ID, SEVERITY_INFO, map[string]interface{}{
+		"credits":         numCredits,
+		"views":           views,
+		"views_remaining": remaining,
+	})
+	log.WithFields(log.Fields{
+		"uid":     uid,
+		"plug_id": plug.ID,
+		"credits": numCredits,
+		"views":   views,
+	}).Info("Plug topped up")
+	flash(c, FLASH_SUCCESS, fmt.Sprintf("Bought %d more view(s) for %d credit(s).", views, numCredits))
+	c.Redirect(http.StatusFound, "/upload")
+}
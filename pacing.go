@@ -0,0 +1,135 @@
+package main
+
+import (
+	"time"
+)
+
+// Paced plugs spread their views evenly between approval and their end date.
+// A plug which has delivered more than its share so far sits out until
+// traffic catches up with it.
+
+// How far ahead of schedule a paced plug may get before it's held back, as a
+// fraction of the views expected by now.
+const PACING_TOLERANCE = 0.05
+
+// Pacing states shown to admins and owners
+const (
+	PACING_NONE     = "not paced"
+	PACING_PENDING  = "not started"
+	PACING_ON_TRACK = "on track"
+	PACING_AHEAD    = "ahead, throttled"
+	PACING_BEHIND   = "behind"
+	PACING_ENDED    = "ended"
+)
+
+// Format of the end date picked on the upload form
+const END_DATE_FORMAT = "2006-01-02"
+
+// pacingStart is when the plug's campaign began, which is when it was
+// approved. Plugs approved before that was recorded use their upload time.
+func (p Plug) pacingStart() time.Time {
+	if p.ApprovedAt != nil {
+		return *p.ApprovedAt
+	}
+	return p.Created
+}
+
+// Ended reports whether the plug's end date has passed.
+func (p Plug) Ended(now time.Time) bool {
+	return p.EndsAt != nil && !now.Before(*p.EndsAt)
+}
+
+// ExpectedViews is how many views a paced plug should have delivered by now.
+func (p Plug) ExpectedViews(now time.Time) float64 {
+	if !p.Paced || p.EndsAt == nil || !p.Approved {
+		return 0
+	}
+	start := p.pacingStart()
+	total := p.EndsAt.Sub(start)
+	if total <= 0 || now.After(*p.EndsAt) {
+		return float64(p.ViewsPurchased)
+	}
+	elapsed := now.Sub(start)
+	if elapsed < 0 {
+		return 0
+	}
+	return float64(p.ViewsPurchased) * elapsed.Seconds() / total.Seconds()
+}
+
+// PacingRatio compares views delivered to views expected by now, so 1 is
+// exactly on schedule. It's false for plugs which aren't paced.
+func (p Plug) PacingRatio(now time.Time) (float64, bool) {
+	if !p.Paced || p.EndsAt == nil || !p.Approved {
+		return 0, false
+	}
+	expected := p.ExpectedViews(now)
+	if expected <= 0 {
+		return 0, true
+	}
+	return float64(p.ViewsDelivered()) / expected, true
+}
+
+// Throttled reports whether a paced plug is far enough ahead of schedule
+// that it should be skipped for now.
+func (p Plug) Throttled(now time.Time) bool {
+	if !p.Paced || p.EndsAt == nil || p.IsDefault() {
+		return false
+	}
+	// Always allow one view so a plug can get started
+	return float64(p.ViewsDelivered()) >= p.ExpectedViews(now)*(1+PACING_TOLERANCE)+1
+}
+
+// PacingStatus summarises how a plug is doing against its schedule.
+func (p Plug) PacingStatus() string {
+	now := time.Now()
+	if !p.Paced || p.EndsAt == nil {
+		return PACING_NONE
+	}
+	if p.Ended(now) {
+		return PACING_ENDED
+	}
+	if !p.Approved {
+		return PACING_PENDING
+	}
+	if p.Throttled(now) {
+		return PACING_AHEAD
+	}
+	if ratio, _ := p.PacingRatio(now); ratio < 1-PACING_TOLERANCE && p.ExpectedViews(now) >= 1 {
+		return PACING_BEHIND
+	}
+	return PACING_ON_TRACK
+}
+
+// PacingPercent is PacingRatio as a whole percentage, for display.
+func (p Plug) PacingPercent() int {
+	ratio, ok := p.PacingRatio(time.Now())
+	if !ok {
+		return 0
+	}
+	return int(ratio*100 + 0.5)
+}
+
+// PacePlugs drops plugs which are ahead of schedule.
+func PacePlugs(plugs []Plug, now time.Time) []Plug {
+	var eligible []Plug
+	for _, plug := range plugs {
+		if !plug.Throttled(now) {
+			eligible = append(eligible, plug)
+		}
+	}
+	return eligible
+}
+
+// parseEndDate reads an end date from the upload form. Plugs run until the
+// end of that day.
+func parseEndDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	day, err := time.ParseInLocation(END_DATE_FORMAT, value, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	end := day.AddDate(0, 0, 1)
+	return &end, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func pacedPlug(start time.Time, length time.Duration, purchased, remaining int) Plug {
+	end := start.Add(length)
+	return Plug{
+		Approved:       true,
+		ApprovedAt:     &start,
+		EndsAt:         &end,
+		Paced:          true,
+		ViewsPurchased: purchased,
+		ViewsRemaining: remaining,
+	}
+}
+
+func TestExpectedViews(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	unpaced := pacedPlug(start, 10*day, 100, 100)
+	unpaced.Paced = false
+	unapproved := pacedPlug(start, 10*day, 100, 100)
+	unapproved.Approved = false
+	instant := pacedPlug(start, 0, 100, 100)
+
+	tests := []struct {
+		name string
+		plug Plug
+		now  time.Time
+		want float64
+	}{
+		{"not paced", unpaced, start.Add(5 * day), 0},
+		{"not approved", unapproved, start.Add(5 * day), 0},
+		{"before start", pacedPlug(start, 10*day, 100, 100), start.Add(-day), 0},
+		{"at start", pacedPlug(start, 10*day, 100, 100), start, 0},
+		{"halfway", pacedPlug(start, 10*day, 100, 100), start.Add(5 * day), 50},
+		{"at end", pacedPlug(start, 10*day, 100, 100), start.Add(10 * day), 100},
+		{"after end", pacedPlug(start, 10*day, 100, 100), start.Add(11 * day), 100},
+		{"ends when it starts", instant, start, 100},
+		{"zero budget", pacedPlug(start, 10*day, 0, 0), start.Add(5 * day), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.plug.ExpectedViews(tt.now)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("ExpectedViews() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	halfway := start.Add(5 * day)
+
+	unpaced := pacedPlug(start, 10*day, 100, 0)
+	unpaced.Paced = false
+	house := pacedPlug(start, 10*day, 100, -1)
+
+	tests := []struct {
+		name string
+		plug Plug
+		now  time.Time
+		want bool
+	}{
+		{"not paced", unpaced, halfway, false},
+		{"house ad", house, halfway, false},
+		{"first view is always allowed", pacedPlug(start, 10*day, 100, 100), start, false},
+		{"second view at the start waits", pacedPlug(start, 10*day, 100, 99), start, true},
+		{"on schedule", pacedPlug(start, 10*day, 100, 50), halfway, false},
+		{"within tolerance", pacedPlug(start, 10*day, 100, 47), halfway, false},
+		{"ahead of schedule", pacedPlug(start, 10*day, 100, 40), halfway, true},
+		{"behind schedule", pacedPlug(start, 10*day, 100, 80), halfway, false},
+		{"last moment of flight", pacedPlug(start, 10*day, 100, 1), start.Add(10 * day), false},
+		{"after end of flight", pacedPlug(start, 10*day, 100, 1), start.Add(11 * day), false},
+		{"zero budget", pacedPlug(start, 10*day, 0, 0), halfway, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.plug.Throttled(tt.now); got != tt.want {
+				t.Errorf("Throttled() = %v, want %v (expected %.2f views, delivered %d)",
+					got, tt.want, tt.plug.ExpectedViews(tt.now), tt.plug.ViewsDelivered())
+			}
+		})
+	}
+}
+
+func TestPacePlugs(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	ahead := pacedPlug(start, 10*day, 100, 10)
+	ahead.ID = 1
+	onTrack := pacedPlug(start, 10*day, 100, 50)
+	onTrack.ID = 2
+
+	got := PacePlugs([]Plug{ahead, onTrack}, start.Add(5*day))
+	if len(got) != 1 || got[0].ID != 2 {
+		t.Errorf("PacePlugs() = %v, want only plug 2", got)
+	}
+	if got := PacePlugs(nil, start); len(got) != 0 {
+		t.Errorf("PacePlugs(nil) = %v, want nothing", got)
+	}
+}
+
+func TestParseEndDate(t *testing.T) {
+	end, err := parseEndDate("")
+	if err != nil || end != nil {
+		t.Errorf(`parseEndDate("") = %v, %v, want nil, nil`, end, err)
+	}
+
+	end, err = parseEndDate("2026-03-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2026, 3, 2, 0, 0, 0, 0, time.Local)
+	if !end.Equal(want) {
+		t.Errorf("parseEndDate() = %v, want the end of the day, %v", end, want)
+	}
+
+	if _, err := parseEndDate("03/01/2026"); err == nil {
+		t.Error("parseEndDate() accepted a date in the wrong format")
+	}
+}
@@ -3,26 +3,105 @@ package main
 import "math/rand"
 import "time"
 
-const DEFAULT_AD_CHANCE = 95
+// Size in pixels every plug image must be
+const (
+	PLUG_WIDTH  = 728
+	PLUG_HEIGHT = 200
+)
+
+// Limits on the text members give with a plug, matching the plugs columns
+const (
+	MAX_TITLE_LENGTH       = 100
+	MAX_ALT_TEXT_LENGTH    = 250
+	MAX_DESCRIPTION_LENGTH = 1000
+)
 
 type Plug struct {
-	ID             int
-	S3ID           string
-	Owner          string
+	ID   int
+	S3ID string
+	// The member who uploaded the plug and paid for it. Later top ups may be
+	// paid for by other members of Group, those are in the credit ledger.
+	Owner string
+	// LDAP group (cn) whose members can all manage the plug, empty for
+	// plugs belonging to Owner alone.
+	Group          string
 	ViewsRemaining int
 	Approved       bool
-	PresignedURL   string
+	Paused         bool
+	CreditsPaid    int
+	ViewsPurchased int
+	Created        time.Time
+	// Admin reviewing the plug, see ActiveClaim
+	ClaimedBy string
+	ClaimedAt *time.Time
+	Title     string
+	// Describes the image for screen readers. Required for new plugs, older
+	// ones fall back to Alt's generic text.
+	AltText     string
+	Description string
+	ApprovedAt  *time.Time
+	// Last moment the plug may be shown, if it has an end date. Paced plugs
+	// spread their views out until then, see PacingStatus.
+	EndsAt       *time.Time
+	Paced        bool
+	PresignedURL string
+	// How often a house ad is picked relative to the others
+	Weight int
+	// Size and type of the image as uploaded, zero and empty for plugs from
+	// before they were recorded. See CheckObjects.
+	ImageSize   int64
+	ContentType string
+	// When, by whom and why the plug was taken down, if it has been. See
+	// ArchivePlug.
+	ArchivedAt    *time.Time
+	ArchivedBy    string
+	ArchiveReason string
+	// When an archived plug's image was deleted under the retention policy
+	ImagePurgedAt *time.Time
+	// Sites the plug is restricted to, see AttachPlugSites
+	Sites []Site
 }
 
 type PlugList struct {
 	Data []string `form:"plugs[]"`
 }
 
+// Alt is the text to use for the plug's alt attribute.
+func (p Plug) Alt() string {
+	if p.AltText != "" {
+		return p.AltText
+	}
+	if p.Title != "" {
+		return p.Title
+	}
+	return "Plug by " + p.Owner
+}
+
 func (p Plug) IsDefault() bool {
 	return p.ViewsRemaining < 0
 }
 
-func ChoosePlug(plugs []Plug) Plug {
+// RefundableCredits is the share of the credits paid for this plug covering
+// the views it hasn't used yet, rounded down.
+func (p Plug) RefundableCredits() int {
+	if p.ViewsPurchased <= 0 || p.ViewsRemaining <= 0 {
+		return 0
+	}
+	return p.CreditsPaid * p.ViewsRemaining / p.ViewsPurchased
+}
+
+// ViewsDelivered is how many of the plug's purchased views have been shown.
+func (p Plug) ViewsDelivered() int {
+	if p.ViewsRemaining <= 0 {
+		return p.ViewsPurchased
+	}
+	return p.ViewsPurchased - p.ViewsRemaining
+}
+
+// ChoosePlug picks a plug to show, giving member plugs fillRatio percent of
+// requests while there are any and house ads the rest by weight. It returns
+// false if there's nothing to show.
+func ChoosePlug(plugs []Plug, fillRatio int) (Plug, bool) {
 	rand.Seed(time.Now().Unix())
 	// Split plugs into default and custom ads
 	var defaults []Plug
@@ -34,19 +113,43 @@ func ChoosePlug(plugs []Plug) Plug {
 			customs = append(customs, plugs[i])
 		}
 	}
+	if len(defaults) == 0 && len(customs) == 0 {
+		return Plug{}, false
+	}
 	// Decide whether to chose default ad or user submitted ad
 	var pickDefault int = rand.Intn(100)
-	if pickDefault >= DEFAULT_AD_CHANCE || len(customs) == 0 {
-		return defaults[rand.Intn(len(defaults))]
+	if len(customs) == 0 || (pickDefault >= fillRatio && len(defaults) > 0) {
+		return chooseWeighted(defaults)
 	} else {
-		return customs[rand.Intn(len(customs))]
+		return customs[rand.Intn(len(customs))], true
 	}
 }
 
-func PlugValueInDrinkCredits(ldap LDAPConnection, username string) int {
-	if ldap.CheckIfIntroMember(username) {
-		return 1000
+// chooseWeighted picks one of plugs with chances in proportion to their
+// weights, or any of them if none has a weight. It returns false if there
+// are no plugs.
+func chooseWeighted(plugs []Plug) (Plug, bool) {
+	if len(plugs) == 0 {
+		return Plug{}, false
 	}
-
-	return 100
+	total := 0
+	for _, plug := range plugs {
+		if plug.Weight > 0 {
+			total += plug.Weight
+		}
+	}
+	if total <= 0 {
+		return plugs[rand.Intn(len(plugs))], true
+	}
+	pick := rand.Intn(total)
+	for _, plug := range plugs {
+		if plug.Weight <= 0 {
+			continue
+		}
+		if pick < plug.Weight {
+			return plug, true
+		}
+		pick -= plug.Weight
+	}
+	return plugs[len(plugs)-1], true
 }
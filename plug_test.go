@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestChoosePlug(t *testing.T) {
+	member := Plug{ID: 1, ViewsRemaining: 10}
+	house := Plug{ID: 2, ViewsRemaining: -1, Weight: 1}
+
+	tests := []struct {
+		name      string
+		plugs     []Plug
+		fillRatio int
+		wantID    int
+		wantOK    bool
+	}{
+		{"no plugs", nil, 95, 0, false},
+		{"only member plugs", []Plug{member}, 0, 1, true},
+		{"only house ads", []Plug{house}, 100, 2, true},
+		{"members get everything at 100", []Plug{member, house}, 100, 1, true},
+		{"house ads get everything at 0", []Plug{member, house}, 0, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 50; i++ {
+				plug, ok := ChoosePlug(tt.plugs, tt.fillRatio)
+				if ok != tt.wantOK || plug.ID != tt.wantID {
+					t.Fatalf("ChoosePlug() = %d, %v, want %d, %v", plug.ID, ok, tt.wantID, tt.wantOK)
+				}
+			}
+		})
+	}
+}
+
+func TestChooseWeighted(t *testing.T) {
+	tests := []struct {
+		name    string
+		plugs   []Plug
+		allowed map[int]bool
+		wantOK  bool
+	}{
+		{"empty pool", nil, nil, false},
+		{"single plug", []Plug{{ID: 1, Weight: 3}}, map[int]bool{1: true}, true},
+		{"zero weights are never picked", []Plug{{ID: 1, Weight: 0}, {ID: 2, Weight: 5}, {ID: 3, Weight: 0}}, map[int]bool{2: true}, true},
+		{"negative weights are never picked", []Plug{{ID: 1, Weight: -4}, {ID: 2, Weight: 1}}, map[int]bool{2: true}, true},
+		{"all zero weights pick any", []Plug{{ID: 1}, {ID: 2}}, map[int]bool{1: true, 2: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 200; i++ {
+				plug, ok := chooseWeighted(tt.plugs)
+				if ok != tt.wantOK {
+					t.Fatalf("chooseWeighted() ok = %v, want %v", ok, tt.wantOK)
+				}
+				if ok && !tt.allowed[plug.ID] {
+					t.Fatalf("chooseWeighted() picked plug %d", plug.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestChooseWeightedProportions(t *testing.T) {
+	plugs := []Plug{{ID: 1, Weight: 1}, {ID: 2, Weight: 3}}
+	counts := make(map[int]int)
+	const draws = 20000
+	for i := 0; i < draws; i++ {
+		plug, _ := chooseWeighted(plugs)
+		counts[plug.ID]++
+	}
+	// Expect 25% and 75%, allowing plenty of room for chance
+	share := float64(counts[2]) / draws
+	if share < 0.7 || share > 0.8 {
+		t.Errorf("plug with weight 3 picked %.2f of the time, want about 0.75", share)
+	}
+}
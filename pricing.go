@@ -0,0 +1,422 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	csh_auth "github.com/liam-middlebrook/csh-auth"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prices are worked out from rules admins keep in pricing_rules. Every rule
+// can be limited to members of an LDAP group and to a time window.
+//
+//   - rate: views per credit. The best matching rate applies.
+//   - placement: percentage of the views a plug targeted at a site gets, so
+//     busy sites can cost more. A plug on several sites pays for the
+//     dearest.
+//   - discount: percentage of bonus views. The best matching one applies.
+//   - limits: the fewest and most credits one purchase may spend.
+const (
+	PRICING_RATE      = "rate"
+	PRICING_PLACEMENT = "placement"
+	PRICING_DISCOUNT  = "discount"
+	PRICING_LIMITS    = "limits"
+)
+
+var PRICING_KINDS = []string{PRICING_RATE, PRICING_PLACEMENT, PRICING_DISCOUNT, PRICING_LIMITS}
+
+// Views per credit when no rate rule matches
+const DEFAULT_VIEWS_PER_CREDIT = 100
+
+// Starts off with the prices that used to be hardcoded: 100 views per credit,
+// or 1000 for intro members.
+const SQL_CREATE_PRICING_RULES_TABLE = `CREATE TABLE pricing_rules (
+id                  SERIAL PRIMARY KEY,
+kind                VARCHAR(16) NOT NULL,
+group_cn            VARCHAR(64) NOT NULL DEFAULT '',
+site_id             INTEGER REFERENCES sites(id) ON DELETE CASCADE,
+views_per_credit    INTEGER NOT NULL DEFAULT 0,
+percent             INTEGER NOT NULL DEFAULT 0,
+min_credits         INTEGER NOT NULL DEFAULT 0,
+max_credits         INTEGER NOT NULL DEFAULT 0,
+starts_at           TIMESTAMP,
+ends_at             TIMESTAMP,
+created_by          VARCHAR(32) NOT NULL,
+created             TIMESTAMP NOT NULL
+);
+INSERT INTO pricing_rules (kind, group_cn, views_per_credit, min_credits, created_by, created) VALUES
+('rate', '', 100, 0, 'system', now()),
+('rate', 'intromembers', 1000, 0, 'system', now()),
+('limits', '', 0, 1, 'system', now());`
+
+const SQL_RETRIEVE_PRICING_RULES = `SELECT r.id, r.kind, r.group_cn, r.site_id, COALESCE(s.name, ''),
+r.views_per_credit, r.percent, r.min_credits, r.max_credits, r.starts_at, r.ends_at, r.created_by
+FROM pricing_rules r LEFT JOIN sites s ON s.id = r.site_id
+ORDER BY r.kind, r.id`
+
+const SQL_INSERT_PRICING_RULE = `INSERT INTO pricing_rules
+(kind, group_cn, site_id, views_per_credit, percent, min_credits, max_credits, starts_at, ends_at, created_by, created)
+VALUES ($1::text, $2::text, $3, $4::integer, $5::integer, $6::integer, $7::integer, $8, $9, $10::text, $11)`
+
+const SQL_DELETE_PRICING_RULE = `DELETE FROM pricing_rules WHERE id=$1::integer`
+
+type PricingRule struct {
+	ID             int
+	Kind           string
+	Group          string
+	SiteID         int
+	SiteName       string
+	ViewsPerCredit int
+	Percent        int
+	MinCredits     int
+	// Zero for no maximum
+	MaxCredits int
+	StartsAt   *time.Time
+	EndsAt     *time.Time
+	CreatedBy  string
+}
+
+// Applies reports whether the rule covers a member of memberOf buying at
+// the given time.
+func (r PricingRule) Applies(memberOf []string, now time.Time) bool {
+	if r.StartsAt != nil && now.Before(*r.StartsAt) {
+		return false
+	}
+	if r.EndsAt != nil && !now.Before(*r.EndsAt) {
+		return false
+	}
+	if r.Group == "" {
+		return true
+	}
+	for _, group := range memberOf {
+		if group == r.Group {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary describes what the rule does for the admin page.
+func (r PricingRule) Summary() string {
+	switch r.Kind {
+	case PRICING_RATE:
+		return fmt.Sprintf("%d views per credit", r.ViewsPerCredit)
+	case PRICING_PLACEMENT:
+		return fmt.Sprintf("%d%% of views on %s", r.Percent, r.SiteName)
+	case PRICING_DISCOUNT:
+		return fmt.Sprintf("%d%% bonus views", r.Percent)
+	case PRICING_LIMITS:
+		if r.MaxCredits > 0 {
+			return fmt.Sprintf("%d to %d credits per purchase", r.MinCredits, r.MaxCredits)
+		}
+		return fmt.Sprintf("at least %d credits per purchase", r.MinCredits)
+	}
+	return r.Kind
+}
+
+// Quote is the price of a purchase of views.
+type Quote struct {
+	Credits          int    `json:"credits"`
+	Views            int    `json:"views"`
+	BaseRate         int    `json:"base_rate"`
+	PlacementPercent int    `json:"placement_percent"`
+	DiscountPercent  int    `json:"discount_percent"`
+	MinCredits       int    `json:"min_credits"`
+	MaxCredits       int    `json:"max_credits,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// QuoteViews prices credits for a member of memberOf buying views on the
+// given sites, which are empty for a plug shown everywhere.
+func QuoteViews(rules []PricingRule, memberOf []string, siteIDs []int, credits int, now time.Time) Quote {
+	q := Quote{Credits: credits, PlacementPercent: 100}
+
+	sitePercents := make(map[int]int)
+	for _, rule := range rules {
+		if !rule.Applies(memberOf, now) {
+			continue
+		}
+		switch rule.Kind {
+		case PRICING_RATE:
+			if rule.ViewsPerCredit > q.BaseRate {
+				q.BaseRate = rule.ViewsPerCredit
+			}
+		case PRICING_PLACEMENT:
+			if percent, ok := sitePercents[rule.SiteID]; !ok || rule.Percent < percent {
+				sitePercents[rule.SiteID] = rule.Percent
+			}
+		case PRICING_DISCOUNT:
+			if rule.Percent > q.DiscountPercent {
+				q.DiscountPercent = rule.Percent
+			}
+		case PRICING_LIMITS:
+			if rule.MinCredits > q.MinCredits {
+				q.MinCredits = rule.MinCredits
+			}
+			if rule.MaxCredits > 0 && (q.MaxCredits == 0 || rule.MaxCredits < q.MaxCredits) {
+				q.MaxCredits = rule.MaxCredits
+			}
+		}
+	}
+	if q.BaseRate == 0 {
+		q.BaseRate = DEFAULT_VIEWS_PER_CREDIT
+	}
+
+	for i, id := range siteIDs {
+		percent, ok := sitePercents[id]
+		if !ok {
+			percent = 100
+		}
+		if i == 0 || percent < q.PlacementPercent {
+			q.PlacementPercent = percent
+		}
+	}
+
+	q.Views = credits * q.BaseRate * q.PlacementPercent * (100 + q.DiscountPercent) / 10000
+
+	switch {
+	case credits < 0:
+		q.Error = "Can't specify negative credits!"
+	case credits < q.MinCredits:
+		q.Error = fmt.Sprintf("You need to spend at least %d credit(s).", q.MinCredits)
+	case q.MaxCredits > 0 && credits > q.MaxCredits:
+		q.Error = fmt.Sprintf("You can spend at most %d credit(s) at once.", q.MaxCredits)
+	}
+	return q
+}
+
+// Quote prices a purchase of views for uid on the current rules.
+func (a *PlugApplication) Quote(uid string, siteIDs []int, credits int) Quote {
+	return QuoteViews(a.db.GetPricingRules(), a.ldap.GetUserGroups(uid), siteIDs, credits, time.Now())
+}
+
+func (c DBConnection) GetPricingRules() []PricingRule {
+	start := time.Now()
+	rows, err := c.con.Query(SQL_RETRIEVE_PRICING_RULES)
+	c.app.metrics.ObserveDependency("postgres", "get_pricing_rules", start, err)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var rules []PricingRule
+	for rows.Next() {
+		var obj PricingRule
+		var siteID sql.NullInt64
+		err = rows.Scan(&obj.ID, &obj.Kind, &obj.Group, &siteID, &obj.SiteName,
+			&obj.ViewsPerCredit, &obj.Percent, &obj.MinCredits, &obj.MaxCredits,
+			&obj.StartsAt, &obj.EndsAt, &obj.CreatedBy)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		obj.SiteID = int(siteID.Int64)
+		rules = append(rules, obj)
+	}
+	return rules
+}
+
+func (c DBConnection) MakePricingRule(rule PricingRule) {
+	var siteID interface{}
+	if rule.SiteID > 0 {
+		siteID = rule.SiteID
+	}
+
+	start := time.Now()
+	_, err := c.con.Exec(SQL_INSERT_PRICING_RULE,
+		rule.Kind,
+		rule.Group,
+		siteID,
+		rule.ViewsPerCredit,
+		rule.Percent,
+		rule.MinCredits,
+		rule.MaxCredits,
+		rule.StartsAt,
+		rule.EndsAt,
+		rule.CreatedBy,
+		time.Now())
+	c.app.metrics.ObserveDependency("postgres", "make_pricing_rule", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (c DBConnection) DeletePricingRule(id int) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_DELETE_PRICING_RULE, id)
+	c.app.metrics.ObserveDependency("postgres", "delete_pricing_rule", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// checkQuote compares the views a member was quoted with the current price,
+// writing an error response and returning false if they differ or the
+// purchase isn't allowed.
+func checkQuote(c *gin.Context, quote Quote) bool {
+	if quote.Error != "" {
+		c.String(http.StatusBadRequest, quote.Error)
+		return false
+	}
+	quoted, err := strconv.Atoi(c.PostForm("quotedViews"))
+	if err != nil || quoted != quote.Views {
+		c.String(http.StatusConflict,
+			"The price has changed: %d credit(s) now buys %d view(s). Nothing was charged, please check the new quote and try again.",
+			quote.Credits, quote.Views)
+		return false
+	}
+	return true
+}
+
+// quote prices a purchase for the upload and top up forms. Top ups pass the
+// plug so its sites are taken into account, which only its owners may do.
+// Other plugs are reported missing, so nobody learns which exist.
+func (r PlugRoutes) quote(c *gin.Context) {
+	claims, ok := c.Value(csh_auth.AuthKey).(csh_auth.CSHClaims)
+	if !ok {
+		log.Fatal("error finding claims")
+		return
+	}
+
+	credits, err := strconv.Atoi(c.Query("numCredits"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Specify numCredits"})
+		return
+	}
+
+	siteIDs := parsePlugIds(c.QueryArray("sites[]"))
+	if id, err := strconv.Atoi(c.Query("plug")); err == nil {
+		plug, ok := r.app.db.GetPlugById(id)
+		if !ok || plug.IsDefault() || !r.app.CanManagePlug(claims.UserInfo.Username, plug) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No such plug!"})
+			return
+		}
+		plugs := []Plug{plug}
+		r.app.db.AttachPlugSites(plugs)
+		siteIDs = plugs[0].SiteIDs()
+	}
+
+	c.JSON(http.StatusOK, r.app.Quote(claims.UserInfo.Username, siteIDs, credits))
+}
+
+func (r PlugRoutes) pricing_view(c *gin.Context) {
+	if _, ok := r.requireAdmin(c); !ok {
+		return
+	}
+
+	r.page(c, "pricing.tmpl", gin.H{
+		"rules": r.app.db.GetPricingRules(),
+		"kinds": PRICING_KINDS,
+		"sites": r.app.db.GetSites(),
+	})
+}
+
+func (r PlugRoutes) pricing_rule_create(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	rule := PricingRule{
+		Kind:      c.PostForm("kind"),
+		Group:     strings.TrimSpace(c.PostForm("group")),
+		CreatedBy: claims.UserInfo.Username,
+	}
+	number := func(field string) int {
+		value, err := strconv.Atoi(c.PostForm(field))
+		if err != nil || value < 0 {
+			return 0
+		}
+		return value
+	}
+
+	switch rule.Kind {
+	case PRICING_RATE:
+		rule.ViewsPerCredit = number("viewsPerCredit")
+		if rule.ViewsPerCredit == 0 {
+			c.String(http.StatusBadRequest, "A rate needs a number of views per credit!")
+			return
+		}
+	case PRICING_PLACEMENT:
+		rule.SiteID = number("site")
+		rule.Percent = number("percent")
+		if rule.SiteID == 0 || rule.Percent == 0 {
+			c.String(http.StatusBadRequest, "A placement rule needs a site and a percentage!")
+			return
+		}
+	case PRICING_DISCOUNT:
+		rule.Percent = number("percent")
+		if rule.Percent == 0 {
+			c.String(http.StatusBadRequest, "A discount needs a percentage!")
+			return
+		}
+	case PRICING_LIMITS:
+		rule.MinCredits = number("minCredits")
+		rule.MaxCredits = number("maxCredits")
+		if rule.MaxCredits > 0 && rule.MaxCredits < rule.MinCredits {
+			c.String(http.StatusBadRequest, "The maximum can't be below the minimum!")
+			return
+		}
+	default:
+		c.String(http.StatusBadRequest, "Unknown kind of rule!")
+		return
+	}
+
+	var err error
+	if rule.StartsAt, err = parseRuleTime(c.PostForm("startsAt")); err != nil {
+		c.String(http.StatusBadRequest, "Invalid start time!")
+		return
+	}
+	if rule.EndsAt, err = parseRuleTime(c.PostForm("endsAt")); err != nil {
+		c.String(http.StatusBadRequest, "Invalid end time!")
+		return
+	}
+
+	r.app.db.MakePricingRule(rule)
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_PRICING_RULE_CREATED, 0, SEVERITY_INFO, map[string]interface{}{
+		"kind":    rule.Kind,
+		"group":   rule.Group,
+		"site_id": rule.SiteID,
+		"summary": rule.Summary(),
+	})
+	flash(c, FLASH_SUCCESS, "Pricing rule added.")
+	c.Redirect(http.StatusFound, "/admin/pricing")
+}
+
+// parseRuleTime reads a datetime-local field from the pricing form
+func parseRuleTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := time.ParseInLocation("2006-01-02T15:04", value, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+func (r PlugRoutes) pricing_rule_deletion(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid rule id!")
+		return
+	}
+
+	r.app.db.DeletePricingRule(id)
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_PRICING_RULE_DELETED, 0, SEVERITY_INFO, map[string]interface{}{
+		"rule_id": id,
+	})
+	flash(c, FLASH_SUCCESS, "Pricing rule deleted.")
+	c.Redirect(http.StatusFound, "/admin/pricing")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuoteViews(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	rules := []PricingRule{
+		{Kind: PRICING_RATE, ViewsPerCredit: 100},
+		{Kind: PRICING_RATE, Group: "intromembers", ViewsPerCredit: 1000},
+		{Kind: PRICING_RATE, Group: "expired", ViewsPerCredit: 5000, EndsAt: &past},
+		{Kind: PRICING_RATE, Group: "upcoming", ViewsPerCredit: 5000, StartsAt: &future},
+		{Kind: PRICING_PLACEMENT, SiteID: 1, Percent: 50},
+		{Kind: PRICING_PLACEMENT, SiteID: 2, Percent: 80},
+		{Kind: PRICING_PLACEMENT, SiteID: 2, Percent: 90},
+		{Kind: PRICING_DISCOUNT, Group: "sale", Percent: 10},
+		{Kind: PRICING_DISCOUNT, Group: "sale", Percent: 25},
+		{Kind: PRICING_LIMITS, MinCredits: 1},
+		{Kind: PRICING_LIMITS, Group: "capped", MaxCredits: 5},
+	}
+
+	tests := []struct {
+		name      string
+		rules     []PricingRule
+		memberOf  []string
+		siteIDs   []int
+		credits   int
+		wantViews int
+		wantError bool
+	}{
+		{"no rules uses the default rate", nil, nil, nil, 2, 200, false},
+		{"base rate", rules, nil, nil, 3, 300, false},
+		{"best rate wins", rules, []string{"intromembers"}, nil, 1, 1000, false},
+		{"expired rules don't apply", rules, []string{"expired"}, nil, 1, 100, false},
+		{"future rules don't apply", rules, []string{"upcoming"}, nil, 1, 100, false},
+		{"placement on one site", rules, nil, []int{1}, 2, 100, false},
+		{"dearest site wins", rules, nil, []int{2, 1}, 2, 100, false},
+		{"cheapest rule for a site wins", rules, nil, []int{2}, 1, 80, false},
+		{"unpriced sites are full price", rules, nil, []int{3}, 1, 100, false},
+		{"best discount wins", rules, []string{"sale"}, nil, 1, 125, false},
+		{"discount on placement", rules, []string{"sale"}, []int{1}, 1, 62, false},
+		{"zero credits", nil, nil, nil, 0, 0, false},
+		{"zero credits under the minimum", rules, nil, nil, 0, 0, true},
+		{"negative credits", nil, nil, nil, -1, -100, true},
+		{"over the maximum", rules, []string{"capped"}, nil, 6, 600, true},
+		{"at the maximum", rules, []string{"capped"}, nil, 5, 500, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := QuoteViews(tt.rules, tt.memberOf, tt.siteIDs, tt.credits, now)
+			if q.Views != tt.wantViews {
+				t.Errorf("Views = %d, want %d", q.Views, tt.wantViews)
+			}
+			if (q.Error != "") != tt.wantError {
+				t.Errorf("Error = %q, want error %v", q.Error, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestQuoteViewsRoundsDown(t *testing.T) {
+	rules := []PricingRule{
+		{Kind: PRICING_RATE, ViewsPerCredit: 3},
+		{Kind: PRICING_PLACEMENT, SiteID: 1, Percent: 50},
+		{Kind: PRICING_DISCOUNT, Percent: 33},
+	}
+	tests := []struct {
+		credits int
+		siteIDs []int
+		want    int
+	}{
+		// 3 * 133% = 3.99
+		{1, nil, 3},
+		// 3 * 50% * 133% = 1.995
+		{1, []int{1}, 1},
+		// 7 * 3 * 50% * 133% = 13.965
+		{7, []int{1}, 13},
+	}
+	for _, tt := range tests {
+		q := QuoteViews(rules, nil, tt.siteIDs, tt.credits, time.Now())
+		if q.Views != tt.want {
+			t.Errorf("QuoteViews(%d credits, sites %v) = %d views, want %d", tt.credits, tt.siteIDs, q.Views, tt.want)
+		}
+	}
+}
+
+func TestCheckQuote(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		quote      Quote
+		quoted     string
+		wantOK     bool
+		wantStatus int
+	}{
+		{"matching quote", Quote{Credits: 1, Views: 100}, "100", true, http.StatusOK},
+		{"price changed", Quote{Credits: 1, Views: 100}, "1000", false, http.StatusConflict},
+		{"no quote given", Quote{Credits: 1, Views: 100}, "", false, http.StatusConflict},
+		{"not a number", Quote{Credits: 1, Views: 100}, "lots", false, http.StatusConflict},
+		{"purchase not allowed", Quote{Credits: 0, Views: 0, Error: "too few"}, "0", false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			form := url.Values{"quotedViews": {tt.quoted}}
+			c.Request = httptest.NewRequest("POST", "/upload", strings.NewReader(form.Encode()))
+			c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			if ok := checkQuote(c, tt.quote); ok != tt.wantOK {
+				t.Errorf("checkQuote() = %v, want %v", ok, tt.wantOK)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
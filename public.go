@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Public CSH pages show plugs to logged out visitors through /public/data and
+// /public/data.json. Rather than a login these need either a site's API
+// token or a placement URL signed with PLUG_SIGNING_KEY, both issued from
+// the sites admin page. Visitors are told apart by an anonymous session
+// cookie so frequency capping still works, and limited by IP under
+// LIMIT_PUBLIC.
+
+const (
+	PUBLIC_SESSION_COOKIE  = "plug_session"
+	PUBLIC_SESSION_MAX_AGE = 365 * 24 * time.Hour
+	// Bytes of randomness in a session ID, which is hex encoded
+	PUBLIC_SESSION_ID_LENGTH = 12
+	// Anonymous viewers are recorded as this followed by their session ID
+	ANONYMOUS_VIEWER_PREFIX = "anon:"
+)
+
+const SQL_RETRIEVE_SITE_BY_TOKEN = `SELECT id, host, name, token FROM sites WHERE token=$1::text AND token<>''`
+
+const SQL_SET_SITE_TOKEN = `UPDATE sites SET token=$2::text WHERE id=$1::integer`
+
+type PublicServing struct {
+	// Key placement URLs are signed with, signed URLs are refused without one
+	signing_key []byte
+}
+
+func (p *PublicServing) Init(signing_key string) {
+	p.signing_key = []byte(signing_key)
+}
+
+// SignPlacement signs a site's host for use in a placement URL. It's empty
+// when there's no signing key.
+func (p PublicServing) SignPlacement(host string) string {
+	if len(p.signing_key) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, p.signing_key)
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p PublicServing) VerifyPlacement(host, sig string) bool {
+	expected := p.SignPlacement(host)
+	return expected != "" && hmac.Equal([]byte(expected), []byte(sig))
+}
+
+// PlacementURL is the signed URL a public page can use as an image source.
+func (p PublicServing) PlacementURL(public_url string, site Site) string {
+	sig := p.SignPlacement(site.Host)
+	if sig == "" {
+		return ""
+	}
+	query := url.Values{}
+	query.Set("site", site.Host)
+	query.Set("sig", sig)
+	return public_url + "/public/data?" + query.Encode()
+}
+
+func newSiteToken() string {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func newSessionID() string {
+	buf := make([]byte, PUBLIC_SESSION_ID_LENGTH)
+	_, err := rand.Read(buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (c DBConnection) GetSiteByToken(token string) (Site, bool) {
+	sites := c.querySites("get_site_by_token", SQL_RETRIEVE_SITE_BY_TOKEN, token)
+	if len(sites) == 0 {
+		return Site{}, false
+	}
+	return sites[0], true
+}
+
+func (c DBConnection) SetSiteToken(id int, token string) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_SET_SITE_TOKEN, id, token)
+	c.app.metrics.ObserveDependency("postgres", "set_site_token", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// publicSite works out which site a public request is authorized for, from
+// a bearer token, a token query parameter or a signed placement.
+func (r PlugRoutes) publicSite(c *gin.Context) (Site, bool) {
+	token := c.Query("token")
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token != "" {
+		return r.app.db.GetSiteByToken(token)
+	}
+
+	host := normalizeHost(c.Query("site"))
+	if host == "" || !r.app.public.VerifyPlacement(host, c.Query("sig")) {
+		return Site{}, false
+	}
+	return r.app.db.GetSiteByHost(host)
+}
+
+// originIsSite reports whether a CORS Origin is one of site's pages.
+func originIsSite(origin string, site Site) bool {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return false
+	}
+	return normalizeHost(u.Host) == normalizeHost(site.Host)
+}
+
+// anonymousViewer identifies a logged out visitor by their session cookie,
+// giving them a new session if they don't have one.
+func anonymousViewer(c *gin.Context) string {
+	session, err := c.Cookie(PUBLIC_SESSION_COOKIE)
+	if err != nil || len(session) != PUBLIC_SESSION_ID_LENGTH*2 {
+		session = newSessionID()
+	}
+
+	// Public pages embed plugs from another origin, which browsers only send
+	// cookies to over HTTPS with SameSite=None.
+	cookie := &http.Cookie{
+		Name:     PUBLIC_SESSION_COOKIE,
+		Value:    session,
+		Path:     "/public",
+		MaxAge:   int(PUBLIC_SESSION_MAX_AGE.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(c.Writer, cookie)
+
+	return ANONYMOUS_VIEWER_PREFIX + session
+}
+
+// servePublic checks a public request is allowed before serving it a plug.
+func (r PlugRoutes) servePublic(c *gin.Context) (Plug, *url.URL, bool) {
+	if !r.app.limits.Allow(c, LIMIT_PUBLIC, "ip:"+r.app.limits.ClientIP(c)) {
+		return Plug{}, nil, false
+	}
+
+	site, ok := r.publicSite(c)
+	if !ok {
+		c.String(http.StatusUnauthorized, "A site token or signed placement is required!")
+		return Plug{}, nil, false
+	}
+
+	// Let the site's own scripts, and only those, fetch data.json along with
+	// the session
+	c.Header("Vary", "Origin")
+	if origin := c.GetHeader("Origin"); originIsSite(origin, site) {
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Allow-Credentials", "true")
+	}
+
+	return r.serve(c, anonymousViewer(c), site, true)
+}
+
+func (r PlugRoutes) public_action(c *gin.Context) {
+	_, url, ok := r.servePublic(c)
+	if !ok {
+		return
+	}
+	c.Redirect(http.StatusFound, url.String())
+}
+
+func (r PlugRoutes) public_action_json(c *gin.Context) {
+	plug, url, ok := r.servePublic(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, plugJSON(plug, url))
+}
+
+// site_token_issue gives a site a new API token, replacing any old one.
+func (r PlugRoutes) site_token_issue(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid site id!")
+		return
+	}
+
+	r.app.db.SetSiteToken(id, newSiteToken())
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_SITE_TOKEN_ISSUED, 0, SEVERITY_WARNING, map[string]interface{}{
+		"site_id": id,
+	})
+	flash(c, FLASH_SUCCESS, "New API token issued, the old one no longer works.")
+	c.Redirect(http.StatusFound, "/admin/sites")
+}
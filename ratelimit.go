@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	csh_auth "github.com/liam-middlebrook/csh-auth"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limits are token buckets: each key may make Requests requests at once
+// and gets them back evenly over Per. Requests refused while a bucket is
+// empty still cost a token, down to a debt of one, so clients that ignore
+// Retry-After stay locked out rather than getting every other request in.
+
+// Named limits, each applied per uid and per client IP. Set with
+// PLUG_RATE_LIMITS, e.g. "data=60/1m,upload=10/1h", where 0 disables a limit.
+const (
+	LIMIT_DATA   = "data"
+	LIMIT_UPLOAD = "upload"
+	// Logged out requests from public sites, limited by IP alone
+	LIMIT_PUBLIC = "public"
+)
+
+var DEFAULT_RATE_LIMITS = map[string]RateLimit{
+	LIMIT_DATA:   {60, time.Minute},
+	LIMIT_UPLOAD: {10, time.Hour},
+	LIMIT_PUBLIC: {60, time.Minute},
+}
+
+// Where buckets are kept, set with PLUG_RATE_LIMIT_STORE. The memory store is
+// per process, so each replica allows the full limit.
+const (
+	RATE_LIMIT_STORE_MEMORY   = "memory"
+	RATE_LIMIT_STORE_POSTGRES = "postgres"
+)
+
+// Buckets are swept after this many requests once they've had time to fill
+const RATE_LIMIT_SWEEP_INTERVAL = 1000
+
+// Each key is audited at most this often while it's being limited
+const RATE_LIMIT_AUDIT_INTERVAL = time.Minute
+
+const SQL_CREATE_RATE_LIMIT_BUCKETS_TABLE = `CREATE TABLE rate_limit_buckets (
+key             VARCHAR(128) PRIMARY KEY,
+tokens          DOUBLE PRECISION NOT NULL,
+updated         TIMESTAMP NOT NULL
+);`
+
+// Refills the bucket for the time since it was last used, then takes a
+// token, going no lower than -1. The request is allowed if the result isn't
+// negative. $2 is the bucket size and $3 the refill rate per second.
+const SQL_TAKE_RATE_LIMIT_TOKEN = `INSERT INTO rate_limit_buckets (key, tokens, updated)
+VALUES ($1::text, $2::double precision - 1, $4)
+ON CONFLICT (key) DO UPDATE SET
+tokens = GREATEST(LEAST($2::double precision,
+rate_limit_buckets.tokens + EXTRACT(EPOCH FROM ($4 - rate_limit_buckets.updated)) * $3::double precision) - 1, -1),
+updated = $4
+RETURNING tokens`
+
+const SQL_SWEEP_RATE_LIMIT_BUCKETS = `DELETE FROM rate_limit_buckets WHERE updated < $1`
+
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// retryAfter is how long a bucket left with tokens takes to get a whole
+// token back.
+func (l RateLimit) retryAfter(tokens float64) time.Duration {
+	return time.Duration((1 - tokens) / l.rate() * float64(time.Second))
+}
+
+// takeToken refills a bucket holding tokens for elapsed time and takes one
+// token, returning what's left and whether the request is allowed.
+func (l RateLimit) takeToken(tokens float64, elapsed time.Duration) (float64, bool) {
+	tokens = math.Min(float64(l.Requests), tokens+elapsed.Seconds()*l.rate()) - 1
+	tokens = math.Max(tokens, -1)
+	return tokens, tokens >= 0
+}
+
+// Limiter keeps token buckets.
+type Limiter interface {
+	// Take takes a token from key's bucket, returning whether the request is
+	// allowed and if not how long until it would be.
+	Take(key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// Time until the bucket is full again, when it can be forgotten
+	full time.Time
+}
+
+// MemoryLimiter keeps buckets in process.
+type MemoryLimiter struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	requests int
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: make(map[string]*bucket)}
+}
+
+func (m *MemoryLimiter) Take(key string, limit RateLimit) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Requests), updated: now}
+		m.buckets[key] = b
+	}
+
+	tokens, allowed := limit.takeToken(b.tokens, now.Sub(b.updated))
+	b.tokens = tokens
+	b.updated = now
+	b.full = now.Add(time.Duration((float64(limit.Requests) - tokens) / limit.rate() * float64(time.Second)))
+
+	m.requests++
+	if m.requests%RATE_LIMIT_SWEEP_INTERVAL == 0 {
+		for k, b := range m.buckets {
+			if now.After(b.full) {
+				delete(m.buckets, k)
+			}
+		}
+	}
+
+	if !allowed {
+		return false, limit.retryAfter(tokens), nil
+	}
+	return true, 0, nil
+}
+
+// PostgresLimiter shares buckets between replicas.
+type PostgresLimiter struct {
+	db *DBConnection
+	// Longest time any limit takes to refill, after which buckets are swept
+	longest time.Duration
+
+	mu       sync.Mutex
+	requests int
+}
+
+func (p *PostgresLimiter) Take(key string, limit RateLimit) (bool, time.Duration, error) {
+	now := time.Now()
+	var tokens float64
+	start := time.Now()
+	err := p.db.con.QueryRow(SQL_TAKE_RATE_LIMIT_TOKEN, key, limit.Requests, limit.rate(), now).Scan(&tokens)
+	p.db.app.metrics.ObserveDependency("postgres", "take_rate_limit_token", start, err)
+	if err != nil {
+		return true, 0, err
+	}
+
+	p.mu.Lock()
+	p.requests++
+	sweep := p.requests%RATE_LIMIT_SWEEP_INTERVAL == 0
+	p.mu.Unlock()
+	if sweep {
+		start = time.Now()
+		_, err := p.db.con.Exec(SQL_SWEEP_RATE_LIMIT_BUCKETS, now.Add(-p.longest))
+		p.db.app.metrics.ObserveDependency("postgres", "sweep_rate_limit_buckets", start, err)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	if tokens < 0 {
+		return false, limit.retryAfter(tokens), nil
+	}
+	return true, 0, nil
+}
+
+type RateLimits struct {
+	app     *PlugApplication
+	limiter Limiter
+	limits  map[string]RateLimit
+
+	// Proxies whose X-Forwarded-For is believed, see ClientIP
+	trusted []*net.IPNet
+
+	// When each limited key was last audited
+	mu      sync.Mutex
+	audited map[string]time.Time
+}
+
+func (r *RateLimits) Init(app *PlugApplication, store, limits, trusted_proxies string) {
+	r.app = app
+	r.audited = make(map[string]time.Time)
+
+	var err error
+	r.limits, err = parseRateLimits(limits)
+	if err != nil {
+		log.Fatal("PLUG_RATE_LIMITS: ", err)
+	}
+	r.trusted, err = parseTrustedProxies(trusted_proxies)
+	if err != nil {
+		log.Fatal("PLUG_TRUSTED_PROXIES: ", err)
+	}
+
+	switch store {
+	case "", RATE_LIMIT_STORE_MEMORY:
+		r.limiter = NewMemoryLimiter()
+	case RATE_LIMIT_STORE_POSTGRES:
+		app.db.create_table_safe("rate_limit_buckets", SQL_CREATE_RATE_LIMIT_BUCKETS_TABLE)
+		longest := time.Duration(0)
+		for _, limit := range r.limits {
+			if limit.Per > longest {
+				longest = limit.Per
+			}
+		}
+		r.limiter = &PostgresLimiter{db: &app.db, longest: longest}
+	default:
+		log.Fatal("PLUG_RATE_LIMIT_STORE must be memory or postgres")
+	}
+}
+
+// parseTrustedProxies reads a comma separated list of addresses and CIDR
+// ranges.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, item := range splitList(value) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("%q isn't an address or CIDR range", item)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			item = fmt.Sprintf("%s/%d", item, bits)
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't an address or CIDR range", item)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+func (r *RateLimits) isTrusted(ip net.IP) bool {
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the address limits are keyed on. It's the connection's peer
+// unless that's a trusted proxy, in which case X-Forwarded-For is read from
+// the right, skipping trusted proxies, as anything further left may have
+// been made up by the client.
+func (r *RateLimits) ClientIP(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		host = strings.TrimSpace(c.Request.RemoteAddr)
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !r.isTrusted(peer) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(c.Request.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !r.isTrusted(ip) {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+// parseRateLimits reads limits like "data=60/1m,upload=10/1h" over the
+// defaults.
+func parseRateLimits(value string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for name, limit := range DEFAULT_RATE_LIMITS {
+		limits[name] = limit
+	}
+
+	for _, item := range splitList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q should look like name=requests/duration", item)
+		}
+		name := strings.TrimSpace(parts[0])
+		if _, ok := DEFAULT_RATE_LIMITS[name]; !ok {
+			return nil, fmt.Errorf("unknown limit %q", name)
+		}
+
+		spec := strings.TrimSpace(parts[1])
+		if spec == "0" {
+			delete(limits, name)
+			continue
+		}
+		rate := strings.SplitN(spec, "/", 2)
+		if len(rate) != 2 {
+			return nil, fmt.Errorf("%q should look like requests/duration", spec)
+		}
+		requests, err := strconv.Atoi(rate[0])
+		if err != nil || requests <= 0 {
+			return nil, fmt.Errorf("%q isn't a positive number of requests", rate[0])
+		}
+		per, err := time.ParseDuration(rate[1])
+		if err != nil || per <= 0 {
+			return nil, fmt.Errorf("%q isn't a duration", rate[1])
+		}
+		limits[name] = RateLimit{requests, per}
+	}
+	return limits, nil
+}
+
+// Allow checks the named limit for each of the given keys, writing a 429
+// response and returning false if any of them is used up.
+func (r *RateLimits) Allow(c *gin.Context, name string, keys ...string) bool {
+	limit, ok := r.limits[name]
+	if !ok {
+		return true
+	}
+
+	for _, key := range keys {
+		allowed, retry, err := r.limiter.Take(name+":"+key, limit)
+		if err != nil {
+			// Better to let requests through than refuse everyone
+			log.Error(err)
+			continue
+		}
+		if allowed {
+			continue
+		}
+
+		r.app.metrics.RecordRateLimited(name, strings.SplitN(key, ":", 2)[0])
+		r.audit(name, key, retry)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		c.String(http.StatusTooManyRequests, "Too many requests, please try again later!")
+		return false
+	}
+	return true
+}
+
+// audit records that key hit a limit, once per RATE_LIMIT_AUDIT_INTERVAL so
+// a script hammering the server can't flood the log.
+func (r *RateLimits) audit(name, key string, retry time.Duration) {
+	now := time.Now()
+	r.mu.Lock()
+	last, seen := r.audited[name+":"+key]
+	if seen && now.Sub(last) < RATE_LIMIT_AUDIT_INTERVAL {
+		r.mu.Unlock()
+		return
+	}
+	r.audited[name+":"+key] = now
+	for k, t := range r.audited {
+		if now.Sub(t) >= RATE_LIMIT_AUDIT_INTERVAL {
+			delete(r.audited, k)
+		}
+	}
+	r.mu.Unlock()
+
+	actor := SYSTEM_ACTOR
+	if strings.HasPrefix(key, "uid:") {
+		actor = strings.TrimPrefix(key, "uid:")
+	}
+	r.app.db.Audit(actor, AUDIT_RATE_LIMITED, 0, SEVERITY_WARNING, map[string]interface{}{
+		"limit":       name,
+		"key":         key,
+		"retry_after": retry.String(),
+	})
+}
+
+// Limit wraps a handler behind AuthWrapper in the named limit, applied to
+// the member and to their IP.
+func (r *RateLimits) Limit(name string, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys := []string{"ip:" + r.ClientIP(c)}
+		if claims, ok := c.Value(csh_auth.AuthKey).(csh_auth.CSHClaims); ok {
+			keys = append(keys, "uid:"+claims.UserInfo.Username)
+		}
+		if !r.Allow(c, name, keys...) {
+			return
+		}
+		handler(c)
+	}
+}
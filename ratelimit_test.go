@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTakeToken(t *testing.T) {
+	// 10 requests a minute, a token every 6 seconds
+	limit := RateLimit{10, time.Minute}
+
+	tests := []struct {
+		name        string
+		tokens      float64
+		elapsed     time.Duration
+		wantTokens  float64
+		wantAllowed bool
+	}{
+		{"full bucket", 10, 0, 9, true},
+		{"last token", 1, 0, 0, true},
+		{"empty bucket", 0, 0, -1, false},
+		{"debt stops at one token", -1, 0, -1, false},
+		{"partial refill isn't enough", 0, 3 * time.Second, -0.5, false},
+		{"refilled one token", 0, 6 * time.Second, 0, true},
+		{"refill out of debt", -1, 12 * time.Second, 0, true},
+		{"refill stops at the bucket size", 5, time.Hour, 9, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, allowed := limit.takeToken(tt.tokens, tt.elapsed)
+			if math.Abs(tokens-tt.wantTokens) > 1e-9 || allowed != tt.wantAllowed {
+				t.Errorf("takeToken(%v, %v) = %v, %v, want %v, %v",
+					tt.tokens, tt.elapsed, tokens, allowed, tt.wantTokens, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	limit := RateLimit{10, time.Minute}
+	if got := limit.retryAfter(-1); got != 12*time.Second {
+		t.Errorf("retryAfter(-1) = %v, want 12s", got)
+	}
+	if got := limit.retryAfter(0.5); got != 3*time.Second {
+		t.Errorf("retryAfter(0.5) = %v, want 3s", got)
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	limit := RateLimit{3, time.Minute}
+	m := NewMemoryLimiter()
+
+	for i := 0; i < 3; i++ {
+		if allowed, _, _ := m.Take("a", limit); !allowed {
+			t.Fatalf("request %d refused, want the first 3 allowed", i+1)
+		}
+	}
+	allowed, retry, err := m.Take("a", limit)
+	if err != nil || allowed {
+		t.Fatalf("Take() = %v, %v, want the 4th request refused", allowed, err)
+	}
+	if retry <= 0 || retry > limit.Per {
+		t.Errorf("retry after %v, want up to %v", retry, limit.Per)
+	}
+
+	if allowed, _, _ := m.Take("b", limit); !allowed {
+		t.Error("another key was refused, want buckets kept apart")
+	}
+
+	// Wind the bucket back so it has had time to refill
+	m.buckets["a"].updated = m.buckets["a"].updated.Add(-limit.Per)
+	if allowed, _, _ := m.Take("a", limit); !allowed {
+		t.Error("refilled bucket refused a request")
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := parseRateLimits("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != len(DEFAULT_RATE_LIMITS) || limits[LIMIT_DATA] != DEFAULT_RATE_LIMITS[LIMIT_DATA] {
+		t.Errorf("parseRateLimits(\"\") = %v, want the defaults", limits)
+	}
+
+	limits, err = parseRateLimits("data=5/1s, upload=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[LIMIT_DATA] != (RateLimit{5, time.Second}) {
+		t.Errorf("data = %v, want 5/1s", limits[LIMIT_DATA])
+	}
+	if _, ok := limits[LIMIT_UPLOAD]; ok {
+		t.Error("upload=0 didn't turn the limit off")
+	}
+	if limits[LIMIT_PUBLIC] != DEFAULT_RATE_LIMITS[LIMIT_PUBLIC] {
+		t.Errorf("public = %v, want the default", limits[LIMIT_PUBLIC])
+	}
+
+	for _, bad := range []string{
+		"data",
+		"nonsense=1/1m",
+		"data=5",
+		"data=0/1m",
+		"data=-1/1m",
+		"data=lots/1m",
+		"data=5/soon",
+		"data=5/0s",
+		"data=5/-1m",
+	} {
+		if _, err := parseRateLimits(bad); err == nil {
+			t.Errorf("parseRateLimits(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trusted) != 3 {
+		t.Fatalf("got %d networks, want 3", len(trusted))
+	}
+	for _, bad := range []string{"proxy.example.com", "10.0.0.0/33", "300.1.1.1"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &RateLimits{trusted: trusted}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer can't forward", "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed hops are ignored", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chained trusted proxies", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"several headers", "10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without a header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"garbage in the header", "10.0.0.1:1234", []string{"not-an-ip"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/public/data", nil)
+			c.Request.RemoteAddr = tt.remote
+			for _, value := range tt.xff {
+				c.Request.Header.Add("X-Forwarded-For", value)
+			}
+			if got := r.ClientIP(c); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,10 +8,13 @@ import (
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type PlugRoutes struct {
@@ -27,29 +30,99 @@ func protectedProfile(c *gin.Context) {
 	c.String(http.StatusOK, "uid %s email %s name %s uuid %s", claims.UserInfo.Username, claims.UserInfo.Email, claims.UserInfo.FullName, claims.UserInfo.Subject)
 }
 
+// requireAdmin returns the caller's claims if they may use the admin pages,
+// otherwise it redirects them away and returns false.
+func (r PlugRoutes) requireAdmin(c *gin.Context) (csh_auth.CSHClaims, bool) {
+	claims, ok := c.Value(csh_auth.AuthKey).(csh_auth.CSHClaims)
+	if !ok {
+		log.Fatal("error finding claims")
+		return claims, false
+	}
+
+	if !r.app.ldap.CheckIfAdmin(claims.UserInfo.Username) {
+		flash(c, FLASH_ERROR, "Only drink admins, RTPs and eboard can use the admin pages.")
+		c.Redirect(http.StatusFound, "/")
+		return claims, false
+	}
+	return claims, true
+}
+
 func (r PlugRoutes) index(c *gin.Context) {
 	c.Redirect(http.StatusFound, "/upload")
 }
 
-func (r PlugRoutes) action(c *gin.Context) {
-	plug := r.app.db.GetPlug()
-	url := r.app.s3.PresignPlug(plug)
-
+// servePlug picks a plug to show a member, counting the impression.
+func (r PlugRoutes) servePlug(c *gin.Context) (Plug, *url.URL, bool) {
 	claims, ok := c.Value(csh_auth.AuthKey).(csh_auth.CSHClaims)
 	if !ok {
 		log.Fatal("error finding claims")
-		return
 	}
+
+	site, known := r.requestSite(c)
+	return r.serve(c, claims.UserInfo.Username, site, known)
+}
+
+// serve picks a plug for viewer on site, counting the impression. If
+// there's nothing to show it responds with a 404 and returns false.
+func (r PlugRoutes) serve(c *gin.Context, viewer string, site Site, known bool) (Plug, *url.URL, bool) {
+	req := ServeRequest{Viewer: viewer}
+	if known {
+		req.SiteID = site.ID
+	}
+
+	plug, ok := r.app.db.GetPlug(req)
+	if !ok {
+		c.String(http.StatusNotFound, "No plugs to show!")
+		return Plug{}, nil, false
+	}
+	url := r.app.store.PresignPlug(plug)
+	r.app.metrics.RecordImpression(plug)
+	r.app.db.RecordImpression(plug, req)
+	r.app.frequency.Record(req.Viewer, plug)
+
 	log.WithFields(log.Fields{
-		"uid":           claims.UserInfo.Username,
+		"uid":           viewer,
 		"plug_id":       plug.ID,
 		"plug_s3id":     plug.S3ID,
 		"presigned_uri": url.String(),
 	}).Info("Presigned URI Generated")
-	r.app.db.AddLog(13, c.GetHeader("Referer"))
+	r.app.db.Audit(viewer, AUDIT_PLUG_SERVED, plug.ID, SEVERITY_DEBUG, map[string]interface{}{
+		"referer": c.GetHeader("Referer"),
+		"site":    site.Host,
+	})
+	return plug, url, true
+}
+
+func (r PlugRoutes) action(c *gin.Context) {
+	_, url, ok := r.servePlug(c)
+	if !ok {
+		return
+	}
 	c.Redirect(http.StatusFound, url.String())
 }
 
+// action_json serves a plug along with the text embedding sites need to
+// render it accessibly.
+func (r PlugRoutes) action_json(c *gin.Context) {
+	plug, url, ok := r.servePlug(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, plugJSON(plug, url))
+}
+
+func plugJSON(plug Plug, url *url.URL) gin.H {
+	return gin.H{
+		"id":          plug.ID,
+		"url":         url.String(),
+		"title":       plug.Title,
+		"alt":         plug.Alt(),
+		"description": plug.Description,
+		"width":       PLUG_WIDTH,
+		"height":      PLUG_HEIGHT,
+	}
+}
+
 func (r PlugRoutes) upload(c *gin.Context) {
 	plug := Plug{}
 
@@ -61,59 +134,98 @@ func (r PlugRoutes) upload(c *gin.Context) {
 
 	plug.Owner = claims.UserInfo.Username
 
-	file, err := c.FormFile("fileUpload")
-	if err != nil {
-		log.Error(err)
-		c.String(http.StatusBadRequest, "Error Reading File")
+	if group := c.PostForm("ownerGroup"); group != "" {
+		allowed := r.app.ManageableGroups(r.app.ldap.GetUserGroups(plug.Owner))
+		for _, g := range allowed {
+			if g == group {
+				plug.Group = group
+			}
+		}
+		if plug.Group == "" {
+			c.String(http.StatusForbidden, "You can't upload plugs for that group!")
+			return
+		}
+	}
+
+	if !plugTextFromForm(c, &plug) {
 		return
 	}
-	data, err := file.Open()
-	if err != nil {
-		log.Error(err)
-		c.String(http.StatusBadRequest, "Error Reading File")
+
+	endsAt, err := parseEndDate(c.PostForm("endDate"))
+	plug.EndsAt = endsAt
+	if err != nil || (plug.EndsAt != nil && !plug.EndsAt.After(time.Now())) {
+		c.String(http.StatusBadRequest, "Please pick an end date in the future!")
+		return
+	}
+	plug.Paced = plug.EndsAt != nil && c.PostForm("paced") == "on"
+
+	file, data, mime, ok := readPlugImage(c)
+	if !ok {
 		return
 	}
 	defer data.Close()
-	imageData, _, err := image.DecodeConfig(data)
+
+	numCredits, err := strconv.Atoi(c.PostForm("numCredits"))
 	if err != nil {
 		log.Error(err)
-		c.String(http.StatusUnsupportedMediaType, "Please upload either a JPG or PNG!")
+		c.String(http.StatusUnsupportedMediaType, "Specify numCredits")
+		return
+	}
+	siteIDs := siteIdsFromForm(c)
+	quote := r.app.Quote(plug.Owner, siteIDs, numCredits)
+	if !checkQuote(c, quote) {
 		return
 	}
-	data.Seek(0, 0)
-	if imageData.Width == 728 && imageData.Height == 200 {
-		numCredits, err := strconv.Atoi(c.PostForm("numCredits"))
-		if err != nil {
-			log.Error(err)
-			c.String(http.StatusUnsupportedMediaType, "Specify numCredits")
-			return
-		}
-		if numCredits < 0 {
-			log.Error(err)
-			c.String(http.StatusBadRequest, "Can't specify negative credits!")
-		}
-		mime := getMime(data)
-		data.Seek(0, 0)
 
-		if !r.app.ldap.DecrementCredits(plug.Owner, numCredits) {
-			c.String(http.StatusPaymentRequired, "Get More Credits!")
-			return
-		}
+	if !r.app.ldap.DecrementCredits(plug.Owner, numCredits) {
+		c.String(http.StatusPaymentRequired, "Get More Credits!")
+		return
+	}
 
-		plug.ViewsRemaining = numCredits * PlugValueInDrinkCredits(r.app.ldap, claims.UserInfo.Username)
+	plug.ViewsRemaining = quote.Views
+	plug.CreditsPaid = numCredits
+	plug.ViewsPurchased = plug.ViewsRemaining
 
-		plug.S3ID = time.Now().Format("2006/01/02/150405") + "-" + plug.Owner + "-" + file.Filename
-		r.app.s3.AddFile(plug, data, mime)
+	plug.S3ID = time.Now().Format("2006/01/02/150405") + "-" + plug.Owner + "-" + file.Filename
+	plug.ImageSize = file.Size
+	plug.ContentType = mime
+	r.app.store.AddFile(plug, data, mime)
 
-		r.app.db.MakePlug(plug)
-	} else {
-		log.Error("invalid file dimensions")
-		c.String(http.StatusBadRequest, "Please upload a 728x200 pixel image!")
+	plug.ID, err = r.app.db.MakePlug(plug)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uid":       plug.Owner,
+			"plug_s3id": plug.S3ID,
+			"credits":   numCredits,
+		}).Error("Failed to save uploaded plug: ", err)
+		if err := r.app.store.DelFile(plug); err != nil {
+			log.Error(err)
+		}
+		// Nothing was bought, so there's no ledger entry to refund later
+		if !r.app.ldap.IncrementCredits(plug.Owner, numCredits) {
+			log.WithFields(log.Fields{
+				"uid":     plug.Owner,
+				"credits": numCredits,
+			}).Error("Failed to return credits for a plug that wasn't saved")
+			c.String(http.StatusInternalServerError, "Your plug couldn't be saved and your credits couldn't be returned, please contact an admin.")
+			return
+		}
+		c.String(http.StatusInternalServerError, "Your plug couldn't be saved, your credits have been returned.")
 		return
 	}
-	r.app.db.AddLog(1, "uid: "+plug.Owner+"uploaded plug s3id"+plug.S3ID)
-	c.HTML(http.StatusOK, "success.tmpl", gin.H{
-		"plug_s3url": r.app.s3.PresignPlug(plug).String(),
+	if len(siteIDs) > 0 {
+		r.app.db.SetPlugSites(plug, siteIDs)
+	}
+	r.app.RecordPurchase(plug.Owner, plug, numCredits, plug.ViewsRemaining)
+
+	r.app.db.Audit(plug.Owner, AUDIT_PLUG_UPLOADED, plug.ID, SEVERITY_INFO, map[string]interface{}{
+		"s3id":  plug.S3ID,
+		"views": plug.ViewsRemaining,
+		"group": plug.Group,
+	})
+	r.app.webhooks.Emit(EVENT_PLUG_UPLOADED, plug, plug.Owner, nil)
+	r.page(c, "success.tmpl", gin.H{
+		"plug_s3url": r.app.store.PresignPlug(plug).String(),
 	})
 	log.WithFields(log.Fields{
 		"uid":       claims.UserInfo.Username,
@@ -129,94 +241,177 @@ func (r PlugRoutes) upload_view(c *gin.Context) {
 		return
 	}
 
-	plugs := r.app.db.GetUserPlugs(claims.UserInfo.Username)
+	memberOf := r.app.ldap.GetUserGroups(claims.UserInfo.Username)
+	plugs := r.app.db.GetUserPlugs(claims.UserInfo.Username, memberOf)
 	var out_plugs []Plug
+	var ids []int
 
 	for _, plug := range plugs {
 		new := plug
-		new.PresignedURL = r.app.s3.PresignPlug(plug).String()
+		new.PresignedURL = r.app.store.PresignPlug(plug).String()
 		out_plugs = append(out_plugs, new)
+		ids = append(ids, plug.ID)
+	}
+	r.app.db.AttachPlugSites(out_plugs)
+
+	// Archived plugs keep their image until it's purged under the retention
+	// policy
+	var past_plugs []Plug
+	for _, plug := range r.app.db.GetUserArchivedPlugs(claims.UserInfo.Username, memberOf) {
+		if plug.ImagePurgedAt == nil {
+			plug.PresignedURL = r.app.store.PresignPlug(plug).String()
+		}
+		past_plugs = append(past_plugs, plug)
+		ids = append(ids, plug.ID)
+	}
+
+	// Quote one credit up front, the page asks /quote as the form changes
+	rules := r.app.db.GetPricingRules()
+	now := time.Now()
+	topups := make(map[int]Quote)
+	for _, plug := range out_plugs {
+		topups[plug.ID] = QuoteViews(rules, memberOf, plug.SiteIDs(), 1, now)
 	}
-	c.HTML(http.StatusOK, "upload.tmpl", gin.H{
-		"plugs":      out_plugs,
-		"plug_value": PlugValueInDrinkCredits(r.app.ldap, claims.UserInfo.Username),
+
+	r.page(c, "upload.tmpl", gin.H{
+		"plugs":         out_plugs,
+		"past_plugs":    past_plugs,
+		"quote":         QuoteViews(rules, memberOf, nil, 1, now),
+		"topup_quotes":  topups,
+		"sites":         r.app.db.GetSites(),
+		"impressions":   r.app.db.PlugImpressionReport(ids),
+		"owner_groups":  r.app.ManageableGroups(memberOf),
+		"email_opt_out": r.app.db.GetEmailOptOut(claims.UserInfo.Username),
 	})
 }
 
-func (r PlugRoutes) get_pending_plugs(c *gin.Context) {
-	claims, ok := c.Value(csh_auth.AuthKey).(csh_auth.CSHClaims)
+func (r PlugRoutes) plug_deletion(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
 	if !ok {
-		log.Fatal("error finding claims")
 		return
 	}
 
-	if !r.app.ldap.CheckIfAdmin(claims.UserInfo.Username) {
-		c.Redirect(http.StatusFound, "/")
-		return
-	}
-	plugs := r.app.db.GetPendingPlugs()
-	var out_plugs []Plug
+	id, err := strconv.Atoi(c.Param("id"))
 
-	for _, plug := range plugs {
-		new := plug
-		new.PresignedURL = r.app.s3.PresignPlug(plug).String()
-		out_plugs = append(out_plugs, new)
+	if err != nil {
+		log.Error(err)
 	}
-	c.HTML(http.StatusOK, "view_plugs.tmpl", gin.H{
-		"plugs": out_plugs,
-	})
-}
 
-func (r PlugRoutes) plug_approval(c *gin.Context) {
-	claims, ok := c.Value(csh_auth.AuthKey).(csh_auth.CSHClaims)
+	plug, ok := r.app.db.GetPlugById(id)
 	if !ok {
-		log.Fatal("error finding claims")
+		c.String(http.StatusNotFound, "No such plug!")
 		return
 	}
 
-	if !r.app.ldap.CheckIfAdmin(claims.UserInfo.Username) {
-		c.Redirect(http.StatusFound, "/")
+	if plug.ClaimedByOther(claims.UserInfo.Username) {
+		flash(c, FLASH_ERROR, "Someone else is reviewing that plug.")
+		c.Redirect(http.StatusFound, "/admin")
 		return
 	}
 
-	var plugList PlugList
-	c.Bind(&plugList)
+	r.app.RemovePlug(plug, claims.UserInfo.Username, c.PostForm("reason-"+c.Param("id")))
 
-	log.WithFields(log.Fields{
-		"uid":            claims.UserInfo.Username,
-		"plugs_approved": strings.Join(plugList.Data, ","),
-	}).Info("Changed Approved Plug List")
-
-	r.app.db.AddLog(1, "uid: "+claims.UserInfo.Username+"approved: "+strings.Join(plugList.Data, ","))
-
-	r.app.db.SetPendingPlugs(plugList.Data)
+	flash(c, FLASH_SUCCESS, "Plug deleted.")
 	c.Redirect(http.StatusFound, "/admin")
 }
 
-func (r PlugRoutes) plug_deletion(c *gin.Context) {
-	claims, ok := c.Value(csh_auth.AuthKey).(csh_auth.CSHClaims)
+// plug_rejection turns down a plug awaiting review, refunding its owner and
+// telling them why.
+func (r PlugRoutes) plug_rejection(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
 	if !ok {
-		log.Fatal("error finding claims")
 		return
 	}
 
-	if !r.app.ldap.CheckIfAdmin(claims.UserInfo.Username) {
-		c.Redirect(http.StatusFound, "/")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid plug id!")
 		return
 	}
 
-	id, err := strconv.Atoi(c.Param("id"))
+	reason := strings.TrimSpace(c.PostForm("reason-" + c.Param("id")))
+	if reason == "" {
+		flash(c, FLASH_ERROR, "Please give a reason for rejecting the plug.")
+		c.Redirect(http.StatusFound, "/admin")
+		return
+	}
 
-	if err != nil {
-		log.Error(err)
+	plug, ok := r.app.db.GetPlugById(id)
+	if !ok || plug.IsDefault() {
+		c.String(http.StatusNotFound, "No such plug!")
+		return
+	}
+	if plug.Approved {
+		flash(c, FLASH_ERROR, "That plug is already approved, delete it instead.")
+		c.Redirect(http.StatusFound, "/admin")
+		return
+	}
+	if plug.ClaimedByOther(claims.UserInfo.Username) {
+		flash(c, FLASH_ERROR, "Someone else is reviewing that plug.")
+		c.Redirect(http.StatusFound, "/admin")
+		return
 	}
 
-	r.app.db.AddLog(1, "uid: "+claims.UserInfo.Username+" deleted: "+c.Param("id"))
-	r.app.db.DeletePlug(r.app.db.GetPlugById(id))
+	r.app.RejectPlug(plug, claims.UserInfo.Username, reason)
 
+	flash(c, FLASH_SUCCESS, "Plug rejected.")
 	c.Redirect(http.StatusFound, "/admin")
 }
 
+// plugTextFromForm reads the title, alt text and description given with a
+// plug, writing an error response and returning false if they're unusable.
+func plugTextFromForm(c *gin.Context, plug *Plug) bool {
+	plug.Title = strings.TrimSpace(c.PostForm("title"))
+	plug.AltText = strings.TrimSpace(c.PostForm("altText"))
+	plug.Description = strings.TrimSpace(c.PostForm("description"))
+	if plug.AltText == "" {
+		c.String(http.StatusBadRequest, "Please describe your plug in the alt text!")
+		return false
+	}
+	if utf8.RuneCountInString(plug.Title) > MAX_TITLE_LENGTH ||
+		utf8.RuneCountInString(plug.AltText) > MAX_ALT_TEXT_LENGTH ||
+		utf8.RuneCountInString(plug.Description) > MAX_DESCRIPTION_LENGTH {
+		c.String(http.StatusBadRequest, "Your title, alt text or description is too long!")
+		return false
+	}
+	return true
+}
+
+// readPlugImage opens the uploaded plug image and checks it's a PNG or JPG
+// of the right size. It writes an error response and returns false if not,
+// otherwise the caller must close the file.
+func readPlugImage(c *gin.Context) (*multipart.FileHeader, multipart.File, string, bool) {
+	file, err := c.FormFile("fileUpload")
+	if err != nil {
+		log.Error(err)
+		c.String(http.StatusBadRequest, "Error Reading File")
+		return nil, nil, "", false
+	}
+	data, err := file.Open()
+	if err != nil {
+		log.Error(err)
+		c.String(http.StatusBadRequest, "Error Reading File")
+		return nil, nil, "", false
+	}
+	imageData, _, err := image.DecodeConfig(data)
+	if err != nil {
+		log.Error(err)
+		data.Close()
+		c.String(http.StatusUnsupportedMediaType, "Please upload either a JPG or PNG!")
+		return nil, nil, "", false
+	}
+	if imageData.Width != PLUG_WIDTH || imageData.Height != PLUG_HEIGHT {
+		log.Error("invalid file dimensions")
+		data.Close()
+		c.String(http.StatusBadRequest, "Please upload a 728x200 pixel image!")
+		return nil, nil, "", false
+	}
+	data.Seek(0, 0)
+	mime := getMime(data)
+	data.Seek(0, 0)
+	return file, data, mime, true
+}
+
 func getMime(data io.Reader) string {
 	buffer := make([]byte, 512)
 	n, err := data.Read(buffer)
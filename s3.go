@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"github.com/minio/minio-go"
 	log "github.com/sirupsen/logrus"
 	"io"
@@ -9,10 +10,13 @@ import (
 )
 
 type S3Connection struct {
+	app *PlugApplication
 	con *minio.Client
 }
 
-func (c *S3Connection) Init(host, access, secret string) {
+func (c *S3Connection) Init(app *PlugApplication, host, access, secret string) {
+	c.app = app
+
 	s3, err := minio.NewV2(host, access, secret, true)
 	if err != nil {
 		log.Fatal(err)
@@ -20,8 +24,27 @@ func (c *S3Connection) Init(host, access, secret string) {
 	c.con = s3
 }
 
+func (c S3Connection) Name() string {
+	return OBJECT_STORE_S3
+}
+
+func (c S3Connection) CheckAlive() error {
+	start := time.Now()
+	exists, err := c.con.BucketExists("plugs")
+	c.app.metrics.ObserveDependency("s3", "ping", start, err)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("bucket plugs does not exist")
+	}
+	return nil
+}
+
 func (c S3Connection) PresignPlug(plug Plug) *url.URL {
+	start := time.Now()
 	presignedURL, err := c.con.PresignedGetObject("plugs", plug.S3ID, time.Duration(60)*time.Second, make(url.Values))
+	c.app.metrics.ObserveDependency("s3", "presign", start, err)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -32,15 +55,102 @@ func (c S3Connection) PresignPlug(plug Plug) *url.URL {
 func (c S3Connection) AddFile(plug Plug, data io.Reader, mime string) {
 	opts := new(minio.PutObjectOptions)
 	opts.ContentType = mime
+	start := time.Now()
 	_, err := c.con.PutObject("plugs", plug.S3ID, data, -1, *opts)
+	c.app.metrics.ObserveDependency("s3", "put_object", start, err)
 	if err != nil {
 		log.Error(err)
 	}
 }
 
-func (c S3Connection) DelFile(plug Plug) {
+func (c S3Connection) DelFile(plug Plug) error {
+	start := time.Now()
 	err := c.con.RemoveObject("plugs", plug.S3ID)
+	c.app.metrics.ObserveDependency("s3", "remove_object", start, err)
 	if err != nil {
 		log.Error(err)
 	}
+	return err
+}
+
+// StatObject looks up the size and type of the object stored under s3id.
+func (c S3Connection) StatObject(s3id string) (ObjectInfo, error) {
+	start := time.Now()
+	info, err := c.con.StatObject("plugs", s3id, minio.StatObjectOptions{})
+	c.app.metrics.ObserveDependency("s3", "stat_object", start, err)
+	return objectInfo(info), err
+}
+
+// GetObject opens the object stored under s3id, which the caller must close.
+func (c S3Connection) GetObject(s3id string) (io.ReadCloser, error) {
+	start := time.Now()
+	obj, err := c.con.GetObject("plugs", s3id, minio.GetObjectOptions{})
+	c.app.metrics.ObserveDependency("s3", "get_object", start, err)
+	return obj, err
+}
+
+// PutObject stores size bytes from data under s3id.
+func (c S3Connection) PutObject(s3id string, data io.Reader, size int64, mime string) error {
+	start := time.Now()
+	_, err := c.con.PutObject("plugs", s3id, data, size, minio.PutObjectOptions{ContentType: mime})
+	c.app.metrics.ObserveDependency("s3", "put_object", start, err)
+	return err
+}
+
+// IsEmpty reports whether there are no objects in the bucket.
+func (c S3Connection) IsEmpty() (bool, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	start := time.Now()
+	for obj := range c.con.ListObjectsV2("plugs", "", true, done) {
+		c.app.metrics.ObserveDependency("s3", "list_objects", start, obj.Err)
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		return false, nil
+	}
+	c.app.metrics.ObserveDependency("s3", "list_objects", start, nil)
+	return true, nil
+}
+
+// ListObjects lists everything in the bucket. Listings don't include
+// content types, see StatObject.
+func (c S3Connection) ListObjects() ([]ObjectInfo, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	start := time.Now()
+	var objects []ObjectInfo
+	for obj := range c.con.ListObjectsV2("plugs", "", true, done) {
+		if obj.Err != nil {
+			c.app.metrics.ObserveDependency("s3", "list_objects", start, obj.Err)
+			return nil, obj.Err
+		}
+		objects = append(objects, objectInfo(obj))
+	}
+	c.app.metrics.ObserveDependency("s3", "list_objects", start, nil)
+	return objects, nil
+}
+
+func objectInfo(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+	}
+}
+
+// SetContentType replaces the content type an object is served with by
+// copying it over itself.
+func (c S3Connection) SetContentType(s3id, mime string) error {
+	dst, err := minio.NewDestinationInfo("plugs", s3id, nil, map[string]string{"Content-Type": mime})
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = c.con.CopyObject(dst, minio.NewSourceInfo("plugs", s3id, nil))
+	c.app.metrics.ObserveDependency("s3", "copy_object", start, err)
+	return err
 }
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sites are the CSH hosts (or named placements on them) which show plugs.
+// Owners can restrict a plug to some of them, plugs without any sites are
+// shown everywhere.
+
+// How far back the admin site report looks
+const SITE_REPORT_DAYS = 30
+
+const SQL_CREATE_SITES_TABLE = `CREATE TABLE sites (
+id              SERIAL PRIMARY KEY,
+host            VARCHAR(253) NOT NULL UNIQUE,
+name            VARCHAR(64) NOT NULL,
+created         TIMESTAMP NOT NULL
+);`
+
+const SQL_CREATE_PLUG_SITES_TABLE = `CREATE TABLE plug_sites (
+plug_id         INTEGER NOT NULL REFERENCES plugs(id) ON DELETE CASCADE,
+site_id         INTEGER NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+PRIMARY KEY (plug_id, site_id)
+);`
+
+// Daily impression counts. site_id is 0 for requests from unknown sites, and
+// neither column references its table so history outlives plugs and sites.
+const SQL_CREATE_IMPRESSIONS_TABLE = `CREATE TABLE impressions (
+day             DATE NOT NULL,
+plug_id         INTEGER NOT NULL,
+site_id         INTEGER NOT NULL,
+count           INTEGER NOT NULL,
+PRIMARY KEY (day, plug_id, site_id)
+);`
+
+const SQL_INSERT_SITE = `INSERT INTO sites (host, name, created)
+VALUES ($1::text, $2::text, $3)
+ON CONFLICT (host) DO NOTHING`
+
+const SQL_RETRIEVE_SITES = `SELECT id, host, name, token FROM sites ORDER BY name, host`
+
+const SQL_RETRIEVE_SITE_BY_HOST = `SELECT id, host, name, token FROM sites WHERE host=$1::text`
+
+const SQL_DELETE_SITE = `DELETE FROM sites WHERE id=$1::integer`
+
+const SQL_RETRIEVE_PLUG_SITES = `SELECT ps.plug_id, s.id, s.host, s.name
+FROM plug_sites ps JOIN sites s ON s.id = ps.site_id
+WHERE ps.plug_id = ANY($1::integer[])
+ORDER BY s.name, s.host`
+
+const SQL_CLEAR_PLUG_SITES = `DELETE FROM plug_sites WHERE plug_id=$1::integer`
+
+const SQL_ADD_PLUG_SITES = `INSERT INTO plug_sites (plug_id, site_id)
+SELECT $1::integer, id FROM sites WHERE id = ANY($2::integer[])`
+
+const SQL_RECORD_IMPRESSION = `INSERT INTO impressions (day, plug_id, site_id, count)
+VALUES ($1::date, $2::integer, $3::integer, 1)
+ON CONFLICT (day, plug_id, site_id) DO UPDATE SET count = impressions.count + 1`
+
+const SQL_SITE_IMPRESSION_REPORT = `SELECT i.site_id, COALESCE(s.host, ''), SUM(i.count)
+FROM impressions i LEFT JOIN sites s ON s.id = i.site_id
+WHERE i.day >= $1::date
+GROUP BY i.site_id, s.host
+ORDER BY SUM(i.count) DESC`
+
+const SQL_PLUG_IMPRESSION_REPORT = `SELECT i.plug_id, i.site_id, COALESCE(s.host, ''), SUM(i.count)
+FROM impressions i LEFT JOIN sites s ON s.id = i.site_id
+WHERE i.plug_id = ANY($1::integer[])
+GROUP BY i.plug_id, i.site_id, s.host
+ORDER BY SUM(i.count) DESC`
+
+type Site struct {
+	ID   int
+	Host string
+	Name string
+	// API token for serving plugs to logged out visitors, see publicSite
+	Token string
+}
+
+// SiteImpressions is one row of an impressions-by-site report. Host is empty
+// for requests that didn't come from a known site.
+type SiteImpressions struct {
+	SiteID      int
+	Host        string
+	Impressions int
+}
+
+// ServeRequest describes where a plug is about to be shown.
+type ServeRequest struct {
+	// Zero when the request didn't come from a known site, in which case
+	// only unrestricted plugs are eligible.
+	SiteID int
+	// Who'll see the plug, for frequency capping
+	Viewer string
+}
+
+// normalizeHost lower cases a host and strips any port.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// requestSite works out which site a plug request is for, preferring an
+// explicit site query parameter (so one host can have several placements)
+// and falling back to the Referer's host.
+func (r PlugRoutes) requestSite(c *gin.Context) (Site, bool) {
+	host := c.Query("site")
+	if host == "" {
+		referer, err := url.Parse(c.GetHeader("Referer"))
+		if err != nil {
+			return Site{}, false
+		}
+		host = referer.Host
+	}
+	if host == "" {
+		return Site{}, false
+	}
+	return r.app.db.GetSiteByHost(normalizeHost(host))
+}
+
+func (c DBConnection) querySites(operation, query string, args ...interface{}) []Site {
+	start := time.Now()
+	rows, err := c.con.Query(query, args...)
+	c.app.metrics.ObserveDependency("postgres", operation, start, err)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var sites []Site
+	for rows.Next() {
+		var obj Site
+		err = rows.Scan(&obj.ID, &obj.Host, &obj.Name, &obj.Token)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		sites = append(sites, obj)
+	}
+	return sites
+}
+
+func (c DBConnection) GetSites() []Site {
+	return c.querySites("get_sites", SQL_RETRIEVE_SITES)
+}
+
+func (c DBConnection) GetSiteByHost(host string) (Site, bool) {
+	sites := c.querySites("get_site_by_host", SQL_RETRIEVE_SITE_BY_HOST, host)
+	if len(sites) == 0 {
+		return Site{}, false
+	}
+	return sites[0], true
+}
+
+func (c DBConnection) MakeSite(site Site) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_INSERT_SITE, site.Host, site.Name, time.Now())
+	c.app.metrics.ObserveDependency("postgres", "make_site", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (c DBConnection) DeleteSite(id int) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_DELETE_SITE, id)
+	c.app.metrics.ObserveDependency("postgres", "delete_site", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// SiteIDs lists the sites the plug is restricted to, once AttachPlugSites
+// has filled them in.
+func (p Plug) SiteIDs() []int {
+	var ids []int
+	for _, site := range p.Sites {
+		ids = append(ids, site.ID)
+	}
+	return ids
+}
+
+// AttachPlugSites fills in the sites each plug is restricted to.
+func (c DBConnection) AttachPlugSites(plugs []Plug) {
+	var ids []int
+	for _, plug := range plugs {
+		ids = append(ids, plug.ID)
+	}
+
+	start := time.Now()
+	rows, err := c.con.Query(SQL_RETRIEVE_PLUG_SITES, pq.Array(ids))
+	c.app.metrics.ObserveDependency("postgres", "get_plug_sites", start, err)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer rows.Close()
+
+	sites := make(map[int][]Site)
+	for rows.Next() {
+		var id int
+		var obj Site
+		err = rows.Scan(&id, &obj.ID, &obj.Host, &obj.Name)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		sites[id] = append(sites[id], obj)
+	}
+	for i := range plugs {
+		plugs[i].Sites = sites[plugs[i].ID]
+	}
+}
+
+// SetPlugSites restricts plug to the given sites, or lifts the restriction
+// if there are none.
+func (c DBConnection) SetPlugSites(plug Plug, siteIDs []int) {
+	tx, err := c.con.Begin()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	start := time.Now()
+	_, err = tx.Exec(SQL_CLEAR_PLUG_SITES, plug.ID)
+	if err == nil && len(siteIDs) > 0 {
+		_, err = tx.Exec(SQL_ADD_PLUG_SITES, plug.ID, pq.Array(siteIDs))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	c.app.metrics.ObserveDependency("postgres", "set_plug_sites", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (c DBConnection) RecordImpression(plug Plug, req ServeRequest) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_RECORD_IMPRESSION, time.Now().Format("2006-01-02"), plug.ID, req.SiteID)
+	c.app.metrics.ObserveDependency("postgres", "record_impression", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// SiteImpressionReport totals impressions of all plugs by site since the
+// given time.
+func (c DBConnection) SiteImpressionReport(since time.Time) []SiteImpressions {
+	start := time.Now()
+	rows, err := c.con.Query(SQL_SITE_IMPRESSION_REPORT, since.Format("2006-01-02"))
+	c.app.metrics.ObserveDependency("postgres", "site_impression_report", start, err)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var report []SiteImpressions
+	for rows.Next() {
+		var obj SiteImpressions
+		err = rows.Scan(&obj.SiteID, &obj.Host, &obj.Impressions)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		report = append(report, obj)
+	}
+	return report
+}
+
+// PlugImpressionReport breaks down each plug's lifetime impressions by site.
+func (c DBConnection) PlugImpressionReport(ids []int) map[int][]SiteImpressions {
+	report := make(map[int][]SiteImpressions)
+	start := time.Now()
+	rows, err := c.con.Query(SQL_PLUG_IMPRESSION_REPORT, pq.Array(ids))
+	c.app.metrics.ObserveDependency("postgres", "plug_impression_report", start, err)
+	if err != nil {
+		log.Error(err)
+		return report
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var obj SiteImpressions
+		err = rows.Scan(&id, &obj.SiteID, &obj.Host, &obj.Impressions)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		report[id] = append(report[id], obj)
+	}
+	return report
+}
+
+// siteIdsFromForm reads the sites[] checkboxes on the upload and owner
+// pages.
+func siteIdsFromForm(c *gin.Context) []int {
+	return parsePlugIds(c.PostFormArray("sites[]"))
+}
+
+func (r PlugRoutes) sites_view(c *gin.Context) {
+	if _, ok := r.requireAdmin(c); !ok {
+		return
+	}
+
+	sites := r.app.db.GetSites()
+	placements := make(map[int]string)
+	for _, site := range sites {
+		placements[site.ID] = r.app.public.PlacementURL(r.app.notifier.public_url, site)
+	}
+
+	r.page(c, "sites.tmpl", gin.H{
+		"sites":       sites,
+		"placements":  placements,
+		"report":      r.app.db.SiteImpressionReport(time.Now().AddDate(0, 0, -SITE_REPORT_DAYS)),
+		"report_days": SITE_REPORT_DAYS,
+	})
+}
+
+func (r PlugRoutes) site_create(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	site := Site{
+		Host: normalizeHost(c.PostForm("host")),
+		Name: strings.TrimSpace(c.PostForm("name")),
+	}
+	if site.Host == "" || strings.ContainsAny(site.Host, "/ ") {
+		c.String(http.StatusBadRequest, "Please give a host name such as members.csh.rit.edu!")
+		return
+	}
+	if site.Name == "" {
+		site.Name = site.Host
+	}
+
+	r.app.db.MakeSite(site)
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_SITE_CREATED, 0, SEVERITY_INFO, map[string]interface{}{
+		"host": site.Host,
+		"name": site.Name,
+	})
+	flash(c, FLASH_SUCCESS, "Site "+site.Host+" added.")
+	c.Redirect(http.StatusFound, "/admin/sites")
+}
+
+func (r PlugRoutes) site_deletion(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid site id!")
+		return
+	}
+
+	r.app.db.DeleteSite(id)
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_SITE_DELETED, 0, SEVERITY_INFO, map[string]interface{}{
+		"site_id": id,
+	})
+	flash(c, FLASH_SUCCESS, "Site deleted.")
+	c.Redirect(http.StatusFound, "/admin/sites")
+}
+
+// plug_sites changes which sites an owner's plug is shown on.
+func (r PlugRoutes) plug_sites(c *gin.Context) {
+	claims, plug, ok := r.ownedPlug(c)
+	if !ok {
+		return
+	}
+
+	siteIDs := siteIdsFromForm(c)
+	r.app.db.SetPlugSites(plug, siteIDs)
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_PLUG_SITES_SET, plug.ID, SEVERITY_INFO, map[string]interface{}{
+		"sites": siteIDs,
+	})
+	flash(c, FLASH_SUCCESS, "Plug sites saved.")
+	c.Redirect(http.StatusFound, "/upload")
+}
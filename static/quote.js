@@ -0,0 +1,35 @@
+// Keeps the price shown on purchase forms up to date. The views quoted are
+// sent with the form so the server can refuse the purchase if the price
+// changed before it was submitted.
+document.querySelectorAll('form[data-quote]').forEach(function (form) {
+    var display = form.querySelector('.quote');
+    var quoted = form.querySelector('input[name=quotedViews]');
+
+    function update() {
+        var params = new URLSearchParams();
+        params.append('numCredits', form.elements.numCredits.value);
+        if (form.dataset.plug) {
+            params.append('plug', form.dataset.plug);
+        }
+        form.querySelectorAll('input[name="sites[]"]:checked').forEach(function (site) {
+            params.append('sites[]', site.value);
+        });
+
+        fetch('/quote?' + params.toString(), { credentials: 'same-origin' })
+            .then(function (response) { return response.json(); })
+            .then(function (quote) {
+                if (quote.error) {
+                    display.textContent = quote.error;
+                    return;
+                }
+                quoted.value = quote.views;
+                display.textContent = quote.credits + ' credit(s) buys ' + quote.views + ' view(s)';
+            });
+    }
+
+    form.addEventListener('input', function (event) {
+        if (event.target.name === 'numCredits' || event.target.name === 'sites[]') {
+            update();
+        }
+    });
+});
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+	csh_auth "github.com/liam-middlebrook/csh-auth"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"net/http"
+	"path/filepath"
+)
+
+// Every page is templates/layouts/base.tmpl wrapped around one of
+// templates/*.tmpl, which defines the "title", "content" and optionally
+// "scripts" blocks. Handlers render pages with PlugRoutes.page, which adds
+// navigation for the member's roles and any flash messages left for them by
+// an earlier request, usually the one that redirected them here.
+
+// Template every page is executed through
+const PAGE_LAYOUT = "base"
+
+const (
+	ROLE_MEMBER = "member"
+	ROLE_ADMIN  = "admin"
+)
+
+// Kinds of flash message, which are also the alert classes they're shown with
+const (
+	FLASH_SUCCESS = "success"
+	FLASH_INFO    = "info"
+	FLASH_ERROR   = "danger"
+)
+
+const (
+	FLASH_COOKIE = "plug_flash"
+	// Flash messages nobody comes back to see are dropped after this long
+	FLASH_MAX_AGE = 300
+	// Most flash messages kept waiting, so the cookie stays small
+	FLASH_LIMIT = 5
+)
+
+type navItem struct {
+	Title string
+	Path  string
+	// Role needed to see the link
+	Role string
+}
+
+var NAV_ITEMS = []navItem{
+	{"Upload", "/upload", ROLE_MEMBER},
+	{"Admin", "/admin", ROLE_ADMIN},
+	{"House Ads", "/admin/house", ROLE_ADMIN},
+	{"Logs", "/admin/logs", ROLE_ADMIN},
+	{"Sites", "/admin/sites", ROLE_ADMIN},
+	{"Pricing", "/admin/pricing", ROLE_ADMIN},
+	{"Webhooks", "/admin/webhooks", ROLE_ADMIN},
+}
+
+// NavLink is a navigation bar entry as shown on a page
+type NavLink struct {
+	Title  string
+	Path   string
+	Active bool
+}
+
+type Flash struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// PageRender is the router's HTMLRender, executing each page's template set
+// through the base layout.
+type PageRender struct {
+	pages map[string]*template.Template
+}
+
+// loadPages parses every page in dir along with the layouts.
+func loadPages(dir string) PageRender {
+	p := PageRender{pages: make(map[string]*template.Template)}
+	layouts, err := filepath.Glob(filepath.Join(dir, "layouts", "*.tmpl"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	pages, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, page := range pages {
+		files := append(append([]string{}, layouts...), page)
+		p.pages[filepath.Base(page)] = template.Must(template.ParseFiles(files...))
+	}
+	return p
+}
+
+func (p PageRender) Instance(name string, data interface{}) render.Render {
+	tmpl, ok := p.pages[name]
+	if !ok {
+		log.Error("No such page template: ", name)
+		tmpl = template.New(name)
+	}
+	return render.HTML{Template: tmpl, Name: PAGE_LAYOUT, Data: data}
+}
+
+// Roles lists what uid may do, which decides the navigation they see.
+func (a *PlugApplication) Roles(uid string) []string {
+	roles := []string{ROLE_MEMBER}
+	if a.ldap.CheckIfAdmin(uid) {
+		roles = append(roles, ROLE_ADMIN)
+	}
+	return roles
+}
+
+// navLinks builds the navigation bar for a member with roles, marking the
+// link to path active.
+func navLinks(roles []string, path string) []NavLink {
+	var links []NavLink
+	for _, item := range NAV_ITEMS {
+		for _, role := range roles {
+			if role == item.Role {
+				links = append(links, NavLink{
+					Title:  item.Title,
+					Path:   item.Path,
+					Active: item.Path == path,
+				})
+				break
+			}
+		}
+	}
+	return links
+}
+
+// page renders a page for the signed in member, adding the navigation and
+// flash messages the layout shows.
+func (r PlugRoutes) page(c *gin.Context, name string, data gin.H) {
+	claims, ok := c.Value(csh_auth.AuthKey).(csh_auth.CSHClaims)
+	if !ok {
+		log.Fatal("error finding claims")
+		return
+	}
+
+	data["nav"] = navLinks(r.app.Roles(claims.UserInfo.Username), c.Request.URL.Path)
+	data["flashes"] = takeFlashes(c)
+	c.HTML(http.StatusOK, name, data)
+}
+
+// readFlashes decodes the flash cookie, ignoring it if it's malformed. Only
+// known kinds are kept, as the kind ends up in a class attribute.
+func readFlashes(c *gin.Context) []Flash {
+	value, err := c.Cookie(FLASH_COOKIE)
+	if err != nil || value == "" {
+		return nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	var decoded []Flash
+	if json.Unmarshal(raw, &decoded) != nil {
+		return nil
+	}
+	var flashes []Flash
+	for _, f := range decoded {
+		switch f.Kind {
+		case FLASH_SUCCESS, FLASH_INFO, FLASH_ERROR:
+			flashes = append(flashes, f)
+		}
+	}
+	if len(flashes) > FLASH_LIMIT {
+		flashes = flashes[len(flashes)-FLASH_LIMIT:]
+	}
+	return flashes
+}
+
+func setFlashCookie(c *gin.Context, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     FLASH_COOKIE,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// flash leaves a message for the next page the member sees, which is
+// normally the one they're being redirected to.
+func flash(c *gin.Context, kind, message string) {
+	flashes := append(readFlashes(c), Flash{Kind: kind, Message: message})
+	if len(flashes) > FLASH_LIMIT {
+		flashes = flashes[len(flashes)-FLASH_LIMIT:]
+	}
+	raw, err := json.Marshal(flashes)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	setFlashCookie(c, base64.RawURLEncoding.EncodeToString(raw), FLASH_MAX_AGE)
+}
+
+// takeFlashes returns the messages waiting for the member, clearing them
+// along with any malformed cookie.
+func takeFlashes(c *gin.Context) []Flash {
+	if _, err := c.Cookie(FLASH_COOKIE); err != nil {
+		return nil
+	}
+	setFlashCookie(c, "", -1)
+	return readFlashes(c)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// flashContext makes a request carrying cookie as the flash cookie, if given.
+func flashContext(cookie string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	if cookie != "" {
+		c.Request.AddCookie(&http.Cookie{Name: FLASH_COOKIE, Value: cookie})
+	}
+	return c, w
+}
+
+// flashCookie finds the flash cookie set on the response.
+func flashCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == FLASH_COOKIE {
+			return cookie
+		}
+	}
+	t.Fatal("no flash cookie set")
+	return nil
+}
+
+func TestFlashRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, w := flashContext("")
+	flash(c, FLASH_SUCCESS, "Plug uploaded")
+	cookie := flashCookie(t, w)
+	if !cookie.HttpOnly || cookie.Path != "/" || cookie.MaxAge != FLASH_MAX_AGE {
+		t.Errorf("flash cookie = %+v", cookie)
+	}
+
+	c, w = flashContext(cookie.Value)
+	flash(c, FLASH_ERROR, `<script>alert("hi")</script>; a=b`)
+
+	c, w = flashContext(flashCookie(t, w).Value)
+	flashes := takeFlashes(c)
+	want := []Flash{
+		{FLASH_SUCCESS, "Plug uploaded"},
+		{FLASH_ERROR, `<script>alert("hi")</script>; a=b`},
+	}
+	if len(flashes) != len(want) {
+		t.Fatalf("takeFlashes() = %+v, want %+v", flashes, want)
+	}
+	for i := range want {
+		if flashes[i] != want[i] {
+			t.Errorf("flash %d = %+v, want %+v", i, flashes[i], want[i])
+		}
+	}
+	if cookie := flashCookie(t, w); cookie.MaxAge >= 0 {
+		t.Errorf("takeFlashes() left the cookie with max age %d", cookie.MaxAge)
+	}
+}
+
+func TestFlashLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cookie := ""
+	for i := 0; i < FLASH_LIMIT+3; i++ {
+		c, w := flashContext(cookie)
+		flash(c, FLASH_INFO, strconv.Itoa(i))
+		cookie = flashCookie(t, w).Value
+	}
+
+	c, _ := flashContext(cookie)
+	flashes := readFlashes(c)
+	if len(flashes) != FLASH_LIMIT {
+		t.Fatalf("kept %d flashes, want %d", len(flashes), FLASH_LIMIT)
+	}
+	if flashes[0].Message != "3" || flashes[FLASH_LIMIT-1].Message != strconv.Itoa(FLASH_LIMIT+2) {
+		t.Errorf("flashes = %+v, want the newest kept", flashes)
+	}
+}
+
+func TestMalformedFlashCookie(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name   string
+		cookie string
+		want   int
+	}{
+		{"not base64", "!!!not base64", 0},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`[]`)) + "=", 0},
+		{"not JSON", encode("not json"), 0},
+		{"not a list", encode(`{"kind":"success","message":"hi"}`), 0},
+		{"wrong types", encode(`[{"kind":1,"message":2}]`), 0},
+		{"empty list", encode(`[]`), 0},
+		{"unknown kind", encode(`[{"kind":"x\" onmouseover=\"alert(1)","message":"hi"}]`), 0},
+		{"unknown kinds dropped", encode(`[{"kind":"bogus","message":"a"},{"kind":"info","message":"b"}]`), 1},
+		{"too many", encode(`[{"kind":"info"},{"kind":"info"},{"kind":"info"},{"kind":"info"},{"kind":"info"},{"kind":"info"},{"kind":"info"}]`), FLASH_LIMIT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := flashContext(tt.cookie)
+			if flashes := takeFlashes(c); len(flashes) != tt.want {
+				t.Errorf("takeFlashes() = %+v, want %d flashes", flashes, tt.want)
+			}
+			if cookie := flashCookie(t, w); cookie.MaxAge >= 0 {
+				t.Errorf("cookie left in place with max age %d", cookie.MaxAge)
+			}
+
+			// A new flash replaces whatever couldn't be read
+			c, w = flashContext(tt.cookie)
+			flash(c, FLASH_INFO, "fresh")
+			c, _ = flashContext(flashCookie(t, w).Value)
+			if flashes := readFlashes(c); len(flashes) == 0 || flashes[len(flashes)-1].Message != "fresh" {
+				t.Errorf("flash() on a malformed cookie kept %+v", flashes)
+			}
+		})
+	}
+}
+
+func TestTakeFlashesWithoutCookie(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, w := flashContext("")
+	if flashes := takeFlashes(c); flashes != nil {
+		t.Errorf("takeFlashes() = %+v, want nil", flashes)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("takeFlashes() set %+v without a flash cookie", cookies)
+	}
+}
+
+func TestNavLinks(t *testing.T) {
+	member := navLinks([]string{ROLE_MEMBER}, "/")
+	admin := navLinks([]string{ROLE_MEMBER, ROLE_ADMIN}, "/")
+	if len(member) == 0 || len(admin) <= len(member) {
+		t.Errorf("member sees %d links, admin sees %d", len(member), len(admin))
+	}
+	for _, link := range member {
+		for _, item := range NAV_ITEMS {
+			if item.Path == link.Path && item.Role != ROLE_MEMBER {
+				t.Errorf("member sees %s link %s", item.Role, link.Path)
+			}
+		}
+	}
+	if len(navLinks(nil, "/")) != 0 {
+		t.Error("no roles still gets links")
+	}
+
+	active := 0
+	for _, link := range navLinks([]string{ROLE_MEMBER, ROLE_ADMIN}, NAV_ITEMS[0].Path) {
+		if link.Active {
+			active++
+			if link.Path != NAV_ITEMS[0].Path {
+				t.Errorf("link %s marked active", link.Path)
+			}
+		}
+	}
+	if active != 1 {
+		t.Errorf("%d links active, want 1", active)
+	}
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plug lifecycle events delivered to webhooks
+const (
+	EVENT_PLUG_UPLOADED  = "plug.uploaded"
+	EVENT_PLUG_APPROVED  = "plug.approved"
+	EVENT_PLUG_REJECTED  = "plug.rejected"
+	EVENT_PLUG_DELETED   = "plug.deleted"
+	EVENT_PLUG_EXHAUSTED = "plug.exhausted"
+)
+
+var WEBHOOK_EVENTS = []string{
+	EVENT_PLUG_UPLOADED,
+	EVENT_PLUG_APPROVED,
+	EVENT_PLUG_REJECTED,
+	EVENT_PLUG_DELETED,
+	EVENT_PLUG_EXHAUSTED,
+}
+
+// Webhook payload formats. Slack incoming webhooks want a message rather
+// than our event JSON.
+const (
+	WEBHOOK_FORMAT_JSON  = "json"
+	WEBHOOK_FORMAT_SLACK = "slack"
+)
+
+const (
+	WEBHOOK_POLL_INTERVAL  = 5 * time.Second
+	WEBHOOK_BATCH_SIZE     = 20
+	WEBHOOK_TIMEOUT        = 10 * time.Second
+	WEBHOOK_MAX_ATTEMPTS   = 8
+	WEBHOOK_INITIAL_DELAY  = 30 * time.Second
+	WEBHOOK_MAX_DELAY      = 6 * time.Hour
+	WEBHOOK_DELIVERY_LIMIT = 50
+)
+
+// Claimed deliveries aren't due again until the lease runs out, long enough
+// for a whole batch to be sent. Ones from a replica that died mid-batch are
+// picked up once it has.
+const WEBHOOK_CLAIM_LEASE = WEBHOOK_BATCH_SIZE*WEBHOOK_TIMEOUT + time.Minute
+
+const SQL_CREATE_WEBHOOKS_TABLE = `CREATE TABLE webhooks (
+id              SERIAL PRIMARY KEY,
+url             TEXT NOT NULL,
+secret          VARCHAR(64) NOT NULL,
+events          TEXT[] NOT NULL,
+format          VARCHAR(16) NOT NULL,
+enabled         BOOLEAN NOT NULL,
+created_by      VARCHAR(32) NOT NULL,
+created         TIMESTAMP NOT NULL
+);`
+
+// Events are written to the outbox in the same request that causes them and
+// delivered by a background worker, which retries with backoff until
+// WEBHOOK_MAX_ATTEMPTS is reached.
+const SQL_CREATE_WEBHOOK_OUTBOX_TABLE = `CREATE TABLE webhook_outbox (
+id              SERIAL PRIMARY KEY,
+webhook_id      INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+event           VARCHAR(32) NOT NULL,
+payload         JSONB NOT NULL,
+created         TIMESTAMP NOT NULL,
+attempts        INTEGER NOT NULL DEFAULT 0,
+next_attempt    TIMESTAMP NOT NULL,
+delivered_at    TIMESTAMP,
+failed_at       TIMESTAMP,
+last_status     INTEGER,
+last_error      TEXT
+);
+CREATE INDEX webhook_outbox_due_idx ON webhook_outbox (next_attempt)
+WHERE delivered_at IS NULL AND failed_at IS NULL;`
+
+const SQL_INSERT_WEBHOOK = `INSERT INTO webhooks (url, secret, events, format, enabled, created_by, created)
+VALUES ($1::text, $2::text, $3::text[], $4::text, true, $5::text, $6)`
+
+const SQL_RETRIEVE_WEBHOOKS = `SELECT id, url, secret, events, format, enabled, created_by, created
+FROM webhooks ORDER BY id`
+
+const SQL_SET_WEBHOOK_ENABLED = `UPDATE webhooks SET enabled=$2::boolean WHERE id=$1::integer`
+
+const SQL_DELETE_WEBHOOK = `DELETE FROM webhooks WHERE id=$1::integer`
+
+const SQL_ENQUEUE_WEBHOOK_EVENT = `INSERT INTO webhook_outbox (webhook_id, event, payload, created, next_attempt)
+SELECT id, $1::text, $2::jsonb, $3, $3 FROM webhooks
+WHERE enabled AND $1::text = ANY(events)`
+
+const SQL_CLAIM_DUE_WEBHOOK_DELIVERIES = `UPDATE webhook_outbox o SET next_attempt = $2
+FROM webhooks w
+WHERE w.id = o.webhook_id AND o.id IN (
+	SELECT id FROM webhook_outbox
+	WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt <= $1
+	ORDER BY id
+	LIMIT $3::integer
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING o.id, o.event, o.payload, o.attempts, w.url, w.secret, w.format`
+
+const SQL_RELEASE_WEBHOOK_DELIVERIES = `UPDATE webhook_outbox SET next_attempt = $2
+WHERE id = ANY($1::integer[]) AND delivered_at IS NULL AND failed_at IS NULL`
+
+const SQL_MARK_WEBHOOK_DELIVERED = `UPDATE webhook_outbox
+SET attempts=$2::integer, delivered_at=$3, last_status=$4, last_error=NULL
+WHERE id=$1::integer`
+
+const SQL_MARK_WEBHOOK_RETRY = `UPDATE webhook_outbox
+SET attempts=$2::integer, next_attempt=$3, last_status=$4, last_error=$5::text
+WHERE id=$1::integer`
+
+const SQL_MARK_WEBHOOK_FAILED = `UPDATE webhook_outbox
+SET attempts=$2::integer, failed_at=$3, last_status=$4, last_error=$5::text
+WHERE id=$1::integer`
+
+const SQL_RETRIEVE_WEBHOOK_DELIVERIES = `SELECT o.id, o.webhook_id, w.url, o.event, o.created, o.attempts,
+o.next_attempt, o.delivered_at, o.failed_at, o.last_status, o.last_error
+FROM webhook_outbox o JOIN webhooks w ON w.id = o.webhook_id
+ORDER BY o.id DESC
+LIMIT $1::integer`
+
+type Webhook struct {
+	ID        int
+	URL       string
+	Secret    string
+	Events    []string
+	Format    string
+	Enabled   bool
+	CreatedBy string
+	Created   time.Time
+}
+
+// WebhookDelivery is an outbox entry as shown in the admin delivery log
+type WebhookDelivery struct {
+	ID          int
+	WebhookID   int
+	URL         string
+	Event       string
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time
+	DeliveredAt *time.Time
+	FailedAt    *time.Time
+	LastStatus  int
+	LastError   string
+}
+
+func (d WebhookDelivery) Status() string {
+	switch {
+	case d.DeliveredAt != nil:
+		return "delivered"
+	case d.FailedAt != nil:
+		return "failed"
+	case d.Attempts > 0:
+		return "retrying"
+	}
+	return "pending"
+}
+
+type WebhookEvent struct {
+	Event string                 `json:"event"`
+	Time  time.Time              `json:"time"`
+	Actor string                 `json:"actor"`
+	Plug  WebhookPlug            `json:"plug"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+type WebhookPlug struct {
+	ID             int    `json:"id"`
+	Owner          string `json:"owner"`
+	Group          string `json:"group,omitempty"`
+	ViewsRemaining int    `json:"views_remaining"`
+	Approved       bool   `json:"approved"`
+}
+
+type pendingDelivery struct {
+	id       int
+	event    string
+	payload  []byte
+	attempts int
+	url      string
+	secret   string
+	format   string
+}
+
+type WebhookDispatcher struct {
+	app    *PlugApplication
+	client *http.Client
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func (w *WebhookDispatcher) Init(app *PlugApplication) {
+	w.app = app
+	w.client = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	w.stop = make(chan struct{})
+}
+
+// Emit queues event for every enabled webhook subscribed to it.
+func (w *WebhookDispatcher) Emit(event string, plug Plug, actor string, data map[string]interface{}) {
+	payload, err := json.Marshal(WebhookEvent{
+		Event: event,
+		Time:  time.Now().UTC(),
+		Actor: actor,
+		Plug: WebhookPlug{
+			ID:             plug.ID,
+			Owner:          plug.Owner,
+			Group:          plug.Group,
+			ViewsRemaining: plug.ViewsRemaining,
+			Approved:       plug.Approved,
+		},
+		Data: data,
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	start := time.Now()
+	_, err = w.app.db.con.Exec(SQL_ENQUEUE_WEBHOOK_EVENT, event, string(payload), time.Now())
+	w.app.metrics.ObserveDependency("postgres", "enqueue_webhook", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Start runs the delivery worker until Stop is called.
+func (w *WebhookDispatcher) Start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(WEBHOOK_POLL_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				// Keep going while there's a full batch waiting
+				for w.deliverBatch() == WEBHOOK_BATCH_SIZE && !w.stopping() {
+				}
+			}
+		}
+	}()
+}
+
+func (w *WebhookDispatcher) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+func (w *WebhookDispatcher) stopping() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// claimBatch leases due outbox entries to this replica. Rows are locked
+// with SKIP LOCKED only for the length of the claim, so several replicas can
+// share the work without holding a transaction open while sending.
+func (w *WebhookDispatcher) claimBatch() ([]pendingDelivery, error) {
+	now := time.Now()
+	start := time.Now()
+	rows, err := w.app.db.con.Query(SQL_CLAIM_DUE_WEBHOOK_DELIVERIES, now, now.Add(WEBHOOK_CLAIM_LEASE), WEBHOOK_BATCH_SIZE)
+	if err != nil {
+		w.app.metrics.ObserveDependency("postgres", "claim_webhook_deliveries", start, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		err = rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.url, &d.secret, &d.format)
+		if err != nil {
+			break
+		}
+		due = append(due, d)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	w.app.metrics.ObserveDependency("postgres", "claim_webhook_deliveries", start, err)
+	return due, err
+}
+
+// release hands back claimed deliveries which weren't attempted.
+func (w *WebhookDispatcher) release(due []pendingDelivery) {
+	ids := make([]int64, len(due))
+	for i, d := range due {
+		ids[i] = int64(d.id)
+	}
+	start := time.Now()
+	_, err := w.app.db.con.Exec(SQL_RELEASE_WEBHOOK_DELIVERIES, pq.Array(ids), time.Now())
+	w.app.metrics.ObserveDependency("postgres", "release_webhook_deliveries", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// deliverBatch sends due outbox entries, returning how many it claimed.
+// Each entry's outcome is recorded as soon as it's known, so one failed
+// update only means that entry is sent again once its lease runs out.
+func (w *WebhookDispatcher) deliverBatch() int {
+	due, err := w.claimBatch()
+	if err != nil {
+		log.Error(err)
+		return 0
+	}
+
+	for i, d := range due {
+		if w.stopping() {
+			w.release(due[i:])
+			break
+		}
+
+		status, err := w.send(d)
+		attempts := d.attempts + 1
+		now := time.Now()
+
+		fields := log.Fields{
+			"delivery_id": d.id,
+			"event":       d.event,
+			"url":         d.url,
+			"attempt":     attempts,
+			"status":      status,
+		}
+
+		con := w.app.db.con
+		start := time.Now()
+		switch {
+		case err == nil:
+			log.WithFields(fields).Info("Delivered webhook")
+			_, err = con.Exec(SQL_MARK_WEBHOOK_DELIVERED, d.id, attempts, now, status)
+		case attempts >= WEBHOOK_MAX_ATTEMPTS:
+			log.WithFields(fields).Error("Giving up on webhook: ", err)
+			_, err = con.Exec(SQL_MARK_WEBHOOK_FAILED, d.id, attempts, now, status, err.Error())
+		default:
+			log.WithFields(fields).Warn("Webhook delivery failed, will retry: ", err)
+			_, err = con.Exec(SQL_MARK_WEBHOOK_RETRY, d.id, attempts, now.Add(webhookBackoff(attempts)), status, err.Error())
+		}
+		w.app.metrics.ObserveDependency("postgres", "mark_webhook_delivery", start, err)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	return len(due)
+}
+
+// webhookBackoff doubles the delay after each failed attempt
+func webhookBackoff(attempts int) time.Duration {
+	delay := WEBHOOK_INITIAL_DELAY
+	for i := 1; i < attempts && delay < WEBHOOK_MAX_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > WEBHOOK_MAX_DELAY {
+		delay = WEBHOOK_MAX_DELAY
+	}
+	return delay
+}
+
+// SignWebhookPayload returns the value of the X-Plug-Signature header,
+// an HMAC-SHA256 of the request body keyed with the webhook's secret.
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *WebhookDispatcher) send(d pendingDelivery) (int, error) {
+	body := d.payload
+	if d.format == WEBHOOK_FORMAT_SLACK {
+		var err error
+		body, err = w.slackMessage(d.payload)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "csh-plug")
+	req.Header.Set("X-Plug-Event", d.event)
+	req.Header.Set("X-Plug-Delivery", strconv.Itoa(d.id))
+	req.Header.Set("X-Plug-Signature", SignWebhookPayload(d.secret, body))
+
+	start := time.Now()
+	resp, err := w.client.Do(req)
+	w.app.metrics.ObserveDependency("webhook", d.event, start, err)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (w *WebhookDispatcher) slackMessage(payload []byte) ([]byte, error) {
+	var event WebhookEvent
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := event.Plug.Owner
+	if event.Plug.Group != "" {
+		owner = event.Plug.Group + " (" + event.Plug.Owner + ")"
+	}
+
+	public_url := w.app.notifier.public_url
+	var text string
+	switch event.Event {
+	case EVENT_PLUG_UPLOADED:
+		text = fmt.Sprintf("Plug #%d by %s is waiting for review: %s/admin", event.Plug.ID, owner, public_url)
+	case EVENT_PLUG_APPROVED:
+		text = fmt.Sprintf("Plug #%d by %s was approved by %s", event.Plug.ID, owner, event.Actor)
+	case EVENT_PLUG_REJECTED:
+		text = fmt.Sprintf("Plug #%d by %s was rejected by %s", event.Plug.ID, owner, event.Actor)
+	case EVENT_PLUG_DELETED:
+		text = fmt.Sprintf("Plug #%d by %s was deleted by %s", event.Plug.ID, owner, event.Actor)
+	case EVENT_PLUG_EXHAUSTED:
+		text = fmt.Sprintf("Plug #%d by %s has run out of views", event.Plug.ID, owner)
+	default:
+		text = fmt.Sprintf("%s: plug #%d by %s", event.Event, event.Plug.ID, owner)
+	}
+	return json.Marshal(map[string]string{"text": text})
+}
+
+func newWebhookSecret() string {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (c DBConnection) MakeWebhook(hook Webhook) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_INSERT_WEBHOOK,
+		hook.URL,
+		hook.Secret,
+		pq.Array(hook.Events),
+		hook.Format,
+		hook.CreatedBy,
+		time.Now())
+	c.app.metrics.ObserveDependency("postgres", "make_webhook", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (c DBConnection) GetWebhooks() []Webhook {
+	start := time.Now()
+	rows, err := c.con.Query(SQL_RETRIEVE_WEBHOOKS)
+	c.app.metrics.ObserveDependency("postgres", "get_webhooks", start, err)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var obj Webhook
+		err = rows.Scan(&obj.ID, &obj.URL, &obj.Secret, pq.Array(&obj.Events), &obj.Format, &obj.Enabled, &obj.CreatedBy, &obj.Created)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		hooks = append(hooks, obj)
+	}
+	return hooks
+}
+
+func (c DBConnection) SetWebhookEnabled(id int, enabled bool) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_SET_WEBHOOK_ENABLED, id, enabled)
+	c.app.metrics.ObserveDependency("postgres", "set_webhook_enabled", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (c DBConnection) DeleteWebhook(id int) {
+	start := time.Now()
+	_, err := c.con.Exec(SQL_DELETE_WEBHOOK, id)
+	c.app.metrics.ObserveDependency("postgres", "delete_webhook", start, err)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (c DBConnection) GetWebhookDeliveries(limit int) []WebhookDelivery {
+	start := time.Now()
+	rows, err := c.con.Query(SQL_RETRIEVE_WEBHOOK_DELIVERIES, limit)
+	c.app.metrics.ObserveDependency("postgres", "get_webhook_deliveries", start, err)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var obj WebhookDelivery
+		var status sql.NullInt64
+		var lastError sql.NullString
+		err = rows.Scan(&obj.ID, &obj.WebhookID, &obj.URL, &obj.Event, &obj.Created, &obj.Attempts,
+			&obj.NextAttempt, &obj.DeliveredAt, &obj.FailedAt, &status, &lastError)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		obj.LastStatus = int(status.Int64)
+		obj.LastError = lastError.String
+		deliveries = append(deliveries, obj)
+	}
+	return deliveries
+}
+
+func (r PlugRoutes) webhooks_view(c *gin.Context) {
+	if _, ok := r.requireAdmin(c); !ok {
+		return
+	}
+
+	r.page(c, "webhooks.tmpl", gin.H{
+		"webhooks":   r.app.db.GetWebhooks(),
+		"deliveries": r.app.db.GetWebhookDeliveries(WEBHOOK_DELIVERY_LIMIT),
+		"events":     WEBHOOK_EVENTS,
+	})
+}
+
+func (r PlugRoutes) webhook_create(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	target, err := url.Parse(strings.TrimSpace(c.PostForm("url")))
+	if err != nil || (target.Scheme != "https" && target.Scheme != "http") || target.Host == "" {
+		c.String(http.StatusBadRequest, "Please give an http(s) URL for the webhook!")
+		return
+	}
+
+	var events []string
+	for _, event := range c.PostFormArray("events[]") {
+		for _, known := range WEBHOOK_EVENTS {
+			if event == known {
+				events = append(events, event)
+			}
+		}
+	}
+	if len(events) == 0 {
+		c.String(http.StatusBadRequest, "Pick at least one event!")
+		return
+	}
+
+	format := WEBHOOK_FORMAT_JSON
+	if c.PostForm("format") == WEBHOOK_FORMAT_SLACK {
+		format = WEBHOOK_FORMAT_SLACK
+	}
+
+	r.app.db.MakeWebhook(Webhook{
+		URL:       target.String(),
+		Secret:    newWebhookSecret(),
+		Events:    events,
+		Format:    format,
+		CreatedBy: claims.UserInfo.Username,
+	})
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_WEBHOOK_CREATED, 0, SEVERITY_INFO, map[string]interface{}{
+		"url":    target.String(),
+		"events": events,
+		"format": format,
+	})
+	flash(c, FLASH_SUCCESS, "Webhook added.")
+	c.Redirect(http.StatusFound, "/admin/webhooks")
+}
+
+func (r PlugRoutes) webhook_toggle(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid webhook id!")
+		return
+	}
+
+	enabled := c.PostForm("enabled") == "true"
+	r.app.db.SetWebhookEnabled(id, enabled)
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_WEBHOOK_UPDATED, 0, SEVERITY_INFO, map[string]interface{}{
+		"webhook_id": id,
+		"enabled":    enabled,
+	})
+	if enabled {
+		flash(c, FLASH_SUCCESS, "Webhook enabled.")
+	} else {
+		flash(c, FLASH_SUCCESS, "Webhook disabled.")
+	}
+	c.Redirect(http.StatusFound, "/admin/webhooks")
+}
+
+func (r PlugRoutes) webhook_deletion(c *gin.Context) {
+	claims, ok := r.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid webhook id!")
+		return
+	}
+
+	r.app.db.DeleteWebhook(id)
+	r.app.db.Audit(claims.UserInfo.Username, AUDIT_WEBHOOK_DELETED, 0, SEVERITY_INFO, map[string]interface{}{
+		"webhook_id": id,
+	})
+	flash(c, FLASH_SUCCESS, "Webhook deleted.")
+	c.Redirect(http.StatusFound, "/admin/webhooks")
+}
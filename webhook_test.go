@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	body := []byte(`{"event":"plug.approved"}`)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := SignWebhookPayload("secret", body); got != want {
+		t.Errorf("SignWebhookPayload() = %q, want %q", got, want)
+	}
+
+	// Known answer, so receivers can check their own implementations
+	const known = "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if got := SignWebhookPayload("key", []byte("The quick brown fox jumps over the lazy dog")); got != known {
+		t.Errorf("SignWebhookPayload() = %q, want %q", got, known)
+	}
+
+	if SignWebhookPayload("other", body) == want {
+		t.Error("a different secret gave the same signature")
+	}
+	if SignWebhookPayload("secret", []byte(`{"event":"plug.rejected"}`)) == want {
+		t.Error("a different body gave the same signature")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, WEBHOOK_INITIAL_DELAY},
+		{1, WEBHOOK_INITIAL_DELAY},
+		{2, 2 * WEBHOOK_INITIAL_DELAY},
+		{3, 4 * WEBHOOK_INITIAL_DELAY},
+		{7, 64 * WEBHOOK_INITIAL_DELAY},
+		{10, 512 * WEBHOOK_INITIAL_DELAY},
+		{11, WEBHOOK_MAX_DELAY},
+		{1000, WEBHOOK_MAX_DELAY},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookClaimLease(t *testing.T) {
+	// A batch sent one at a time, each taking as long as it's allowed, must
+	// finish before another replica can claim the same deliveries
+	if WEBHOOK_CLAIM_LEASE <= WEBHOOK_BATCH_SIZE*WEBHOOK_TIMEOUT {
+		t.Errorf("claim lease %v is shorter than a batch can take", WEBHOOK_CLAIM_LEASE)
+	}
+}